@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/larkiee/distributed_logger/pkg/certs"
+)
+
+// runCerts manages the TLS files of a cluster in a directory laid out the way
+// the config package expects.
+func runCerts(args []string, w io.Writer) error {
+	subcommands := map[string]command{
+		"init-ca": initCA,
+		"issue":   issue,
+		"rotate":  rotate,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		return errors.New("usage: dlogctl certs init-ca|issue|rotate [flags]")
+	}
+	return subcommands[args[0]](args[1:], w)
+}
+
+// certFlags are the flags shared by the certs subcommands.
+type certFlags struct {
+	dir  string
+	cn   string
+	org  string
+	ou   string
+	sans string
+}
+
+func (c *certFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.dir, "dir", "./config/tls/crends", "directory the files are kept in")
+}
+
+func (c *certFlags) registerSubject(fs *flag.FlagSet) {
+	fs.StringVar(&c.cn, "cn", "", "common name")
+	fs.StringVar(&c.org, "o", "", "comma separated organizations")
+	fs.StringVar(&c.ou, "ou", "", "comma separated organizational units")
+}
+
+func (c *certFlags) subject() certs.Subject {
+	return certs.Subject{
+		CommonName:         c.cn,
+		Organization:       list(c.org),
+		OrganizationalUnit: list(c.ou),
+	}
+}
+
+func list(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func initCA(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("init-ca", flag.ContinueOnError)
+	var c certFlags
+	c.register(fs)
+	c.registerSubject(fs)
+	validity := fs.Duration("validity", certs.DefaultCAValidity, "how long the authority is valid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.cn == "" {
+		c.cn = "dlog CA"
+	}
+	if err := certs.InitCA(c.dir, c.subject(), *validity); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "created %s/%s\n", c.dir, certs.CAFile)
+	return nil
+}
+
+// issue signs a server or client certificate, dlogctl certs issue server
+// -sans localhost,127.0.0.1 or dlogctl certs issue client -cn alice.
+func issue(args []string, w io.Writer) error {
+	if len(args) == 0 || (args[0] != "server" && args[0] != "client") {
+		return errors.New("usage: dlogctl certs issue server|client [flags]")
+	}
+	kind := args[0]
+	fs := flag.NewFlagSet("issue "+kind, flag.ContinueOnError)
+	var c certFlags
+	c.register(fs)
+	c.registerSubject(fs)
+	name := fs.String("name", kind, "base of the file names, <name>.pem and <name>-key.pem")
+	fs.StringVar(&c.sans, "sans", "", "comma separated host names, IPs and URIs the certificate is for")
+	validity := fs.Duration("validity", certs.DefaultCertValidity, "how long the certificate is valid")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	r := certs.Request{
+		Name:     *name,
+		Kind:     certs.Client,
+		Subject:  c.subject(),
+		SANs:     list(c.sans),
+		Validity: *validity,
+	}
+	if kind == "server" {
+		r.Kind = certs.Server
+		if r.Subject.CommonName == "" && len(r.SANs) > 0 {
+			r.Subject.CommonName = r.SANs[0]
+		}
+	}
+	if err := certs.Issue(c.dir, r); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "issued %s/%s.pem\n", c.dir, r.Name)
+	return nil
+}
+
+func rotate(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	var c certFlags
+	c.register(fs)
+	ca := fs.Bool("ca", false, "replace the authority too, keeping the old one trusted in ca.pem")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names, err := certs.Rotate(c.dir, *ca)
+	if err != nil {
+		return err
+	}
+	if *ca {
+		fmt.Fprintln(w, "rotated the authority")
+	}
+	fmt.Fprintf(w, "rotated %v\n", names)
+	return nil
+}
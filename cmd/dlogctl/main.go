@@ -0,0 +1,159 @@
+// Command dlogctl administers a dlog cluster.
+//
+//	dlogctl decommission -addr 10.0.0.1:8400
+//	dlogctl mirror -name east-west -source 10.0.0.1:8400 -target 10.1.0.1:8400 \
+//		-source-cluster east -target-cluster west -topics orders -rename orders=east-orders
+//	dlogctl certs init-ca -dir ./config/tls/crends
+//	dlogctl certs issue server -sans localhost,127.0.0.1
+//	dlogctl certs issue client -cn alice -ou writers
+//	dlogctl certs rotate
+//	dlogctl quota set -subject 'spiffe://dlog/ns/shop/*' -records 1000 -bytes 1048576
+//	dlogctl quota list
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// command runs a subcommand with its arguments, writing its output to w.
+type command func(args []string, w io.Writer) error
+
+var commands = map[string]command{
+	"certs":        runCerts,
+	"decommission": decommission,
+	"mirror":       runMirror,
+	"quota":        runQuota,
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "dlogctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return usage()
+	}
+	cmd, OK := commands[args[0]]
+	if !OK {
+		return usage()
+	}
+	return cmd(args[1:], w)
+}
+
+func usage() error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("usage: dlogctl <command> [flags], commands: %v", names)
+}
+
+// connFlags are the flags of every command talking to a server.
+type connFlags struct {
+	addr     string
+	caFile   string
+	certFile string
+	keyFile  string
+	token    string
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.addr, "addr", "127.0.0.1:8400", "RPC address of the server")
+	c.registerTLS(fs)
+}
+
+// registerTLS registers only the TLS flags, for commands dialing more than
+// one address.
+func (c *connFlags) registerTLS(fs *flag.FlagSet) {
+	fs.StringVar(&c.caFile, "ca-file", "", "CA certificate to verify the server with, plaintext when empty")
+	fs.StringVar(&c.certFile, "cert-file", "", "client certificate")
+	fs.StringVar(&c.keyFile, "key-file", "", "client key")
+	fs.StringVar(&c.token, "token", os.Getenv("DLOG_TOKEN"), "bearer JWT or API key to authenticate with over TLS, $DLOG_TOKEN by default")
+}
+
+func (c *connFlags) dial() (*grpc.ClientConn, error) {
+	opts, err := c.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(c.addr, opts...)
+}
+
+func (c *connFlags) dialOptions() ([]grpc.DialOption, error) {
+	if c.caFile == "" {
+		if c.token != "" {
+			return nil, errors.New("tokens are only sent over TLS, set -ca-file")
+		}
+		return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, nil
+	}
+	b, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate in %s", c.caFile)
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+	if c.token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.Bearer(c.token)))
+	}
+	return opts, nil
+}
+
+func decommission(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	var conn connFlags
+	conn.register(fs)
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long to wait for the data to move")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("decommission takes no arguments")
+	}
+
+	cc, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	res, err := api.NewClusterClient(cc).Decommission(ctx, &api.DecommissionRequest{})
+	if err != nil {
+		return err
+	}
+	if res.NewLeader != "" {
+		fmt.Fprintf(w, "leadership handed to %s\n", res.NewLeader)
+	}
+	fmt.Fprintf(w, "moved %d partitions, %s left the cluster\n", res.Partitions, conn.addr)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/pkg/agent"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestDecommission(t *testing.T) {
+	agents := setupAgents(t, 2)
+	addr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.EqualError(t, run([]string{"decommission", "-addr", addr, "extra"}, &out),
+		"decommission takes no arguments")
+
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].GetServers()
+		return err == nil && len(servers) == 2
+	}, 5*time.Second, 100*time.Millisecond)
+	require.NoError(t, run([]string{"decommission", "-addr", addr, "-timeout", "20s"}, &out))
+	require.Equal(t, fmt.Sprintf("leadership handed to 1\nmoved 0 partitions, %s left the cluster\n", addr), out.String())
+	select {
+	case <-agents[0].Done():
+	case <-time.After(time.Second):
+		t.Fatal("the decommissioned agent is not done")
+	}
+}
+
+func TestQuotaSet(t *testing.T) {
+	agents := setupAgents(t, 2)
+	addr, err := agents[0].RPCAddr()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].GetServers()
+		return err == nil && len(servers) == 2
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// every server gets the quota, not only the one dialed
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"quota", "set", "-addr", addr, "-subject", "*", "-records", "10"}, &out))
+	for _, a := range agents {
+		quotas, _ := a.GetQuotas()
+		require.Len(t, quotas, 1)
+		require.Equal(t, 10.0, quotas[0].RecordsPerSecond)
+	}
+	require.NoError(t, run([]string{"quota", "set", "-addr", addr, "-subject", "*"}, &out))
+	require.Equal(t, "removed the quota of * from 2 servers\n", out.String())
+	for _, a := range agents {
+		quotas, _ := a.GetQuotas()
+		require.Empty(t, quotas)
+	}
+}
+
+// setupAgents starts a cluster of n agents, the first one leading.
+func setupAgents(t *testing.T, n int) []*agent.Agent {
+	t.Helper()
+	var agents []*agent.Agent
+	t.Cleanup(func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	})
+	for i := 0; i < n; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("dlogctl-0%d-", i))
+		require.NoError(t, err)
+		c := agent.Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:   ports[1],
+			Bootstrap: i == 0,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := agent.New(c)
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	return agents
+}
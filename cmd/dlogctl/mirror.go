@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/larkiee/distributed_logger/pkg/mirror"
+)
+
+// runMirror copies topics between clusters until interrupted.
+func runMirror(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	var conn connFlags
+	conn.registerTLS(fs)
+	var c mirror.Config
+	fs.StringVar(&c.Name, "name", "", "name of the mirror, checkpoints are kept under it")
+	fs.StringVar(&c.SourceAddr, "source", "", "dial target of the source cluster")
+	fs.StringVar(&c.TargetAddr, "target", "", "dial target of the target cluster")
+	fs.StringVar(&c.SourceCluster, "source-cluster", "", "name of the source cluster")
+	fs.StringVar(&c.TargetCluster, "target-cluster", "", "name of the target cluster")
+	fs.StringVar(&c.CheckpointTopic, "checkpoint-topic", "", "target topic checkpoints are kept in, "+mirror.DefaultCheckpointTopic+".<name> by default")
+	topics := fs.String("topics", "", "comma separated source topics")
+	rename := fs.String("rename", "", "comma separated source=target topic renames")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *topics == "" {
+		return errors.New("mirror needs -topics")
+	}
+	c.Topics = strings.Split(*topics, ",")
+	if *rename != "" {
+		c.Rename = make(map[string]string)
+		for _, r := range strings.Split(*rename, ",") {
+			from, to, OK := strings.Cut(r, "=")
+			if !OK {
+				return fmt.Errorf("bad rename %q, want source=target", r)
+			}
+			c.Rename[from] = to
+		}
+	}
+	opts, err := conn.dialOptions()
+	if err != nil {
+		return err
+	}
+	c.SourceDialOptions, c.TargetDialOptions = opts, opts
+
+	m, err := mirror.New(c)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "mirroring %v from %s to %s\n", c.Topics, c.SourceCluster, c.TargetCluster)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	if err = m.Close(); err != nil {
+		return err
+	}
+	mirrored, skipped := m.Stats()
+	fmt.Fprintf(w, "mirrored %d records, skipped %d from %s\n", mirrored, skipped, c.TargetCluster)
+	return nil
+}
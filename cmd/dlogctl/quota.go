@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"google.golang.org/grpc"
+)
+
+// runQuota sets the produce quotas of the servers of the cluster and
+// lists those of one of them.
+func runQuota(args []string, w io.Writer) error {
+	subcommands := map[string]command{
+		"set":  setQuota,
+		"list": listQuotas,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		return errors.New("usage: dlogctl quota set|list [flags]")
+	}
+	return subcommands[args[0]](args[1:], w)
+}
+
+func setQuota(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("quota set", flag.ContinueOnError)
+	var conn connFlags
+	conn.register(fs)
+	q := &api.Quota{}
+	fs.StringVar(&q.Subject, "subject", "", "clients the quota applies to, * matching any run of characters")
+	fs.StringVar(&q.Topic, "topic", "", "topics the quota applies to, all of them together when empty")
+	fs.Float64Var(&q.RecordsPerSecond, "records", 0, "records per second, unlimited when 0")
+	fs.Float64Var(&q.BytesPerSecond, "bytes", 0, "bytes per second, unlimited when 0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if q.Subject == "" {
+		return errors.New("quota set needs a -subject")
+	}
+
+	cc, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// each server enforces its own quotas, so all of them are given the
+	// quota. Servers joining later start from their -quotas-file
+	res, err := api.NewClusterClient(cc).GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return err
+	}
+	opts, err := conn.dialOptions()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, s := range res.Servers {
+		if err = setServerQuota(ctx, s.RpcAddr, opts, q); err != nil {
+			fmt.Fprintf(w, "%s: %v\n", s.RpcAddr, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("quota not set on %d of %d servers", failed, len(res.Servers))
+	}
+	if q.RecordsPerSecond == 0 && q.BytesPerSecond == 0 {
+		fmt.Fprintf(w, "removed the quota of %s from %d servers\n", q.Subject, len(res.Servers))
+	}
+	return nil
+}
+
+func setServerQuota(ctx context.Context, addr string, opts []grpc.DialOption, q *api.Quota) error {
+	cc, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	_, err = api.NewClusterClient(cc).SetQuota(ctx, &api.SetQuotaRequest{Quota: q})
+	return err
+}
+
+func listQuotas(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("quota list", flag.ContinueOnError)
+	var conn connFlags
+	conn.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cc, err := conn.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := api.NewClusterClient(cc).GetQuotas(ctx, &api.GetQuotasRequest{})
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBJECT\tTOPIC\tRECORDS/S\tBYTES/S")
+	for _, q := range res.Quotas {
+		fmt.Fprintf(tw, "%s\t%s\t%g\t%g\n", q.Subject, q.Topic, q.RecordsPerSecond, q.BytesPerSecond)
+	}
+	fmt.Fprintln(tw, "\nCLIENT\tRECORDS\tBYTES\tTHROTTLED")
+	for _, c := range res.Clients {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", c.Subject, c.Records, c.Bytes, c.Throttled)
+	}
+	return tw.Flush()
+}
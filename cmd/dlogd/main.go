@@ -0,0 +1,204 @@
+// dlogd runs a cluster node.
+//
+// Settings come from flags, environment variables and a YAML config
+// file, in that order of precedence, as loaded by config.LoadFlags.
+// Every flag has an environment variable named after it, -data-dir
+// being DLOGD_DATA_DIR, and the config file nests them by section:
+//
+//	dlogd -config /etc/dlogd.yaml -node-name node-1 -join 10.0.0.1:8401
+//
+// with /etc/dlogd.yaml holding for instance
+//
+//	server:
+//	  dataDir: /var/lib/dlogd
+//	segment:
+//	  maxStoreBytes: 67108864
+//	retention:
+//	  maxAge: 168h
+//
+// The node runs until SIGINT or SIGTERM, or until it is decommissioned.
+// The TLS files are read again whenever they change and on SIGHUP, so
+// rotated certificates are picked up without a restart.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/larkiee/distributed_logger/pkg/agent"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/quota"
+)
+
+// Exit codes, flag errors exit with 2 like the flag package does.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+func run(args []string, w io.Writer) int {
+	c, reloaders, err := parseConfig(args, w)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	var usage usageError
+	if errors.As(err, &usage) {
+		fmt.Fprintln(w, "dlogd:", err)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(w, "dlogd:", err)
+		return exitFailure
+	}
+	defer closeAll(reloaders)
+
+	// signals are caught before the agent starts so an early one still
+	// shuts it down cleanly, SIGHUP reloads the TLS files
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	a, err := agent.New(c)
+	if err != nil {
+		fmt.Fprintln(w, "dlogd: starting agent:", err)
+		return exitFailure
+	}
+wait:
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reload(reloaders, w)
+				continue
+			}
+			fmt.Fprintf(w, "dlogd: %v, shutting down\n", s)
+			break wait
+		case <-a.Done():
+			break wait
+		}
+	}
+	if err = a.Shutdown(); err != nil {
+		fmt.Fprintln(w, "dlogd: shutting down:", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// reload reads the TLS files again, keeping the loaded ones on errors.
+func reload(reloaders []*config.Reloader, w io.Writer) {
+	for _, r := range reloaders {
+		if err := r.Reload(); err != nil {
+			fmt.Fprintln(w, "dlogd: reloading TLS files:", err)
+			return
+		}
+	}
+	fmt.Fprintln(w, "dlogd: reloaded TLS files")
+}
+
+// usageError is a misuse of the command line, as opposed to settings
+// that fail to load.
+type usageError struct {
+	error
+}
+
+// parseConfig returns the agent config and the reloaders of its TLS
+// files, to be closed by the caller.
+func parseConfig(args []string, w io.Writer) (agent.Config, []*config.Reloader, error) {
+	fs := flag.NewFlagSet("dlogd", flag.ContinueOnError)
+	fs.SetOutput(w)
+	configFile := fs.String("config", os.Getenv("DLOGD_CONFIG"), "YAML config file, $DLOGD_CONFIG when not given")
+	config.Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return agent.Config{}, nil, err
+		}
+		return agent.Config{}, nil, usageError{err}
+	}
+	if fs.NArg() > 0 {
+		return agent.Config{}, nil, usageError{fmt.Errorf("unexpected arguments %v", fs.Args())}
+	}
+	c, err := config.LoadFlags(*configFile, fs)
+	if err != nil {
+		return agent.Config{}, nil, err
+	}
+	return agentConfig(c)
+}
+
+// agentConfig loads the files c names into the agent config. The TLS
+// files are read again when they change, until the returned reloaders
+// are closed.
+func agentConfig(c config.Config) (ac agent.Config, reloaders []*config.Reloader, err error) {
+	ac = agent.Config{
+		DataDir:        c.Server.DataDir,
+		BindAddr:       c.Discovery.BindAddr,
+		RPCPort:        c.Server.RPCPort,
+		NodeName:       c.Discovery.NodeName,
+		StartJoinAddrs: c.Discovery.StartJoinAddrs,
+		RetryJoin:      c.Discovery.RetryJoin,
+		Bootstrap:      c.Discovery.Bootstrap,
+		LogConfig:      c.LogConfig(),
+		ACLFile:        c.Auth.ACLFile,
+		JWTKeysFile:    c.Auth.JWTKeysFile,
+		APIKeysFile:    c.Auth.APIKeysFile,
+		MetricsAddr:    c.Telemetry.MetricsAddr,
+	}
+	ac.Telemetry.Exporter = c.Telemetry.Exporter
+	ac.Telemetry.Endpoint = c.Telemetry.Endpoint
+	ac.Telemetry.Insecure = c.Telemetry.Insecure
+	ac.Telemetry.MetricInterval = c.Telemetry.MetricInterval
+	// validated by Load
+	ac.EncryptKey, _ = c.Discovery.Key()
+	if c.Server.QuotasFile != "" {
+		if ac.Quotas, err = quota.Load(c.Server.QuotasFile); err != nil {
+			return ac, nil, err
+		}
+	}
+	var r *config.Reloader
+	if ac.ServerTLSConfig, r, err = tlsConfig(c.TLS.Server.Files(), config.TLSRequest{IsServer: true}); err != nil {
+		return ac, nil, fmt.Errorf("server TLS: %w", err)
+	}
+	if r != nil {
+		reloaders = append(reloaders, r)
+	}
+	// peers are verified against the host gossip binds to, like the
+	// agent does for configs without a server name
+	host, _, _ := net.SplitHostPort(c.Discovery.BindAddr)
+	if ac.PerrTLSConfig, r, err = tlsConfig(c.TLS.Peer.Files(), config.TLSRequest{ServerAddr: host}); err != nil {
+		closeAll(reloaders)
+		return ac, nil, fmt.Errorf("peer TLS: %w", err)
+	}
+	if r != nil {
+		reloaders = append(reloaders, r)
+	}
+	return ac, reloaders, nil
+}
+
+// tlsConfig loads the TLS config, nil when no file is given.
+func tlsConfig(files config.TLSConfig, req config.TLSRequest) (*tls.Config, *config.Reloader, error) {
+	if files.CAFile == "" && files.ServerCertFile == "" && files.ClientCertFile == "" {
+		return nil, nil, nil
+	}
+	r, err := config.NewReloader(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.TLSConfig(req), r, nil
+}
+
+func closeAll(reloaders []*config.Reloader) {
+	for _, r := range reloaders {
+		r.Close()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// TestMain lets the tests start the test binary itself as a daemon.
+func TestMain(m *testing.M) {
+	if os.Getenv("RUN_DLOGD") == "1" {
+		os.Exit(run(os.Args[1:], os.Stderr))
+	}
+	os.Exit(m.Run())
+}
+
+func TestDaemons(t *testing.T) {
+	ports := dynaport.Get(4)
+	dir := t.TempDir()
+
+	// the first node is set up from a config file
+	config := filepath.Join(dir, "dlogd.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(fmt.Sprintf(`
+server:
+  dataDir: %s
+  rpcPort: %d
+discovery:
+  bindAddr: 127.0.0.1:%d
+  nodeName: "0"
+  bootstrap: true
+`, filepath.Join(dir, "0"), ports[1], ports[0])), 0644))
+	first := startDaemon(t, nil, "-config", config)
+
+	// the second one from the environment and flags
+	second := startDaemon(t, []string{
+		"DLOGD_DATA_DIR=" + filepath.Join(dir, "1"),
+		fmt.Sprintf("DLOGD_BIND_ADDR=127.0.0.1:%d", ports[2]),
+		fmt.Sprintf("DLOGD_RPC_PORT=%d", ports[3]),
+		fmt.Sprintf("DLOGD_JOIN=127.0.0.1:%d", ports[0]),
+		// the first node may not be up yet
+		"DLOGD_RETRY_JOIN=true",
+		"DLOGD_NODE_NAME=ignored",
+	}, "-node-name", "1")
+
+	leader := dial(t, ports[1])
+	follower := dial(t, ports[3])
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		res, err := api.NewClusterClient(follower).GetServers(ctx, &api.GetServersRequest{})
+		if err != nil || len(res.Servers) != 2 {
+			return false
+		}
+		names := map[string]bool{}
+		for _, s := range res.Servers {
+			names[s.Id] = true
+		}
+		return names["0"] && names["1"]
+	}, 10*time.Second, 100*time.Millisecond)
+
+	res, err := api.NewLogClient(leader).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := api.NewLogClient(follower).Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+		return err == nil && string(got.Record.Value) == "hello"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for _, d := range []*exec.Cmd{second, first} {
+		require.NoError(t, d.Process.Signal(syscall.SIGTERM))
+		require.NoError(t, d.Wait())
+		require.Equal(t, exitOK, d.ProcessState.ExitCode())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	require.Equal(t, exitUsage, run([]string{"-rpc-port", "eighty"}, io.Discard))
+	require.Equal(t, exitUsage, run([]string{"extra"}, io.Discard))
+	require.Equal(t, exitOK, run([]string{"-h"}, io.Discard))
+
+	config := filepath.Join(t.TempDir(), "dlogd.yaml")
+	require.NoError(t, os.WriteFile(config, []byte("server:\n  rpcProt: 8400\n"), 0644))
+	require.Equal(t, exitFailure, run([]string{"-config", config}, io.Discard))
+	require.Equal(t, exitFailure, run([]string{"-quotas-file", filepath.Join(t.TempDir(), "missing.yaml")}, io.Discard))
+	require.Equal(t, exitFailure, run([]string{"-server-tls-cert-file", "missing.pem", "-server-tls-key-file", "missing-key.pem"}, io.Discard))
+
+	t.Setenv("DLOGD_RPC_PORT", "eighty")
+	require.Equal(t, exitFailure, run(nil, io.Discard))
+}
+
+func TestOverrides(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "dlogd.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`
+server:
+  dataDir: /from/file
+  rpcPort: 9000
+segment:
+  maxStoreBytes: 4096
+retention:
+  maxAge: 24h
+discovery:
+  nodeName: file
+  startJoinAddrs: [10.0.0.1:8401, 10.0.0.2:8401]
+`), 0644))
+	t.Setenv("DLOGD_NODE_NAME", "env")
+	t.Setenv("DLOGD_RPC_PORT", "9100")
+	c, reloaders, err := parseConfig([]string{"-config", config, "-rpc-port", "9200"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "/from/file", c.DataDir)
+	require.Equal(t, "env", c.NodeName)
+	require.Equal(t, 9200, c.RPCPort)
+	require.Equal(t, []string{"10.0.0.1:8401", "10.0.0.2:8401"}, c.StartJoinAddrs)
+	require.Equal(t, uint64(4096), c.LogConfig.DefaultTopic.Log.Segment.MaxStoreBytes)
+	require.Equal(t, 24*time.Hour, c.LogConfig.DefaultTopic.Log.Retention.MaxAge)
+	require.Nil(t, c.ServerTLSConfig)
+	require.Empty(t, reloaders)
+}
+
+func startDaemon(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "RUN_DLOGD=1"), env...)
+	out := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		if t.Failed() {
+			t.Logf("%v:\n%s", args, out)
+		}
+	})
+	return cmd
+}
+
+func dial(t *testing.T, port int) *grpc.ClientConn {
+	t.Helper()
+	cc, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
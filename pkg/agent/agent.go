@@ -1,19 +1,31 @@
 package agent
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"path"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hashicorp/serf/serf"
 	"github.com/larkiee/distributed_logger/api/v1"
-	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/auth"
 	"github.com/larkiee/distributed_logger/pkg/discovery"
 	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/placement"
+	"github.com/larkiee/distributed_logger/pkg/quota"
 	"github.com/larkiee/distributed_logger/pkg/server"
+	"github.com/larkiee/distributed_logger/pkg/telemetry"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Config struct {
@@ -24,6 +36,66 @@ type Config struct {
 	RPCPort int
 	NodeName string
 	StartJoinAddrs []string
+	// LogConfig configures the topics stored under DataDir.
+	LogConfig log.ManagerConfig
+	// ReplicationFactor is how many nodes hold each topic partition.
+	ReplicationFactor int
+	// RebalanceInterval is how often partition placement is checked
+	// besides on membership changes.
+	RebalanceInterval time.Duration
+	// AntiEntropyInterval is how often partitions are compared with
+	// their authoritative replicas.
+	AntiEntropyInterval time.Duration
+	// Bootstrap marks this node as the cluster leader that accepts produces.
+	// A restarted bootstrap node takes back the epoch it led, unless a
+	// newer one was started meanwhile.
+	Bootstrap bool
+	// EncryptKey and Keyring encrypt the gossip between agents, see
+	// discovery.Config. Key changes are kept in DataDir/keyring.
+	EncryptKey []byte
+	Keyring [][]byte
+	// Discovery builds the discoverer finding the other agents, such as
+	// discovery.NewStatic or discovery.NewDNS, for networks without
+	// gossip. Agents gossip through serf when it is nil.
+	Discovery func(local discovery.Member, h discovery.Handler) (discovery.Discoverer, error)
+	// RetryJoin keeps trying StartJoinAddrs in the background when none
+	// of them can be joined at first.
+	RetryJoin bool
+	// JoinFailed, when set, is told about every failed attempt to join
+	// StartJoinAddrs.
+	JoinFailed func(err error)
+	// Zone and Rack locate the agent, partition replicas are spread over
+	// zones and clients can prefer reading from their own zone.
+	Zone string
+	Rack string
+	// LeaseDuration lets a leader serve linearizable consumes and take
+	// produces for that long after a majority last confirmed its epoch,
+	// two seconds when it is 0. Every such call asks the majority again
+	// when it is negative. A promoted leader waits as long before taking
+	// produces.
+	LeaseDuration time.Duration
+	// ACLFile is a policy file authorizing the calls clients make, see
+	// auth.Authorizer. Every caller may do anything when it is empty.
+	// Agents consume from each other, so their identities need to be
+	// allowed to.
+	ACLFile string
+	// JWTKeysFile, a JSON Web Key set, and APIKeysFile, see
+	// auth.LoadAPIKeys, let clients authenticate with bearer tokens
+	// instead of client certificates.
+	JWTKeysFile string
+	APIKeysFile string
+	// Quotas limit what each client produces to this node, see
+	// quota.Rule. They can be changed at runtime through the SetQuota RPC.
+	Quotas []quota.Rule
+	// Logger logs the calls served and what the agent does, a
+	// development logger when nil.
+	Logger *zap.Logger
+	// Telemetry configures where the spans and metrics of the agent are
+	// exported, nowhere by default.
+	Telemetry telemetry.Config
+	// MetricsAddr is the address metrics are served on for Prometheus to
+	// scrape, at /metrics. They are not served when it is empty.
+	MetricsAddr string
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -36,14 +108,44 @@ func (c Config) RPCAddr() (string, error) {
 
 type Agent struct {
 	Config
-	log *log.Log
+	log *log.Manager
 	server *grpc.Server
-	membership *discovery.Membership
+	membership discovery.Discoverer
 	replicator *log.Replicator
+	authorizer *auth.Authorizer
+	limiter *quota.Limiter
+	telemetry *telemetry.Telemetry
+	metrics *http.Server
+	placement *placement.Engine
+	antiEntropy *log.AntiEntropy
+	dialOptions []grpc.DialOption
+	leader atomic.Bool
+	draining atomic.Bool
+	// epoch is the newest leadership epoch known, leaderEpoch the one
+	// this agent leads.
+	epoch atomic.Uint64
+	leaderEpoch atomic.Uint64
+	// epochLock orders the writes of the epoch file.
+	epochLock sync.Mutex
+	// ready is closed once the membership is set up.
+	ready chan struct{}
+	// voters are the members a leader needs a majority of to confirm its
+	// epoch and peers the connections it asks them over, confirmed is
+	// when it last did for confirmedEpoch and ledSince when the agent
+	// started a new epoch.
+	quorumLock sync.Mutex
+	voters map[string]discovery.Member
+	peers map[string]*grpc.ClientConn
+	confirmed time.Time
+	confirmedEpoch uint64
+	ledSince time.Time
 
 	shutdown bool
 	shutdowns chan struct {}
 	shutdownLock sync.Mutex
+	// done is closed once the agent was decommissioned or shut down.
+	done chan struct{}
+	doneOnce sync.Once
 }
 
 func New(c Config) (*Agent, error){
@@ -51,10 +153,16 @@ func New(c Config) (*Agent, error){
 		Config: c,
 	}
 	a.shutdowns = make(chan struct{})
+	a.done = make(chan struct{})
+	a.ready = make(chan struct{})
+	a.voters = make(map[string]discovery.Member)
+	a.peers = make(map[string]*grpc.ClientConn)
 
 	setups := []func() error{
 		a.setupLogger,
+		a.setupTelemetry,
 		a.setupLog,
+		a.setupEpoch,
 		a.setupServer,
 		a.setupMembership,
 	}
@@ -65,21 +173,54 @@ func New(c Config) (*Agent, error){
 			return nil, err
 		}
 	}
+	close(a.ready)
 
 	return a, nil
 }
 
 func (a *Agent) setupLogger() error {
-	logger, err := zap.NewDevelopment()
+	if a.Logger == nil {
+		logger, err := zap.NewDevelopment()
+		if err != nil {
+			return err
+		}
+		a.Logger = logger
+	}
+	zap.ReplaceGlobals(a.Logger)
+	return nil
+}
+
+func (a *Agent) setupTelemetry() error {
+	a.Telemetry.Prometheus = a.MetricsAddr != ""
+	t, err := telemetry.New(a.Telemetry)
 	if err != nil {
 		return err
 	}
-	zap.ReplaceGlobals(logger)
+	a.telemetry = t
+	if a.MetricsAddr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", t.MetricsHandler)
+	a.metrics = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := a.metrics.Serve(l); err != nil && err != http.ErrServerClosed {
+			zap.L().Error("failed to serve metrics", zap.Error(err))
+		}
+	}()
 	return nil
 }
 
 func (a *Agent) setupLog() error {
-	l, err := log.NewLog(a.DataDir, log.Config{})
+	if a.LogConfig.RetentionInterval == 0 {
+		a.LogConfig.RetentionInterval = time.Minute
+	}
+	a.LogConfig.MeterProvider = a.telemetry.MeterProvider
+	l, err := log.NewManager(a.DataDir, a.LogConfig)
 	if err != nil {
 		return err
 	}
@@ -88,23 +229,55 @@ func (a *Agent) setupLog() error {
 }
 
 func (a *Agent) setupServer() error {
-	opts := []grpc.ServerOption{}
-	host, _, _ := net.SplitHostPort(a.BindAddr)
+	opts := []server.Option{
+		server.WithLogger(a.Logger),
+		server.WithTracerProvider(a.telemetry.TracerProvider),
+		server.WithMeterProvider(a.telemetry.MeterProvider),
+	}
 	if a.ServerTLSConfig != nil {
-		tlsCfg, err := config.GetTLSConfig(config.TLSRequest{
-			IsServer: true,
-			ServerAddr: host,
-		})
+		tlsCrends := credentials.NewTLS(a.ServerTLSConfig)
+		opts = append(opts, server.WithServerOptions(grpc.Creds(tlsCrends)))
+	}
+	authenticator, err := a.authenticator()
+	if err != nil {
+		return err
+	}
+	unary := []grpc.UnaryServerInterceptor{authenticator.UnaryServerInterceptor}
+	stream := []grpc.StreamServerInterceptor{authenticator.StreamServerInterceptor}
+	if a.ACLFile != "" {
+		authorizer, err := auth.NewAuthorizer(a.ACLFile)
 		if err != nil {
 			return err
 		}
-		tlsCrends := credentials.NewTLS(tlsCfg)
-		opts = append(opts, grpc.Creds(tlsCrends))
+		a.authorizer = authorizer
+		unary = append(unary, authorizer.UnaryServerInterceptor)
+		stream = append(stream, authorizer.StreamServerInterceptor)
+	}
+	// produces are counted against the quotas of the client once it is
+	// known, allowed to and past the fencing, so those turned away take
+	// no tokens
+	if a.limiter, err = quota.New(a.Quotas, a.telemetry.MeterProvider); err != nil {
+		return err
 	}
+	opts = append(opts,
+		server.WithUnaryInterceptors(append(unary,
+			a.drainUnaryInterceptor,
+			a.epochUnaryInterceptor,
+			a.limiter.UnaryServerInterceptor,
+			a.consistencyUnaryInterceptor,
+		)...),
+		server.WithStreamInterceptors(append(stream,
+			a.drainStreamInterceptor,
+			a.epochStreamInterceptor,
+			a.limiter.StreamServerInterceptor,
+			a.consistencyStreamInterceptor,
+		)...),
+	)
 	s, _, err := server.NewGRPCServer(a.log, opts...)
 	if err != nil {
 		return err
 	}
+	server.RegisterClusterServer(s, a)
 	a.server = s
 
 	rpcAddr, err := a.RPCAddr()
@@ -123,6 +296,27 @@ func (a *Agent) setupServer() error {
 	return nil
 }
 
+// authenticator reads the identities of callers from their client
+// certificates or from the bearer tokens the key files verify.
+func (a *Agent) authenticator() (*auth.Authenticator, error) {
+	authenticator := &auth.Authenticator{}
+	if a.JWTKeysFile != "" {
+		keys, err := auth.LoadKeys(a.JWTKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.Verifiers = append(authenticator.Verifiers, &auth.JWTVerifier{Keys: keys, Leeway: time.Minute})
+	}
+	if a.APIKeysFile != "" {
+		keys, err := auth.LoadAPIKeys(a.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.Verifiers = append(authenticator.Verifiers, keys)
+	}
+	return authenticator, nil
+}
+
 func (a *Agent) setupMembership() error{
 	opts := []grpc.DialOption{}
 
@@ -132,17 +326,18 @@ func (a *Agent) setupMembership() error{
 	}
 	host, _, _ := net.SplitHostPort(a.BindAddr)
 	if a.PerrTLSConfig != nil {
-		tlsConfig, err := config.GetTLSConfig(config.TLSRequest{
-			IsServer: false,
-			ServerAddr: host,
-		})
-		if err != nil {
-			return err
+		tlsConfig := a.PerrTLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
 		}
 		tlsCrends := credentials.NewTLS(tlsConfig)
 		opts = append(opts, grpc.WithTransportCredentials(tlsCrends))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	}
 
+	a.dialOptions = opts
+
 	cc, err := grpc.Dial(rpcAddr, opts...)
 	if err != nil {
 		return err
@@ -151,25 +346,254 @@ func (a *Agent) setupMembership() error{
 	replicator := &log.Replicator{
 		DialOptions: opts,
 		LocalServer: client,
+		Local:       a.log,
+		Follow:      a.follow,
+		Zone:        a.Zone,
 	}
 	a.replicator = replicator
 
-	c := discovery.Config{
-		NodeName: a.NodeName,
-		BindAddr: a.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
+	a.placement, err = placement.New(placement.Config{
+		Local: placement.Member{
+			Name: a.NodeName,
+			RPCAddr: rpcAddr,
+			Zone: a.Zone,
+			Rack: a.Rack,
+			LeaderEpoch: a.leading(),
 		},
-		StartJoinAddrs: a.StartJoinAddrs,
+		ReplicationFactor: a.ReplicationFactor,
+		Dir: a.DataDir,
+		Interval: a.RebalanceInterval,
+	}, &partitionMover{
+		log: a.log,
+		dialOptions: opts,
+		logger: zap.L().Named("placement"),
+	})
+	if err != nil {
+		return err
 	}
 
-	a.membership, err = discovery.NewMembership(c, a.replicator)
+	tags := a.tags()
+	handler := discovery.Handlers{
+		// the epoch goes first so the replicator follows the newest leader
+		epochWatch{agent: a},
+		a.replicator,
+		a.placement,
+	}
+	if a.Discovery != nil {
+		a.membership, err = a.Discovery(discovery.Member{
+			Name: a.NodeName,
+			RPCAddr: rpcAddr,
+			Tags: tags,
+		}, handler)
+	} else {
+		a.membership, err = discovery.NewMembership(discovery.Config{
+			NodeName: a.NodeName,
+			BindAddr: a.BindAddr,
+			Tags: tags,
+			StartJoinAddrs: a.StartJoinAddrs,
+			EncryptKey: a.EncryptKey,
+			Keyring: a.Keyring,
+			KeyringFile: path.Join(a.DataDir, "keyring"),
+			SnapshotPath: path.Join(a.DataDir, "serf.snapshot"),
+			RetryJoin: a.RetryJoin,
+			JoinFailed: a.JoinFailed,
+		}, handler)
+	}
 	if err != nil {
 		return err
 	}
+
+	a.antiEntropy = &log.AntiEntropy{
+		Log: a.log,
+		DialOptions: opts,
+		Authority: a.authority,
+		Interval: a.AntiEntropyInterval,
+	}
+	a.antiEntropy.Start()
 	return nil
 }
 
+// authority returns the RPC address of the replica a local partition is
+// checked against: the leader of the newest epoch for the default topic
+// and the primary replica for the others. It is empty when this node is
+// the authority.
+func (a *Agent) authority(topic string, partition uint32) string {
+	if topic == log.DefaultTopic {
+		var addr string
+		var newest uint64
+		for _, member := range a.membership.Alive() {
+			if member.Tags["role"] != "leader" || member.Name == a.NodeName {
+				continue
+			}
+			if epoch := tagEpoch(member.Tags); addr == "" || epoch > newest {
+				addr, newest = member.RPCAddr, epoch
+			}
+		}
+		if a.leader.Load() && a.leaderEpoch.Load() >= newest {
+			return ""
+		}
+		return addr
+	}
+	m, OK := a.placement.Primary(placement.Partition{Topic: topic, ID: partition})
+	if !OK || m.Name == a.NodeName {
+		return ""
+	}
+	return m.RPCAddr
+}
+
+func (a *Agent) role() string {
+	if a.leader.Load() {
+		return "leader"
+	}
+	return "follower"
+}
+
+// tags are what the agent advertises to the other members.
+func (a *Agent) tags() map[string]string {
+	rpcAddr, _ := a.RPCAddr()
+	tags := map[string]string{
+		"rpc_addr": rpcAddr,
+		"role": a.role(),
+		"epoch": strconv.FormatUint(a.epoch.Load(), 10),
+	}
+	if a.Zone != "" {
+		tags["zone"] = a.Zone
+	}
+	if a.Rack != "" {
+		tags["rack"] = a.Rack
+	}
+	if a.draining.Load() {
+		tags["draining"] = "true"
+	}
+	return tags
+}
+
+// Tags returns the tags the agent advertises, for the discoverers
+// without gossip to ask for them.
+func (a *Agent) Tags() map[string]string {
+	return a.tags()
+}
+
+// GetServers returns the alive members of the cluster, flagging the leader
+// so clients can route produces to it.
+func (a *Agent) GetServers() ([]*api.Server, error) {
+	if a.membership == nil {
+		return nil, errors.New("membership is not set up yet")
+	}
+	var servers []*api.Server
+	for _, member := range a.membership.Alive() {
+		servers = append(servers, &api.Server{
+			Id: member.Name,
+			RpcAddr: member.RPCAddr,
+			IsLeader: member.Tags["role"] == "leader",
+			Zone: member.Tags["zone"],
+			Rack: member.Tags["rack"],
+		})
+	}
+	return servers, nil
+}
+
+// InstallKey, UseKey, RemoveKey and ListKeys let the cluster service
+// rotate the gossip keys of every agent.
+func (a *Agent) InstallKey(key string) (*api.KeyResponse, error) {
+	m, err := a.gossip()
+	if err != nil {
+		return nil, err
+	}
+	return keyResponse(m.InstallKey(key))
+}
+
+func (a *Agent) UseKey(key string) (*api.KeyResponse, error) {
+	m, err := a.gossip()
+	if err != nil {
+		return nil, err
+	}
+	return keyResponse(m.UseKey(key))
+}
+
+func (a *Agent) RemoveKey(key string) (*api.KeyResponse, error) {
+	m, err := a.gossip()
+	if err != nil {
+		return nil, err
+	}
+	return keyResponse(m.RemoveKey(key))
+}
+
+func (a *Agent) ListKeys() (*api.KeyResponse, error) {
+	m, err := a.gossip()
+	if err != nil {
+		return nil, err
+	}
+	return keyResponse(m.ListKeys())
+}
+
+// SetQuota and GetQuotas let the cluster service change the quotas of
+// the agent and see what its clients produce.
+func (a *Agent) SetQuota(q *api.Quota) error {
+	return a.limiter.Set(quota.Rule{
+		Subject:          q.Subject,
+		Topic:            q.Topic,
+		RecordsPerSecond: q.RecordsPerSecond,
+		BytesPerSecond:   q.BytesPerSecond,
+	})
+}
+
+func (a *Agent) GetQuotas() ([]*api.Quota, []*api.ClientUsage) {
+	rules := a.limiter.Rules()
+	quotas := make([]*api.Quota, 0, len(rules))
+	for _, r := range rules {
+		quotas = append(quotas, &api.Quota{
+			Subject:          r.Subject,
+			Topic:            r.Topic,
+			RecordsPerSecond: r.RecordsPerSecond,
+			BytesPerSecond:   r.BytesPerSecond,
+		})
+	}
+	return quotas, a.limiter.Usage()
+}
+
+// gossip returns the serf membership, the only discoverer with keys.
+func (a *Agent) gossip() (*discovery.Membership, error) {
+	m, OK := a.membership.(*discovery.Membership)
+	if !OK {
+		return nil, errors.New("gossip keys need serf discovery")
+	}
+	return m, nil
+}
+
+func keyResponse(r *serf.KeyResponse, err error) (*api.KeyResponse, error) {
+	if r == nil {
+		return nil, err
+	}
+	res := &api.KeyResponse{
+		NumNodes: uint32(r.NumNodes),
+		NumResp: uint32(r.NumResp),
+		NumErr: uint32(r.NumErr),
+		Messages: r.Messages,
+		Keys: make(map[string]uint32, len(r.Keys)),
+		PrimaryKeys: make(map[string]uint32, len(r.PrimaryKeys)),
+	}
+	for k, n := range r.Keys {
+		res.Keys[k] = uint32(n)
+	}
+	for k, n := range r.PrimaryKeys {
+		res.PrimaryKeys[k] = uint32(n)
+	}
+	return res, err
+}
+
+// Done is closed once the agent was decommissioned, for its owner to
+// shut it down, or once it starts shutting down.
+func (a *Agent) Done() <-chan struct{} {
+	return a.done
+}
+
+func (a *Agent) closeDone() {
+	a.doneOnce.Do(func() {
+		close(a.done)
+	})
+}
+
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -180,14 +604,36 @@ func (a *Agent) Shutdown() error {
 
 	a.shutdown = true
 	close(a.shutdowns)
+	a.closeDone()
 	fns := []func() error {
 		a.membership.Leave,
+		a.antiEntropy.Close,
+		a.placement.Close,
 		a.log.Close,
 		a.replicator.Close,
+		a.closePeers,
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		func() error {
+			if a.authorizer == nil {
+				return nil
+			}
+			return a.authorizer.Close()
+		},
+		func() error {
+			if a.metrics == nil {
+				return nil
+			}
+			return a.metrics.Close()
+		},
+		func() error {
+			// export what is left of the spans and metrics
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return a.telemetry.Shutdown(ctx)
+		},
 	}
 
 	for _, fn := range fns {
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/certs"
 	"github.com/larkiee/distributed_logger/pkg/config"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
@@ -17,6 +18,7 @@ import (
 
 func TestAgent(t *testing.T) {
 	var agents []*Agent
+	tlsFiles := testTLS(t)
 
 	for i := 0; i < 3; i++ {
 		port := dynaport.Get(2)
@@ -26,12 +28,12 @@ func TestAgent(t *testing.T) {
 		dir, err := os.MkdirTemp("", fmt.Sprintf("agent-0%d-", i))
 		require.NoError(t, err)
 
-		srvTLSConf, err := config.GetTLSConfig(config.TLSRequest{
+		srvTLSConf, err := config.GetTLSConfig(tlsFiles, config.TLSRequest{
 			IsServer:   true,
 			ServerAddr: addr,
 		})
 		require.NoError(t, err)
-		peerTLSConf, err := config.GetTLSConfig(config.TLSRequest{
+		peerTLSConf, err := config.GetTLSConfig(tlsFiles, config.TLSRequest{
 			IsServer:   false,
 			ServerAddr: addr,
 		})
@@ -66,7 +68,7 @@ func TestAgent(t *testing.T) {
 
 	time.Sleep(3 * time.Second)
 	
-	leadership := client(t, agents[0])
+	leadership := client(t, agents[0], tlsFiles)
 
 	pRes, err := leadership.Produce(context.Background(), &api.ProduceRequest{
 		Record: &api.Record{
@@ -84,7 +86,7 @@ func TestAgent(t *testing.T) {
 	require.Equal(t, cRes.Record.Value, []byte("Hiii !!!"))
 	time.Sleep(3*time.Second)
 
-	// follower := client(t, agents[1])
+	// follower := client(t, agents[1], tlsFiles)
 	// cRes, err = follower.Consume(context.Background(), &api.ConsumeRequest{
 	// 	Offset: 0,
 	// })
@@ -94,10 +96,10 @@ func TestAgent(t *testing.T) {
 }
 
 
-func client(t *testing.T, a *Agent) api.LogClient {
+func client(t *testing.T, a *Agent, tlsFiles config.TLSConfig) api.LogClient {
 	rpcAddr, err := a.RPCAddr()
 	require.NoError(t, err)
-	tlsConfig, err := config.GetTLSConfig(config.TLSRequest{
+	tlsConfig, err := config.GetTLSConfig(tlsFiles, config.TLSRequest{
 		IsServer: false,
 		ServerAddr: "127.0.0.1",
 	})
@@ -112,4 +114,12 @@ func client(t *testing.T, a *Agent) api.LogClient {
 
 	client := api.NewLogClient(cc)
 	return client
-}
\ No newline at end of file
+}
+
+// testTLS issues fresh certificates for the test.
+func testTLS(t *testing.T) config.TLSConfig {
+	t.Helper()
+	files, err := certs.DevTLSConfig(t.TempDir())
+	require.NoError(t, err)
+	return files
+}
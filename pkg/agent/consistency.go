@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (a *Agent) consistencyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.checkConsistency(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *Agent) consistencyStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &recvStream{
+		ServerStream: ss,
+		check: func(m interface{}) error {
+			return a.checkConsistency(ss.Context(), m)
+		},
+	})
+}
+
+// checkConsistency turns consumes away when this agent cannot serve them
+// as up to date as they ask for.
+func (a *Agent) checkConsistency(ctx context.Context, req interface{}) error {
+	c, OK := req.(*api.ConsumeRequest)
+	if !OK || c.Consistency == api.Consistency_CONSISTENCY_ANY {
+		return nil
+	}
+	if !a.leads() {
+		return status.Errorf(codes.FailedPrecondition, "not the leader of epoch %d", a.epoch.Load())
+	}
+	if c.Consistency == api.Consistency_CONSISTENCY_LINEARIZABLE {
+		return a.confirmLeadership(ctx)
+	}
+	return nil
+}
+
+// leads tells whether this agent leads the newest epoch it knows of.
+func (a *Agent) leads() bool {
+	epoch := a.leaderEpoch.Load()
+	return a.leader.Load() && epoch > 0 && epoch >= a.epoch.Load()
+}
+
+// Epoch reports the newest epoch the agent knows of and whether it leads
+// it, for leaders confirming their epoch.
+func (a *Agent) Epoch() (uint64, bool) {
+	return a.epoch.Load(), a.leads()
+}
+
+// confirmLeadership makes sure a majority of the voters knows of no epoch
+// newer than the one this agent leads. Every record produced before the
+// read started is in the local log already, so once confirmed the local
+// log is the read index. A confirmation holds for LeaseDuration.
+func (a *Agent) confirmLeadership(ctx context.Context) error {
+	epoch := a.leaderEpoch.Load()
+	start := time.Now()
+	a.quorumLock.Lock()
+	leased := a.LeaseDuration > 0 && a.confirmedEpoch == epoch && start.Sub(a.confirmed) < a.LeaseDuration
+	// voters without a connection count against the majority
+	total := len(a.voters) + 1
+	peers := make([]*grpc.ClientConn, 0, len(a.peers))
+	for _, cc := range a.peers {
+		peers = append(peers, cc)
+	}
+	a.quorumLock.Unlock()
+	if leased {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	type reply struct {
+		epoch uint64
+		err   error
+	}
+	replies := make(chan reply, len(peers))
+	for _, cc := range peers {
+		go func(cc *grpc.ClientConn) {
+			res, err := api.NewClusterClient(cc).GetEpoch(ctx, &api.GetEpochRequest{})
+			replies <- reply{res.GetEpoch(), err}
+		}(cc)
+	}
+	// this agent votes for itself
+	acks := 1
+	for range peers {
+		if acks > total/2 {
+			break
+		}
+		r := <-replies
+		if r.err != nil {
+			continue
+		}
+		if r.epoch > epoch {
+			if a.observeEpoch(r.epoch) {
+				go a.stepDown()
+			}
+			return status.Errorf(codes.FailedPrecondition, "stale leader of epoch %d, epoch %d is newer", epoch, r.epoch)
+		}
+		acks++
+	}
+	if acks <= total/2 {
+		return status.Errorf(codes.Unavailable, "epoch %d confirmed by %d of %d members", epoch, acks, total)
+	}
+
+	a.quorumLock.Lock()
+	a.confirmed, a.confirmedEpoch = start, epoch
+	a.quorumLock.Unlock()
+	return nil
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConsistency(t *testing.T) {
+	net := &network{nodes: make(map[string]*node)}
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("consistency-0%d-", i))
+		require.NoError(t, err)
+		a, err := New(Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:   ports[1],
+			Bootstrap: i == 0,
+			Discovery: net.discovery,
+			// every call asks the majority
+			LeaseDuration: -1,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	ctx := context.Background()
+	var clients []api.LogClient
+	for _, a := range agents {
+		clients = append(clients, api.NewLogClient(insecureClient(t, a)))
+	}
+	consume := func(c api.LogClient, consistency api.Consistency) error {
+		_, err := c.Consume(ctx, &api.ConsumeRequest{Offset: 0, Consistency: consistency})
+		return err
+	}
+	res, err := clients[0].Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+	require.NoError(t, err)
+
+	// followers only serve reads that take any replica
+	require.NoError(t, consume(clients[0], api.Consistency_CONSISTENCY_LEADER))
+	require.NoError(t, consume(clients[0], api.Consistency_CONSISTENCY_LINEARIZABLE))
+	err = consume(clients[1], api.Consistency_CONSISTENCY_LEADER)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	err = consume(clients[1], api.Consistency_CONSISTENCY_LINEARIZABLE)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// reading one's own write waits for the follower to get it
+	stream, err := clients[1].ConsumeStream(ctx, &api.ConsumeRequest{Offset: res.Offset, MinOffset: &res.Offset})
+	require.NoError(t, err)
+	got, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "a", string(got.Record.Value))
+	future := res.Offset + 10
+	short, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = clients[2].Consume(short, &api.ConsumeRequest{Offset: res.Offset, MinOffset: &future})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// a leader that was replaced while cut off may still serve leader
+	// reads, but the majority tells it about epoch 2 on linearizable ones
+	net.isolate("0")
+	_, err = api.NewClusterClient(insecureClient(t, agents[1])).Promote(ctx, &api.PromoteRequest{})
+	require.NoError(t, err)
+	require.NoError(t, consume(clients[0], api.Consistency_CONSISTENCY_LEADER))
+	err = consume(clients[0], api.Consistency_CONSISTENCY_LINEARIZABLE)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	err = consume(clients[0], api.Consistency_CONSISTENCY_LEADER)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.NoError(t, consume(clients[1], api.Consistency_CONSISTENCY_LINEARIZABLE))
+
+	// without a majority the new leader cannot confirm its epoch
+	require.NoError(t, agents[0].Shutdown())
+	require.NoError(t, agents[2].Shutdown())
+	err = consume(clients[1], api.Consistency_CONSISTENCY_LINEARIZABLE)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.NoError(t, consume(clients[1], api.Consistency_CONSISTENCY_LEADER))
+}
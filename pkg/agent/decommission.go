@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// drainPollInterval is how often a decommission checks on the data it
+// is moving away.
+const drainPollInterval = 100 * time.Millisecond
+
+// tagger is a discoverer the agent can change its tags through.
+type tagger interface {
+	SetTags(tags map[string]string) error
+}
+
+func (a *Agent) drainUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.checkDraining(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *Agent) drainStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.checkDraining(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// checkDraining turns produces away once the agent is draining.
+func (a *Agent) checkDraining(method string) error {
+	produce := method == api.Log_Produce_FullMethodName || method == api.Log_ProduceStream_FullMethodName
+	if a.draining.Load() && produce {
+		return status.Error(codes.Unavailable, "server is draining")
+	}
+	return nil
+}
+
+// Decommission takes the agent out of the cluster: it stops taking
+// produces, hands leadership to a caught up follower, waits for its
+// partitions to be fully replicated elsewhere and leaves the cluster,
+// closing Done for the agent's owner to shut it down. ctx bounds how
+// long it waits for the data to move, the agent going back to taking
+// produces and partitions when it fails.
+func (a *Agent) Decommission(ctx context.Context) (res *api.DecommissionResponse, err error) {
+	t, OK := a.membership.(tagger)
+	if !OK {
+		return nil, status.Error(codes.FailedPrecondition, "decommission needs serf discovery")
+	}
+	if !a.draining.CompareAndSwap(false, true) {
+		return nil, status.Error(codes.FailedPrecondition, "already decommissioning")
+	}
+	logger := zap.L().Named("decommission")
+	defer func() {
+		if err == nil {
+			return
+		}
+		a.draining.Store(false)
+		a.placement.Drain(false)
+		if tagErr := t.SetTags(a.tags()); tagErr != nil {
+			logger.Error("failed to clear the draining tag", zap.Error(tagErr))
+		}
+		logger.Warn("decommission failed", zap.Error(err))
+	}()
+	if err = t.SetTags(a.tags()); err != nil {
+		return nil, err
+	}
+	res = &api.DecommissionResponse{Partitions: uint32(len(a.heldPartitions()))}
+	a.placement.Drain(true)
+
+	if a.leader.Load() {
+		leader, err := a.transferLeadership(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.NewLeader = leader
+		logger.Info("transferred leadership", zap.String("leader", leader))
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for len(a.heldPartitions()) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+	}
+	logger.Info("partitions moved", zap.Uint32("partitions", res.Partitions))
+
+	if err = a.membership.Leave(); err != nil {
+		return nil, err
+	}
+	a.closeDone()
+	return res, nil
+}
+
+// heldPartitions returns the topic partitions with records on this node,
+// the default topic aside since every node replicates it.
+func (a *Agent) heldPartitions() []string {
+	var held []string
+	for _, t := range a.log.Topics() {
+		if t.Name == log.DefaultTopic {
+			continue
+		}
+		for p := uint32(0); p < t.Config.Partitions; p++ {
+			l, err := t.Partition(p)
+			if err == nil && l.NextOffset() > 0 {
+				held = append(held, fmt.Sprintf("%s/%d", t.Name, p))
+			}
+		}
+	}
+	return held
+}
+
+// transferLeadership promotes the follower furthest along in the default
+// topic once it has every record this node has, then steps down.
+func (a *Agent) transferLeadership(ctx context.Context) (string, error) {
+	local, err := a.log.Partition(log.DefaultTopic, 0)
+	if err != nil {
+		return "", err
+	}
+	var best string
+	var bestName string
+	var bestNext uint64
+	for _, m := range a.membership.Alive() {
+		if m.Name == a.NodeName || m.Tags["draining"] == "true" {
+			continue
+		}
+		next, err := a.defaultNextOffset(ctx, m.RPCAddr)
+		if err != nil {
+			continue
+		}
+		if best == "" || next > bestNext {
+			best, bestName, bestNext = m.RPCAddr, m.Name, next
+		}
+	}
+	if best == "" {
+		return "", status.Error(codes.FailedPrecondition, "no member to hand leadership to")
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for bestNext < local.NextOffset() {
+		select {
+		case <-ctx.Done():
+			return "", status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+		if bestNext, err = a.defaultNextOffset(ctx, best); err != nil {
+			return "", err
+		}
+	}
+
+	cc, err := grpc.Dial(best, a.dialOptions...)
+	if err != nil {
+		return "", err
+	}
+	defer cc.Close()
+	if _, err = api.NewClusterClient(cc).Promote(ctx, &api.PromoteRequest{}); err != nil {
+		return "", err
+	}
+	a.leader.Store(false)
+	a.placement.Lead(0)
+	if err = a.membership.(tagger).SetTags(a.tags()); err != nil {
+		return "", err
+	}
+	return bestName, nil
+}
+
+func (a *Agent) defaultNextOffset(ctx context.Context, addr string) (uint64, error) {
+	cc, err := grpc.Dial(addr, a.dialOptions...)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	res, err := api.NewPeerClient(cc).GetPartitions(ctx, &api.GetPartitionsRequest{})
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range res.Partitions {
+		if p.Topic == log.DefaultTopic && p.Partition == 0 {
+			return p.NextOffset, nil
+		}
+	}
+	return 0, nil
+}
+
+// Promote makes the agent the leader taking produces.
+func (a *Agent) Promote() error {
+	t, OK := a.membership.(tagger)
+	if !OK {
+		return status.Error(codes.FailedPrecondition, "promote needs serf discovery")
+	}
+	if a.draining.Load() {
+		return status.Error(codes.FailedPrecondition, "server is draining")
+	}
+	if err := a.becomeLeader(); err != nil {
+		return err
+	}
+	a.placement.Lead(a.leading())
+	return t.SetTags(a.tags())
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestDecommission(t *testing.T) {
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("decommission-0%d-", i))
+		require.NoError(t, err)
+		c := Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			DataDir:           dir,
+			BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:           ports[1],
+			ReplicationFactor: 2,
+			RebalanceInterval: 200 * time.Millisecond,
+			Bootstrap:         i == 0,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := New(c)
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	ctx := context.Background()
+	leader := insecureClient(t, agents[0])
+	_, err := api.NewAdminClient(leader).CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: 2},
+	})
+	require.NoError(t, err)
+	client := api.NewLogClient(leader)
+	for p := uint32(0); p < 2; p++ {
+		partition := p
+		for i := 0; i < 3; i++ {
+			_, err = client.Produce(ctx, &api.ProduceRequest{
+				Topic:     "orders",
+				Partition: &partition,
+				Record:    &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			})
+			require.NoError(t, err)
+		}
+	}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	// a decommission given up on leaves the agent as it was
+	canceled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	_, err = agents[0].Decommission(canceled)
+	require.Error(t, err)
+	require.False(t, agents[0].draining.Load())
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("still leading")}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	res, err := api.NewClusterClient(leader).Decommission(ctx, &api.DecommissionRequest{})
+	require.NoError(t, err)
+	// shutting down is left to the owner of the agent
+	select {
+	case <-agents[0].Done():
+	case <-time.After(time.Second):
+		t.Fatal("the decommissioned agent is not done")
+	}
+	require.Contains(t, []string{"1", "2"}, res.NewLeader)
+	var newLeader *Agent
+	for _, a := range agents {
+		if a.NodeName == res.NewLeader {
+			newLeader = a
+		}
+	}
+
+	// what only the decommissioned node had now lives on the others
+	for _, a := range agents[1:] {
+		for p := uint32(0); p < 2; p++ {
+			l, err := a.log.Partition("orders", p)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), l.NextOffset())
+		}
+	}
+
+	cluster := api.NewClusterClient(insecureClient(t, agents[1]))
+	require.Eventually(t, func() bool {
+		res, err := cluster.GetServers(context.Background(), &api.GetServersRequest{})
+		if err != nil || len(res.Servers) != 2 {
+			return false
+		}
+		for _, s := range res.Servers {
+			if s.IsLeader {
+				return s.Id == newLeader.NodeName
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	_, err = api.NewLogClient(insecureClient(t, newLeader)).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("after")},
+	})
+	require.NoError(t, err)
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("late")}})
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/discovery"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestStaticDiscovery(t *testing.T) {
+	ports := dynaport.Get(4)
+	peers := []discovery.Member{
+		{Name: "0", RPCAddr: fmt.Sprintf("127.0.0.1:%d", ports[1]), Tags: map[string]string{"role": "leader", "zone": "east"}},
+		{Name: "1", RPCAddr: fmt.Sprintf("127.0.0.1:%d", ports[3]), Tags: map[string]string{"zone": "west"}},
+	}
+	var agents []*Agent
+	for i := 0; i < 2; i++ {
+		dir, err := os.MkdirTemp("", fmt.Sprintf("static-0%d-", i))
+		require.NoError(t, err)
+		a, err := New(Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[2*i]),
+			RPCPort:   ports[2*i+1],
+			Bootstrap: i == 0,
+			Zone:      []string{"east", "west"}[i],
+			Discovery: func(local discovery.Member, h discovery.Handler) (discovery.Discoverer, error) {
+				return discovery.NewStatic(local, peers, h)
+			},
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	ctx := context.Background()
+	res, err := api.NewClusterClient(insecureClient(t, agents[1])).GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, 2)
+	require.True(t, res.Servers[0].IsLeader)
+	require.False(t, res.Servers[1].IsLeader)
+	require.Equal(t, "east", res.Servers[0].Zone)
+	require.Equal(t, "west", res.Servers[1].Zone)
+
+	_, err = api.NewLogClient(insecureClient(t, agents[0])).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+
+	// the follower found the leader without gossip and replicates it
+	follower := api.NewLogClient(insecureClient(t, agents[1]))
+	require.Eventually(t, func() bool {
+		res, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		return err == nil && string(res.Record.Value) == "hello"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// what DNS discovery asks members for, having no gossip to carry it
+	tags, err := discovery.ClusterTags(
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)(peers[0].RPCAddr)
+	require.NoError(t, err)
+	require.Equal(t, "leader", tags["role"])
+	require.Equal(t, "east", tags["zone"])
+	require.Equal(t, peers[0].RPCAddr, tags["rpc_addr"])
+
+	_, err = api.NewClusterClient(insecureClient(t, agents[0])).ListKeys(ctx, &api.ListKeysRequest{})
+	require.Error(t, err)
+}
+
+func TestJoinFailed(t *testing.T) {
+	ports := dynaport.Get(3)
+	dir, err := os.MkdirTemp("", "join-failed-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	failed := make(chan error, 10)
+	a, err := New(Config{
+		NodeName:       "0",
+		DataDir:        dir,
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:        ports[1],
+		StartJoinAddrs: []string{fmt.Sprintf("127.0.0.1:%d", ports[2])},
+		RetryJoin:      true,
+		JoinFailed: func(err error) {
+			select {
+			case failed <- err:
+			default:
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	select {
+	case err = <-failed:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed join was not reported")
+	}
+}
@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/discovery"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultLeaseDuration is the LeaseDuration of agents that set none.
+const defaultLeaseDuration = 2 * time.Second
+
+// epochFile keeps the highest epoch the agent knows of under DataDir,
+// followed by the one it leads if any, so a restarted leader neither
+// reuses an epoch nor starts a new one for nothing.
+const epochFile = "epoch"
+
+// setupEpoch loads the highest known epoch, raised by the last record of
+// every partition. Bootstrapping starts the first epoch, or takes back
+// the one the agent led before it restarted.
+func (a *Agent) setupEpoch() error {
+	if a.LeaseDuration == 0 {
+		a.LeaseDuration = defaultLeaseDuration
+	}
+	b, err := os.ReadFile(path.Join(a.DataDir, epochFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var led uint64
+	for i, field := range strings.Fields(string(b)) {
+		epoch, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			a.epoch.Store(epoch)
+		} else {
+			led = epoch
+		}
+	}
+	for _, t := range a.log.Topics() {
+		for i := uint32(0); i < t.Config.Partitions; i++ {
+			l, err := t.Partition(i)
+			if err != nil {
+				return err
+			}
+			last, err := l.LastEpoch()
+			if err != nil {
+				return err
+			}
+			a.observeEpoch(last)
+		}
+	}
+	if !a.Bootstrap {
+		return nil
+	}
+	switch known := a.epoch.Load(); {
+	case known == 0:
+		return a.becomeLeader()
+	case led == known:
+		a.leaderEpoch.Store(led)
+		a.leader.Store(true)
+	default:
+		zap.L().Named("epoch").Info(
+			"not bootstrapping, a newer leader took over",
+			zap.Uint64("led", led),
+			zap.Uint64("epoch", known),
+		)
+	}
+	return nil
+}
+
+// saveEpoch writes the epochs next to the old file and renames it over,
+// so a crash never leaves a torn epoch behind.
+func (a *Agent) saveEpoch() error {
+	a.epochLock.Lock()
+	defer a.epochLock.Unlock()
+	b := strconv.FormatUint(a.epoch.Load(), 10)
+	if a.leader.Load() {
+		b += " " + strconv.FormatUint(a.leaderEpoch.Load(), 10)
+	}
+	name := path.Join(a.DataDir, epochFile)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// observeEpoch raises the highest known epoch, reporting whether it grew.
+func (a *Agent) observeEpoch(epoch uint64) bool {
+	for {
+		known := a.epoch.Load()
+		if epoch <= known {
+			return false
+		}
+		if a.epoch.CompareAndSwap(known, epoch) {
+			return true
+		}
+	}
+}
+
+// becomeLeader starts a new epoch led by this agent.
+func (a *Agent) becomeLeader() error {
+	epoch := a.epoch.Add(1)
+	a.leaderEpoch.Store(epoch)
+	a.leader.Store(true)
+	if epoch > 1 {
+		// some other member led before and may still hold a lease
+		a.quorumLock.Lock()
+		a.ledSince = time.Now()
+		a.quorumLock.Unlock()
+	}
+	return a.saveEpoch()
+}
+
+// leading is the epoch the agent leads, zero when it leads none.
+func (a *Agent) leading() uint64 {
+	if !a.leader.Load() {
+		return 0
+	}
+	return a.leaderEpoch.Load()
+}
+
+// stepDown gives up leading once a newer epoch shows up and tells the
+// other members.
+func (a *Agent) stepDown() {
+	if !a.leader.CompareAndSwap(true, false) {
+		return
+	}
+	logger := zap.L().Named("epoch")
+	logger.Warn(
+		"stepped down for a newer leader",
+		zap.Uint64("led", a.leaderEpoch.Load()),
+		zap.Uint64("epoch", a.epoch.Load()),
+	)
+	if err := a.saveEpoch(); err != nil {
+		logger.Error("failed to save epoch", zap.Error(err))
+	}
+	// the discoverer may still be calling in from its constructor
+	select {
+	case <-a.ready:
+	case <-a.shutdowns:
+		return
+	}
+	a.placement.Lead(0)
+	if t, OK := a.membership.(tagger); OK {
+		if err := t.SetTags(a.tags()); err != nil {
+			logger.Error("failed to set tags", zap.Error(err))
+		}
+	}
+}
+
+// checkEpoch returns the epoch to stamp produced records with. Once some
+// member led an epoch only the leader of the newest one takes produces,
+// and only while a majority of the voters knows of no newer epoch, so a
+// leader that was replaced while cut off is fenced here. A new leader
+// waits out LeaseDuration first, the one it replaced may still hold a
+// lease for that long.
+func (a *Agent) checkEpoch(ctx context.Context) (uint64, error) {
+	known := a.epoch.Load()
+	if known == 0 {
+		// nobody ever led, every member takes produces
+		return 0, nil
+	}
+	if !a.leader.Load() {
+		return 0, status.Errorf(codes.FailedPrecondition, "not the leader of epoch %d", known)
+	}
+	if epoch := a.leaderEpoch.Load(); epoch < known {
+		return 0, status.Errorf(codes.FailedPrecondition, "stale leader of epoch %d, epoch %d is newer", epoch, known)
+	}
+	a.quorumLock.Lock()
+	wait := a.LeaseDuration - time.Since(a.ledSince)
+	a.quorumLock.Unlock()
+	if wait > 0 {
+		return 0, status.Errorf(codes.Unavailable, "epoch %d takes produces in %s", known, wait)
+	}
+	if err := a.confirmLeadership(ctx); err != nil {
+		return 0, err
+	}
+	return known, nil
+}
+
+func (a *Agent) epochUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.stampEpoch(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *Agent) epochStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &recvStream{
+		ServerStream: ss,
+		check: func(m interface{}) error {
+			return a.stampEpoch(ss.Context(), m)
+		},
+	})
+}
+
+// recvStream runs check on every message the stream receives, the
+// request of server streams included.
+type recvStream struct {
+	grpc.ServerStream
+	check func(m interface{}) error
+}
+
+func (s *recvStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.check(m)
+}
+
+func (a *Agent) stampEpoch(ctx context.Context, req interface{}) error {
+	p, OK := req.(*api.ProduceRequest)
+	if !OK {
+		return nil
+	}
+	epoch, err := a.checkEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	if err = a.checkPartition(p); err != nil {
+		return err
+	}
+	if p.Record != nil {
+		p.Record.Epoch = epoch
+	}
+	return nil
+}
+
+// epochWatch raises the known epoch from the tags of the other members
+// and makes the agent step down when a newer leader shows up. It also
+// keeps the voters leaders confirm linearizable reads with.
+type epochWatch struct {
+	agent *Agent
+}
+
+func (w epochWatch) Join(name, addr string) error {
+	return nil
+}
+
+func (w epochWatch) Update(name string, tags map[string]string) error {
+	a := w.agent
+	a.quorumLock.Lock()
+	addr := tags["rpc_addr"]
+	select {
+	case <-a.shutdowns:
+		// the connections are closed already
+		a.quorumLock.Unlock()
+		return nil
+	default:
+	}
+	if cc, OK := a.peers[name]; !OK || a.voters[name].RPCAddr != addr {
+		if OK {
+			cc.Close()
+			delete(a.peers, name)
+		}
+		// dialing does not wait for the connection, a voter that cannot
+		// be reached fails to answer instead
+		if cc, err := grpc.Dial(addr, a.dialOptions...); err != nil {
+			zap.L().Named("epoch").Error("failed to dial voter", zap.Error(err), zap.String("name", name))
+		} else {
+			a.peers[name] = cc
+		}
+	}
+	a.voters[name] = discovery.Member{Name: name, RPCAddr: addr, Tags: tags}
+	a.quorumLock.Unlock()
+	if !a.observeEpoch(tagEpoch(tags)) {
+		return nil
+	}
+	if a.leader.Load() && a.leaderEpoch.Load() < a.epoch.Load() {
+		go a.stepDown()
+	}
+	return a.saveEpoch()
+}
+
+// Leave keeps members that failed or were cut off among the voters, so a
+// leader on the small side of a partition cannot confirm its reads, only
+// decommissioned members stop counting.
+func (w epochWatch) Leave(name string) error {
+	a := w.agent
+	a.quorumLock.Lock()
+	defer a.quorumLock.Unlock()
+	if a.voters[name].Tags["draining"] == "true" {
+		delete(a.voters, name)
+		if cc, OK := a.peers[name]; OK {
+			cc.Close()
+			delete(a.peers, name)
+		}
+	}
+	return nil
+}
+
+// closePeers closes the connections to the voters.
+func (a *Agent) closePeers() error {
+	a.quorumLock.Lock()
+	defer a.quorumLock.Unlock()
+	for name, cc := range a.peers {
+		cc.Close()
+		delete(a.peers, name)
+	}
+	return nil
+}
+
+// follow picks the member the replicator copies the default topic from:
+// the leader of the newest epoch, unless that is this agent.
+func (a *Agent) follow(name string, tags map[string]string) bool {
+	if tags["role"] != "leader" {
+		return false
+	}
+	epoch := tagEpoch(tags)
+	if a.leader.Load() && epoch <= a.leaderEpoch.Load() {
+		return false
+	}
+	return epoch >= a.epoch.Load()
+}
+
+func tagEpoch(tags map[string]string) uint64 {
+	epoch, _ := strconv.ParseUint(tags["epoch"], 10, 64)
+	return epoch
+}
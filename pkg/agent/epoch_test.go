@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/discovery"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEpochFencing(t *testing.T) {
+	net := &network{nodes: make(map[string]*node)}
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("epoch-0%d-", i))
+		require.NoError(t, err)
+		a, err := New(Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:   ports[1],
+			Bootstrap: i == 0,
+			Discovery: net.discovery,
+			// every call asks the majority
+			LeaseDuration: -1,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	ctx := context.Background()
+	produce := func(a *Agent, value string) (uint64, error) {
+		res, err := api.NewLogClient(insecureClient(t, a)).Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		if err != nil {
+			return 0, err
+		}
+		return res.Offset, nil
+	}
+	for _, v := range []string{"a", "b"} {
+		_, err := produce(agents[0], v)
+		require.NoError(t, err)
+	}
+	waitFor(t, agents, "a", "b")
+
+	// the old leader is cut off while the others move on to epoch 2
+	net.isolate("0")
+	_, err := api.NewClusterClient(insecureClient(t, agents[1])).Promote(ctx, &api.PromoteRequest{})
+	require.NoError(t, err)
+	// the majority it asks knows of epoch 2
+	_, err = produce(agents[0], "stale")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	off, err := produce(agents[1], "c")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = produce(agents[2], "d")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// back in touch, the old leader stays fenced
+	net.heal("0")
+	_, err = produce(agents[0], "late")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	waitFor(t, agents, "a", "b", "c")
+	for _, a := range agents {
+		l, err := a.log.Partition(log.DefaultTopic, 0)
+		require.NoError(t, err)
+		epoch, err := l.LastEpoch()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), epoch)
+	}
+	require.Eventually(t, func() bool {
+		return !agents[0].leader.Load()
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLeaderLease(t *testing.T) {
+	net := &network{nodes: make(map[string]*node)}
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("lease-0%d-", i))
+		require.NoError(t, err)
+		a, err := New(Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:   ports[1],
+			Bootstrap: i == 0,
+			Discovery: net.discovery,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+	require.Equal(t, defaultLeaseDuration, agents[0].LeaseDuration)
+
+	ctx := context.Background()
+	produce := func(a *Agent, value string) error {
+		_, err := api.NewLogClient(insecureClient(t, a)).Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		return err
+	}
+	require.NoError(t, produce(agents[0], "a"))
+	// the voters are dialed once as they show up, not on every produce
+	agents[0].quorumLock.Lock()
+	peers := len(agents[0].peers)
+	agents[0].quorumLock.Unlock()
+	require.Equal(t, 2, peers)
+
+	// a promoted leader waits out the lease the one it replaced may hold
+	net.isolate("0")
+	promoted := time.Now()
+	_, err := api.NewClusterClient(insecureClient(t, agents[1])).Promote(ctx, &api.PromoteRequest{})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unavailable, status.Code(produce(agents[1], "b")))
+	require.Eventually(t, func() bool {
+		return produce(agents[1], "b") == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.GreaterOrEqual(t, time.Since(promoted), defaultLeaseDuration)
+	// by then the lease of the old leader ran out, so it asks the
+	// majority again and learns about epoch 2
+	require.Equal(t, codes.FailedPrecondition, status.Code(produce(agents[0], "stale")))
+}
+
+func TestBootstrapRestartKeepsEpoch(t *testing.T) {
+	ports := dynaport.Get(2)
+	dir, err := os.MkdirTemp("", "epoch-restart-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{
+		NodeName:  "0",
+		DataDir:   dir,
+		BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:   ports[1],
+		Bootstrap: true,
+	}
+	for i := 0; i < 3; i++ {
+		a, err := New(c)
+		require.NoError(t, err)
+		epoch, leads := a.Epoch()
+		require.Equal(t, uint64(1), epoch)
+		require.True(t, leads)
+		require.NoError(t, a.Shutdown())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, epochFile))
+	require.NoError(t, err)
+	require.Equal(t, "1 1", string(b))
+	_, err = os.Stat(filepath.Join(dir, epochFile+".tmp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// waitFor waits until every agent holds exactly values in the default
+// topic.
+func waitFor(t *testing.T, agents []*Agent, values ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for _, a := range agents {
+			l, err := a.log.Partition(log.DefaultTopic, 0)
+			if err != nil || l.NextOffset() != uint64(len(values)) {
+				return false
+			}
+			for off, v := range values {
+				r, err := l.Read(uint64(off))
+				if err != nil || string(r.Value) != v {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// network tells the agents of a test about each other the way gossip
+// would, except that it can cut some of them off.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*node
+}
+
+type node struct {
+	net     *network
+	local   discovery.Member
+	handler discovery.Handler
+	cut     bool
+}
+
+func (n *network) discovery(local discovery.Member, h discovery.Handler) (discovery.Discoverer, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nd := &node{net: n, local: local, handler: h}
+	for _, other := range n.nodes {
+		introduce(other, nd)
+		introduce(nd, other)
+	}
+	n.nodes[local.Name] = nd
+	return nd, nil
+}
+
+// introduce tells to about from.
+func introduce(from, to *node) {
+	to.handler.Join(from.local.Name, from.local.RPCAddr)
+	to.handler.Update(from.local.Name, from.tags())
+}
+
+func (n *network) isolate(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cut := n.nodes[name]
+	for _, other := range n.nodes {
+		if other != cut {
+			other.handler.Leave(name)
+			cut.handler.Leave(other.local.Name)
+		}
+	}
+	cut.cut = true
+}
+
+func (n *network) heal(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	healed := n.nodes[name]
+	healed.cut = false
+	for _, other := range n.nodes {
+		if other != healed {
+			introduce(other, healed)
+			introduce(healed, other)
+		}
+	}
+}
+
+// reachable must be called with n.mu held.
+func (nd *node) reachable(other *node) bool {
+	return nd != other && !nd.cut && !other.cut
+}
+
+func (nd *node) tags() map[string]string {
+	tags := map[string]string{"rpc_addr": nd.local.RPCAddr}
+	for k, v := range nd.local.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (nd *node) Alive() []discovery.Member {
+	nd.net.mu.Lock()
+	defer nd.net.mu.Unlock()
+	members := []discovery.Member{nd.local}
+	for _, other := range nd.net.nodes {
+		if nd.reachable(other) {
+			members = append(members, other.local)
+		}
+	}
+	return members
+}
+
+func (nd *node) SetTags(tags map[string]string) error {
+	nd.net.mu.Lock()
+	defer nd.net.mu.Unlock()
+	nd.local.Tags = tags
+	for _, other := range nd.net.nodes {
+		if nd.reachable(other) {
+			other.handler.Update(nd.local.Name, nd.tags())
+		}
+	}
+	return nil
+}
+
+func (nd *node) Leave() error {
+	nd.net.mu.Lock()
+	defer nd.net.mu.Unlock()
+	delete(nd.net.nodes, nd.local.Name)
+	for _, other := range nd.net.nodes {
+		if nd.reachable(other) {
+			other.handler.Leave(nd.local.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestMetrics(t *testing.T) {
+	ports := dynaport.Get(3)
+	dir, err := os.MkdirTemp("", "metrics-")
+	require.NoError(t, err)
+	a, err := New(Config{
+		NodeName:    "0",
+		DataDir:     dir,
+		BindAddr:    fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:     ports[1],
+		Bootstrap:   true,
+		MetricsAddr: fmt.Sprintf("127.0.0.1:%d", ports[2]),
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, a.Shutdown())
+		require.NoError(t, os.RemoveAll(a.DataDir))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := api.NewLogClient(insecureClient(t, a))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	// the stream ends at the end of the log, and leaves the subscribers
+	_, err = stream.Recv()
+	require.Error(t, err)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/metrics", a.MetricsAddr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	for _, metric := range []string{
+		`dlog_log_records_written_total{otel_scope_name="github.com/larkiee/distributed_logger/pkg/log",otel_scope_version="",partition="0",topic="default"} 1`,
+		`dlog_log_append_duration_seconds_count`,
+		`dlog_log_segments{`,
+		`dlog_log_index_fill{`,
+		`dlog_consume_subscribers{otel_scope_name="github.com/larkiee/distributed_logger/pkg/server",otel_scope_version="",topic="default"} 0`,
+		`rpc_server_duration_milliseconds_count{`,
+	} {
+		require.Contains(t, string(b), metric)
+	}
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/placement"
+	"github.com/larkiee/distributed_logger/pkg/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const peerTimeout = 5 * time.Second
+
+// checkPartition turns away produces to a partition the agent lost or
+// never had a copy of while other members hold it, until the placement
+// engine fetched it. Produces naming no partition are given the one
+// their key maps to here, so the partition checked is the one appended
+// to.
+func (a *Agent) checkPartition(req *api.ProduceRequest) error {
+	if req.Topic == "" || req.Topic == log.DefaultTopic {
+		return nil
+	}
+	select {
+	case <-a.ready:
+	default:
+		return status.Error(codes.Unavailable, "server is starting")
+	}
+	if req.Partition == nil {
+		partition, err := a.log.PartitionFor(req.Topic, req.Record.GetKey())
+		if err != nil {
+			// the server answers for unknown topics
+			return nil
+		}
+		req.Partition = &partition
+	}
+	p := placement.Partition{Topic: req.Topic, ID: *req.Partition}
+	if !a.placement.Writable(p) {
+		return status.Errorf(codes.Unavailable, "partition %s is catching up with its replicas", p)
+	}
+	return nil
+}
+
+// partitionMover copies partitions between the agent and its peers on
+// behalf of the placement engine.
+type partitionMover struct {
+	log         *log.Manager
+	dialOptions []grpc.DialOption
+	logger      *zap.Logger
+}
+
+var _ placement.Mover = (*partitionMover)(nil)
+
+func (m *partitionMover) Partitions(members []placement.Member) (map[placement.Partition][]string, error) {
+	holders := make(map[placement.Partition][]string)
+	for _, member := range members {
+		partitions, err := m.partitions(member)
+		if err != nil {
+			// an unreachable member holds nothing we can use right now
+			m.logger.Warn(
+				"failed to list partitions",
+				zap.Error(err),
+				zap.String("name", member.Name),
+			)
+			continue
+		}
+		for _, p := range partitions {
+			// the default topic is replicated to every node already
+			if p.Topic == log.DefaultTopic || p.NextOffset == 0 {
+				continue
+			}
+			id := placement.Partition{Topic: p.Topic, ID: p.Partition}
+			holders[id] = append(holders[id], member.Name)
+		}
+	}
+	return holders, nil
+}
+
+func (m *partitionMover) partitions(member placement.Member) ([]*api.PartitionInfo, error) {
+	cc, err := grpc.Dial(member.RPCAddr, m.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+	defer cancel()
+	res, err := api.NewPeerClient(cc).GetPartitions(ctx, &api.GetPartitionsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Partitions, nil
+}
+
+func (m *partitionMover) Fetch(p placement.Partition, from []placement.Member) error {
+	var err error
+	for _, member := range from {
+		if err = m.fetch(p, member); err == nil {
+			return nil
+		}
+		m.logger.Warn(
+			"failed to fetch partition",
+			zap.Error(err),
+			zap.String("partition", p.String()),
+			zap.String("from", member.Name),
+		)
+	}
+	return err
+}
+
+// fetch copies the sealed segments and then appends the records of p the
+// local node is missing, creating the topic first when this node has
+// never hosted it.
+func (m *partitionMover) fetch(p placement.Partition, member placement.Member) error {
+	cc, err := grpc.Dial(member.RPCAddr, m.dialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err = m.log.Topic(p.Topic); errors.Is(err, log.ErrTopicNotFound) {
+		res, err := api.NewAdminClient(cc).ListTopics(ctx, &api.ListTopicsRequest{})
+		if err != nil {
+			return err
+		}
+		var topic *api.Topic
+		for _, t := range res.Topics {
+			if t.Name == p.Topic {
+				topic = t
+			}
+		}
+		if topic == nil {
+			return fmt.Errorf("%s has no topic %s", member.Name, p.Topic)
+		}
+		_, err = m.log.CreateTopic(p.Topic, server.TopicConfig(topic))
+		if err != nil && !errors.Is(err, log.ErrTopicExists) {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	l, err := m.log.Partition(p.Topic, p.ID)
+	if err != nil {
+		return err
+	}
+	l.LockWriters()
+	defer l.UnlockWriters()
+	if _, err = log.FetchSegments(ctx, api.NewPeerClient(cc), l, p.Topic, p.ID); err != nil {
+		return err
+	}
+	stream, err := api.NewLogClient(cc).ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:     p.Topic,
+		Partition: p.ID,
+		Offset:    l.NextOffset(),
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			// the stream ends once we read past the last record
+			if status.Code(err) == codes.OutOfRange {
+				return nil
+			}
+			return err
+		}
+		if _, err = l.Append(res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *partitionMover) CaughtUp(p placement.Partition, member placement.Member) (bool, error) {
+	l, err := m.log.Partition(p.Topic, p.ID)
+	if err != nil {
+		return false, err
+	}
+	partitions, err := m.partitions(member)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range partitions {
+		if info.Topic == p.Topic && info.Partition == p.ID {
+			return info.NextOffset >= l.NextOffset(), nil
+		}
+	}
+	return false, nil
+}
+
+func (m *partitionMover) Drop(p placement.Partition) error {
+	return m.log.ResetPartition(p.Topic, p.ID)
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/placement"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPartitionPlacement(t *testing.T) {
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("placement-0%d-", i))
+		require.NoError(t, err)
+		c := Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			DataDir:           dir,
+			BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:           ports[1],
+			ReplicationFactor: 2,
+			RebalanceInterval: 200 * time.Millisecond,
+			Bootstrap:         i == 0,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := New(c)
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	cc := insecureClient(t, agents[0])
+	ctx := context.Background()
+	_, err := api.NewAdminClient(cc).CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: 2},
+	})
+	require.NoError(t, err)
+	client := api.NewLogClient(cc)
+	for p := uint32(0); p < 2; p++ {
+		partition := p
+		for i := 0; i < 3; i++ {
+			_, err = client.Produce(ctx, &api.ProduceRequest{
+				Topic:     "orders",
+				Partition: &partition,
+				Record:    &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	// every partition ends up with all of its records on exactly the
+	// replicas the placement engine picked
+	require.Eventually(t, func() bool {
+		for p := uint32(0); p < 2; p++ {
+			id := placement.Partition{Topic: "orders", ID: p}
+			replicas := agents[0].placement.Replicas(id)
+			if len(replicas) != 2 {
+				return false
+			}
+			for _, a := range agents {
+				var next uint64
+				if l, err := a.log.Partition("orders", p); err == nil {
+					next = l.NextOffset()
+				}
+				if contains(replicas, a.NodeName) != (next == 3) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestProduceAfterPartitionsMove(t *testing.T) {
+	var agents []*Agent
+	start := func(i int) {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("placement-moves-0%d-", i))
+		require.NoError(t, err)
+		c := Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			DataDir:           dir,
+			BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:           ports[1],
+			ReplicationFactor: 1,
+			RebalanceInterval: 200 * time.Millisecond,
+			Bootstrap:         i == 0,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := New(c)
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	// the leader starts out alone with every partition
+	start(0)
+	cc := insecureClient(t, agents[0])
+	ctx := context.Background()
+	const partitions = 4
+	_, err := api.NewAdminClient(cc).CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: partitions},
+	})
+	require.NoError(t, err)
+	client := api.NewLogClient(cc)
+	produce := func(i int) {
+		for p := uint32(0); p < partitions; p++ {
+			partition := p
+			require.Eventually(t, func() bool {
+				res, err := client.Produce(ctx, &api.ProduceRequest{
+					Topic:     "orders",
+					Partition: &partition,
+					Record:    &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+				})
+				if err != nil {
+					return false
+				}
+				require.Equal(t, uint64(i), res.Offset)
+				return true
+			}, 10*time.Second, 50*time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		produce(i)
+	}
+
+	// the members joining would win some partitions by their scores, the
+	// leader keeps being their primary so it keeps its copies
+	start(1)
+	start(2)
+	require.Eventually(t, func() bool {
+		for p := uint32(0); p < partitions; p++ {
+			id := placement.Partition{Topic: "orders", ID: p}
+			for _, a := range agents {
+				replicas := a.placement.Replicas(id)
+				if len(replicas) != 1 || replicas[0] != agents[0].NodeName {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+	// give the engines a few rounds to move what they would
+	time.Sleep(time.Second)
+
+	for i := 3; i < 6; i++ {
+		produce(i)
+	}
+	for p := uint32(0); p < partitions; p++ {
+		for i := 0; i < 6; i++ {
+			res, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: p, Offset: uint64(i)})
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(res.Record.Value))
+		}
+	}
+}
+
+func insecureClient(t *testing.T, a *Agent) *grpc.ClientConn {
+	t.Helper()
+	rpcAddr, err := a.RPCAddr()
+	require.NoError(t, err)
+	cc, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
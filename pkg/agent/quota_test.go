@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/quota"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotas(t *testing.T) {
+	ports := dynaport.Get(2)
+	dir, err := os.MkdirTemp("", "quotas-")
+	require.NoError(t, err)
+	a, err := New(Config{
+		NodeName:  "0",
+		DataDir:   dir,
+		BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:   ports[1],
+		Bootstrap: true,
+		// a record every 100 seconds, with room for one
+		Quotas: []quota.Rule{{Subject: "*", RecordsPerSecond: 0.01}},
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, a.Shutdown())
+		require.NoError(t, os.RemoveAll(a.DataDir))
+	}()
+
+	ctx := context.Background()
+	cc := insecureClient(t, a)
+	produce := func() error {
+		_, err := api.NewLogClient(cc).Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		return err
+	}
+	// produces fenced off before the limiter take no tokens
+	a.draining.Store(true)
+	require.Equal(t, codes.Unavailable, status.Code(produce()))
+	a.draining.Store(false)
+	require.NoError(t, produce())
+	err = produce()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	retryAfter, OK := quota.RetryAfter(err)
+	require.True(t, OK)
+	require.Greater(t, retryAfter, 90*time.Second)
+
+	// streams are held to the same buckets
+	stream, err := api.NewLogClient(cc).ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	cluster := api.NewClusterClient(cc)
+	_, err = cluster.SetQuota(ctx, &api.SetQuotaRequest{Quota: &api.Quota{Subject: "*"}})
+	require.NoError(t, err)
+	require.NoError(t, produce())
+	_, err = cluster.SetQuota(ctx, &api.SetQuotaRequest{Quota: &api.Quota{Subject: "*", RecordsPerSecond: -1}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = cluster.SetQuota(ctx, &api.SetQuotaRequest{Quota: &api.Quota{Subject: "*", Topic: "audit", BytesPerSecond: 1024}})
+	require.NoError(t, err)
+
+	res, err := cluster.GetQuotas(ctx, &api.GetQuotasRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Quotas, 1)
+	require.Equal(t, "audit", res.Quotas[0].Topic)
+	require.Equal(t, float64(1024), res.Quotas[0].BytesPerSecond)
+	require.Len(t, res.Clients, 1)
+	require.Equal(t, uint64(2), res.Clients[0].Records)
+	require.Equal(t, uint64(2), res.Clients[0].Throttled)
+}
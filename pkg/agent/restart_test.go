@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestFollowerRestartsOnNewPort(t *testing.T) {
+	var agents []*Agent
+	var configs []Config
+	for i := 0; i < 2; i++ {
+		ports := dynaport.Get(2)
+		dir, err := os.MkdirTemp("", fmt.Sprintf("restart-0%d-", i))
+		require.NoError(t, err)
+		c := Config{
+			NodeName:  fmt.Sprintf("%d", i),
+			DataDir:   dir,
+			BindAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:   ports[1],
+			Bootstrap: i == 0,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := New(c)
+		require.NoError(t, err)
+		agents = append(agents, a)
+		configs = append(configs, c)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.DataDir))
+		}
+	}()
+
+	ctx := context.Background()
+	leader := api.NewLogClient(insecureClient(t, agents[0]))
+	replicated := func(a *Agent, offset uint64, value string) func() bool {
+		follower := api.NewLogClient(insecureClient(t, a))
+		return func() bool {
+			res, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+			return err == nil && string(res.Record.Value) == value
+		}
+	}
+	_, err := leader.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("before")}})
+	require.NoError(t, err)
+	require.Eventually(t, replicated(agents[1], 0, "before"), 5*time.Second, 100*time.Millisecond)
+
+	// the follower comes back from the same data on another RPC port
+	require.NoError(t, agents[1].Shutdown())
+	c := configs[1]
+	c.RPCPort = dynaport.Get(1)[0]
+	agents[1], err = New(c)
+	require.NoError(t, err)
+	rpcAddr, err := agents[1].RPCAddr()
+	require.NoError(t, err)
+
+	// the leader learns the new address, it confirms its epoch there
+	// before taking produces
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].GetServers()
+		if err != nil {
+			return false
+		}
+		for _, s := range servers {
+			if s.Id == "1" {
+				return s.RpcAddr == rpcAddr
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	_, err = leader.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("after")}})
+	require.NoError(t, err)
+	require.Eventually(t, replicated(agents[1], 1, "after"), 10*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Actions rules allow.
+const (
+	Produce = "produce"
+	Consume = "consume"
+	// Admin covers the Admin service, creating, deleting and listing
+	// topics, and running the cluster: gossip keys, decommissioning,
+	// promoting and quotas.
+	Admin = "admin"
+	// Replicate covers what agents call on each other, the Peer service
+	// and leadership epochs. Mirrors need it on their checkpoint topic.
+	Replicate = "replicate"
+	// Discover covers finding the servers of the cluster.
+	Discover = "discover"
+)
+
+// actions are the methods checked and the actions they take. Methods
+// missing from it are denied.
+var actions = map[string]string{
+	api.Log_Produce_FullMethodName:          Produce,
+	api.Log_ProduceStream_FullMethodName:    Produce,
+	api.Log_Consume_FullMethodName:          Consume,
+	api.Log_ConsumeStream_FullMethodName:    Consume,
+	api.Admin_CreateTopic_FullMethodName:    Admin,
+	api.Admin_DeleteTopic_FullMethodName:    Admin,
+	api.Admin_ListTopics_FullMethodName:     Admin,
+	api.Cluster_GetServers_FullMethodName:   Discover,
+	api.Cluster_GetTags_FullMethodName:      Discover,
+	api.Cluster_InstallKey_FullMethodName:   Admin,
+	api.Cluster_UseKey_FullMethodName:       Admin,
+	api.Cluster_RemoveKey_FullMethodName:    Admin,
+	api.Cluster_ListKeys_FullMethodName:     Admin,
+	api.Cluster_Decommission_FullMethodName: Admin,
+	api.Cluster_Promote_FullMethodName:      Admin,
+	api.Cluster_SetQuota_FullMethodName:     Admin,
+	api.Cluster_GetQuotas_FullMethodName:    Admin,
+	api.Cluster_GetEpoch_FullMethodName:     Replicate,
+	api.Peer_GetPartitions_FullMethodName:   Replicate,
+	api.Peer_GetDigests_FullMethodName:      Replicate,
+	api.Peer_FetchSegments_FullMethodName:   Replicate,
+	api.Peer_GetEpochEnd_FullMethodName:     Replicate,
+}
+
+// Rule allows Subject to take Action on Resource, a topic name. Each may
+// hold * wildcards matching any run of characters, * alone matching
+// anything, callers without an identity too.
+type Rule struct {
+	Subject  string `json:"subject" yaml:"subject"`
+	Resource string `json:"resource" yaml:"resource"`
+	Action   string `json:"action" yaml:"action"`
+}
+
+// Authorizer enforces the rules of a JSON or YAML policy file, following
+// changes to it. Whatever no rule allows is denied:
+//
+//	[{"subject": "spiffe://dlog/ns/shop/*", "resource": "orders-*", "action": "produce"},
+//	 {"subject": "*", "resource": "*", "action": "consume"}]
+//
+// Files ending in .yaml or .yml are read as YAML, others as JSON.
+type Authorizer struct {
+	Path   string
+	logger *zap.Logger
+
+	mu    sync.RWMutex
+	rules []Rule
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func NewAuthorizer(path string) (*Authorizer, error) {
+	a := &Authorizer{
+		Path:   path,
+		logger: zap.L().Named("acl"),
+		done:   make(chan struct{}),
+	}
+	rules, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+	a.rules = rules
+
+	// watch the directory, editors and config management replace the
+	// file rather than write to it
+	if a.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	if err = a.watcher.Add(filepath.Dir(path)); err != nil {
+		a.watcher.Close()
+		return nil, err
+	}
+	go a.watch()
+	return a, nil
+}
+
+func (a *Authorizer) read() ([]Rule, error) {
+	b, err := os.ReadFile(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		// caught between truncating and writing, a policy allowing
+		// nothing is written as an empty list
+		return nil, errors.New("policy file is empty")
+	}
+	var rules []Rule
+	if err = config.Unmarshal(a.Path, b, &rules); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.Subject == "" || r.Resource == "" || r.Action == "" {
+			return nil, errors.New("rules need a subject, a resource and an action")
+		}
+	}
+	return rules, nil
+}
+
+func (a *Authorizer) watch() {
+	defer close(a.done)
+	name := filepath.Clean(a.Path)
+	for {
+		select {
+		case e, OK := <-a.watcher.Events:
+			if !OK {
+				return
+			}
+			if filepath.Clean(e.Name) != name || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			rules, err := a.read()
+			if err != nil {
+				// keep enforcing the rules we have until the file is fixed
+				a.logger.Error("failed to read policy", zap.Error(err), zap.String("path", a.Path))
+				continue
+			}
+			a.mu.Lock()
+			a.rules = rules
+			a.mu.Unlock()
+		case err, OK := <-a.watcher.Errors:
+			if !OK {
+				return
+			}
+			a.logger.Error("failed to watch policy", zap.Error(err), zap.String("path", a.Path))
+		}
+	}
+}
+
+// Authorize returns a PermissionDenied error unless a rule allows subject
+// to take action on resource.
+func (a *Authorizer) Authorize(subject, resource, action string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if Match(r.Subject, subject) && Match(r.Resource, resource) && Match(r.Action, action) {
+			return nil
+		}
+	}
+	if subject == "" {
+		subject = "anonymous caller"
+	}
+	return status.Errorf(codes.PermissionDenied, "%s may not %s %s", subject, action, resource)
+}
+
+// Match reports whether s matches pattern, where * matches any run of
+// characters.
+func Match(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
+
+// check authorizes the caller in ctx to send m to method.
+func (a *Authorizer) check(ctx context.Context, method string, m interface{}) error {
+	action, OK := actions[method]
+	if !OK {
+		return status.Errorf(codes.PermissionDenied, "%s is not covered by the policy", method)
+	}
+	id, _ := FromContext(ctx)
+	return a.Authorize(id.Subject, resource(m), action)
+}
+
+// resource is the topic a request is about.
+func resource(m interface{}) string {
+	switch req := m.(type) {
+	case *api.ProduceRequest:
+		return topicOrDefault(req.Topic)
+	case *api.ConsumeRequest:
+		return topicOrDefault(req.Topic)
+	case *api.GetDigestsRequest:
+		return topicOrDefault(req.Topic)
+	case *api.FetchSegmentsRequest:
+		return topicOrDefault(req.Topic)
+	case *api.GetEpochEndRequest:
+		return topicOrDefault(req.Topic)
+	case *api.CreateTopicRequest:
+		return req.GetTopic().GetName()
+	case *api.DeleteTopicRequest:
+		return req.Name
+	}
+	return ""
+}
+
+func topicOrDefault(topic string) string {
+	if topic == "" {
+		return log.DefaultTopic
+	}
+	return topic
+}
+
+// UnaryServerInterceptor authorizes calls with the identity put in the
+// context by the package's UnaryServerInterceptor, chained before it.
+func (a *Authorizer) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.check(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor authorizes every message received on a stream,
+// the topic of each being up to the client.
+func (a *Authorizer) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, OK := actions[info.FullMethod]; !OK {
+		return status.Errorf(codes.PermissionDenied, "%s is not covered by the policy", info.FullMethod)
+	}
+	return handler(srv, &authorizedStream{ServerStream: ss, authorizer: a, method: info.FullMethod})
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	authorizer *Authorizer
+	method     string
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.authorizer.check(s.Context(), s.method, m)
+}
+
+// Close stops following the policy file.
+func (a *Authorizer) Close() error {
+	err := a.watcher.Close()
+	<-a.done
+	return err
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/certs"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestMatch(t *testing.T) {
+	for pattern, matches := range map[string]map[string]bool{
+		"*":                  {"": true, "orders": true},
+		"orders":             {"orders": true, "orders-eu": false},
+		"orders-*":           {"orders-eu": true, "orders-": true, "orders": false},
+		"spiffe://dlog/*/sa": {"spiffe://dlog/ns/shop/sa": true, "spiffe://dlog/sa": false},
+		"*-eu-*":             {"orders-eu-1": true, "orders-eu": false, "-eu-": true},
+		"a*a":                {"a": false, "aa": true, "aba": true},
+	} {
+		for s, want := range matches {
+			require.Equal(t, want, Match(pattern, s), "%q %q", pattern, s)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(dir)
+	require.NoError(t, err)
+	for _, name := range []string{"writer", "reader"} {
+		require.NoError(t, certs.Issue(dir, certs.Request{
+			Name:    name,
+			Kind:    certs.Client,
+			Subject: certs.Subject{CommonName: name},
+		}))
+	}
+	policy := filepath.Join(dir, "acl.yaml")
+	writePolicy := func(rules string) {
+		// written next to the policy and renamed so the reload sees it whole
+		tmp := policy + ".tmp"
+		require.NoError(t, os.WriteFile(tmp, []byte(rules), 0644))
+		require.NoError(t, os.Rename(tmp, policy))
+	}
+	writePolicy(`
+- {subject: writer, resource: "orders*", action: produce}
+- {subject: "*", resource: "*", action: consume}
+- {subject: writer, resource: "*", action: admin}
+`)
+	authorizer, err := NewAuthorizer(policy)
+	require.NoError(t, err)
+	defer authorizer.Close()
+
+	serverTLS, err := config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+	m, err := log.NewManager(t.TempDir(), log.ManagerConfig{})
+	require.NoError(t, err)
+	s, cleanup, err := server.NewGRPCServer(m,
+		server.WithServerOptions(grpc.Creds(credentials.NewTLS(serverTLS))),
+		server.WithUnaryInterceptors(UnaryServerInterceptor, authorizer.UnaryServerInterceptor),
+		server.WithStreamInterceptors(StreamServerInterceptor, authorizer.StreamServerInterceptor),
+	)
+	require.NoError(t, err)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lst)
+	defer func() {
+		s.Stop()
+		cleanup()
+	}()
+	dial := func(name string) *grpc.ClientConn {
+		c := files
+		c.ClientCertFile = filepath.Join(dir, name+".pem")
+		c.ClientKeyFile = filepath.Join(dir, name+"-key.pem")
+		tlsConfig, err := config.GetTLSConfig(c, config.TLSRequest{ServerAddr: "127.0.0.1"})
+		require.NoError(t, err)
+		cc, err := grpc.Dial(lst.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return cc
+	}
+	writer, reader := dial("writer"), dial("reader")
+
+	ctx := context.Background()
+	_, err = api.NewAdminClient(writer).CreateTopic(ctx, &api.CreateTopicRequest{Topic: &api.Topic{Name: "orders"}})
+	require.NoError(t, err)
+	_, err = api.NewAdminClient(reader).DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	produce := func(cc *grpc.ClientConn, topic string) error {
+		_, err := api.NewLogClient(cc).Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte(topic)},
+		})
+		return err
+	}
+	require.NoError(t, produce(writer, "orders"))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce(writer, "")))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce(reader, "orders")))
+	_, err = api.NewLogClient(reader).Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	// only agents replicate
+	_, err = api.NewPeerClient(reader).GetDigests(ctx, &api.GetDigestsRequest{Topic: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// streams are checked message by message
+	stream, err := api.NewLogClient(writer).ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("a")}}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("b")}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	consume, err := api.NewLogClient(reader).ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = consume.Recv()
+	require.NoError(t, err)
+
+	// policy changes apply without a restart, broken ones are ignored
+	writePolicy(`[{"subject": "reader", "resource": "*", "action": "*"}]`)
+	require.Eventually(t, func() bool {
+		return produce(reader, "orders") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, codes.PermissionDenied, status.Code(produce(writer, "orders")))
+	writePolicy(`- {subject: writer}`)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, produce(reader, "orders"))
+}
+
+func TestActionsCoverAPI(t *testing.T) {
+	for _, desc := range []grpc.ServiceDesc{
+		api.Log_ServiceDesc,
+		api.Admin_ServiceDesc,
+		api.Cluster_ServiceDesc,
+		api.Peer_ServiceDesc,
+	} {
+		var methods []string
+		for _, m := range desc.Methods {
+			methods = append(methods, m.MethodName)
+		}
+		for _, s := range desc.Streams {
+			methods = append(methods, s.StreamName)
+		}
+		for _, m := range methods {
+			method := "/" + desc.ServiceName + "/" + m
+			require.Contains(t, actions, method)
+		}
+	}
+
+	// anything else is turned away, whatever the policy allows
+	policy := filepath.Join(t.TempDir(), "acl.json")
+	require.NoError(t, os.WriteFile(policy, []byte(`[{"subject": "*", "resource": "*", "action": "*"}]`), 0644))
+	authorizer, err := NewAuthorizer(policy)
+	require.NoError(t, err)
+	defer authorizer.Close()
+	info := &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/Produce"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+	_, err = authorizer.UnaryServerInterceptor(context.Background(), &api.ProduceRequest{}, info, handler)
+	require.NoError(t, err)
+	info.FullMethod = "/log.v1.Log/Truncate"
+	_, err = authorizer.UnaryServerInterceptor(context.Background(), &api.ProduceRequest{}, info, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = authorizer.StreamServerInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: "/log.v1.Log/Truncate"},
+		func(interface{}, grpc.ServerStream) error { return nil })
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
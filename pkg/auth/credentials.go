@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// Bearer returns per-RPC credentials sending token, a JWT or an API key,
+// with every call:
+//
+//	grpc.Dial(addr, grpc.WithTransportCredentials(tlsCreds), grpc.WithPerRPCCredentials(auth.Bearer(key)))
+//
+// Like all the credentials of the package they are only sent over TLS.
+func Bearer(token string) credentials.PerRPCCredentials {
+	return bearerToken(token)
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorization: bearer + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// JWT returns per-RPC credentials signing a token for claims with key,
+// valid for ttl and signed again once less than a quarter of it is left,
+// for jobs holding a key rather than a token.
+func JWT(key Key, claims Claims, ttl time.Duration) credentials.PerRPCCredentials {
+	return &jwtSource{key: key, claims: claims, ttl: ttl}
+}
+
+type jwtSource struct {
+	key    Key
+	claims Claims
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *jwtSource) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.token == "" || now.Add(s.ttl/4).After(s.expires) {
+		c := s.claims
+		s.expires = now.Add(s.ttl)
+		c.IssuedAt, c.ExpiresAt = now.Unix(), s.expires.Unix()
+		token, err := SignJWT(s.key, c)
+		if err != nil {
+			return nil, err
+		}
+		s.token = token
+	}
+	return map[string]string{authorization: bearer + s.token}, nil
+}
+
+func (s *jwtSource) RequireTransportSecurity() bool {
+	return true
+}
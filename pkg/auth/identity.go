@@ -0,0 +1,100 @@
+// Package auth tells who a request comes from. The server interceptors
+// put the caller's Identity in the request context, for authorization,
+// auditing and quotas to read with FromContext.
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Identity is a caller as its certificate describes it.
+type Identity struct {
+	// Subject names the caller, its SPIFFE ID if it has one and else its
+	// common name.
+	Subject            string
+	CommonName         string
+	OrganizationalUnit []string
+	// URIs are the URI SANs, SPIFFEID the first of them in the spiffe
+	// scheme.
+	URIs     []string
+	SPIFFEID string
+}
+
+// FromCertificate is the identity a verified certificate stands for.
+func FromCertificate(cert *x509.Certificate) Identity {
+	id := Identity{
+		CommonName:         cert.Subject.CommonName,
+		OrganizationalUnit: cert.Subject.OrganizationalUnit,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+		if id.SPIFFEID == "" && strings.EqualFold(u.Scheme, "spiffe") {
+			id.SPIFFEID = u.String()
+		}
+	}
+	id.Subject = id.SPIFFEID
+	if id.Subject == "" {
+		id.Subject = id.CommonName
+	}
+	return id
+}
+
+type identityKey struct{}
+
+// NewContext returns ctx carrying id.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of the caller, false for anonymous
+// ones.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, OK := ctx.Value(identityKey{}).(Identity)
+	return id, OK
+}
+
+// peerIdentity reads the identity from the client certificate of the
+// connection, false when it has none.
+func peerIdentity(ctx context.Context) (Identity, bool) {
+	p, OK := peer.FromContext(ctx)
+	if !OK {
+		return Identity{}, false
+	}
+	info, OK := p.AuthInfo.(credentials.TLSInfo)
+	if !OK || len(info.State.PeerCertificates) == 0 {
+		return Identity{}, false
+	}
+	return FromCertificate(info.State.PeerCertificates[0]), true
+}
+
+// withIdentity adds the caller's identity to ctx when it has one.
+func withIdentity(ctx context.Context) context.Context {
+	if id, OK := peerIdentity(ctx); OK {
+		return NewContext(ctx, id)
+	}
+	return ctx
+}
+
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withIdentity(ctx), req)
+}
+
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: ss, ctx: withIdentity(ss.Context())})
+}
+
+// contextStream is a server stream with a context of its own.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
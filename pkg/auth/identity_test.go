@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/pkg/certs"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestIdentity(t *testing.T) {
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(dir)
+	require.NoError(t, err)
+	require.NoError(t, certs.Issue(dir, certs.Request{
+		Name: "workload",
+		Kind: certs.Client,
+		Subject: certs.Subject{
+			CommonName:         "orders",
+			OrganizationalUnit: []string{"writers"},
+		},
+		SANs: []string{"spiffe://dlog/ns/shop/sa/orders"},
+	}))
+	serverTLS, err := config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+
+	// every call is answered by a handler reporting the identity it saw
+	ids := make(chan Identity, 1)
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		id, _ := FromContext(stream.Context())
+		ids <- id
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+		return stream.SendMsg(&emptypb.Empty{})
+	}
+	s := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(serverTLS)),
+		grpc.StreamInterceptor(StreamServerInterceptor),
+		grpc.UnknownServiceHandler(handler),
+	)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lst)
+	defer s.Stop()
+
+	call := func(opts ...grpc.DialOption) Identity {
+		cc, err := grpc.Dial(lst.Addr().String(), opts...)
+		require.NoError(t, err)
+		defer cc.Close()
+		err = cc.Invoke(context.Background(), "/test.Test/Call", &emptypb.Empty{}, &emptypb.Empty{})
+		require.NoError(t, err)
+		return <-ids
+	}
+	dialTLS := func(name string) grpc.DialOption {
+		c := files
+		c.ClientCertFile, c.ClientKeyFile = "", ""
+		if name != "" {
+			c.ClientCertFile = filepath.Join(dir, name+".pem")
+			c.ClientKeyFile = filepath.Join(dir, name+"-key.pem")
+		}
+		tlsConfig, err := config.GetTLSConfig(c, config.TLSRequest{ServerAddr: "127.0.0.1"})
+		require.NoError(t, err)
+		return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+
+	require.Equal(t, Identity{
+		Subject:            "spiffe://dlog/ns/shop/sa/orders",
+		CommonName:         "orders",
+		OrganizationalUnit: []string{"writers"},
+		URIs:               []string{"spiffe://dlog/ns/shop/sa/orders"},
+		SPIFFEID:           "spiffe://dlog/ns/shop/sa/orders",
+	}, call(dialTLS("workload")))
+	require.Equal(t, Identity{
+		Subject:            "client",
+		CommonName:         "client",
+		OrganizationalUnit: []string{"Client"},
+	}, call(dialTLS("client")))
+	require.Equal(t, Identity{}, call(dialTLS("")))
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TokenVerifier tells the identity a bearer token stands for.
+type TokenVerifier interface {
+	Verify(token string) (Identity, error)
+}
+
+// Authenticator puts the identity of callers in the request context like
+// the package interceptors do, from the bearer token in the authorization
+// metadata when the call carries one and else from the client
+// certificate. Calls with a token none of the Verifiers accepts fail with
+// Unauthenticated.
+type Authenticator struct {
+	Verifiers []TokenVerifier
+}
+
+// authorization is the metadata key bearer tokens are sent in, after the
+// bearer scheme.
+const (
+	authorization = "authorization"
+	bearer        = "Bearer "
+)
+
+func (a *Authenticator) identity(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorization)
+	if len(values) == 0 {
+		return withIdentity(ctx), nil
+	}
+	if len(values[0]) < len(bearer) || !strings.EqualFold(values[0][:len(bearer)], bearer) {
+		return ctx, status.Error(codes.Unauthenticated, "authorization is not a bearer token")
+	}
+	token := values[0][len(bearer):]
+	for _, v := range a.Verifiers {
+		if id, err := v.Verify(token); err == nil {
+			return NewContext(ctx, id), nil
+		}
+	}
+	return ctx, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func (a *Authenticator) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.identity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *Authenticator) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.identity(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// Key is an HMAC key JWTs are signed with.
+type Key struct {
+	ID string
+	// Algorithm is HS256, HS384 or HS512.
+	Algorithm string
+	Secret    []byte
+}
+
+func (k Key) hash() (func() hash.Hash, error) {
+	switch k.Algorithm {
+	case "HS256":
+		return sha256.New, nil
+	case "HS384":
+		return sha512.New384, nil
+	case "HS512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+}
+
+// LoadKeys reads a JSON Web Key set of symmetric keys:
+//
+//	{"keys": [{"kty": "oct", "kid": "jobs", "alg": "HS256", "k": "c2VjcmV0..."}]}
+func LoadKeys(path string) ([]Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make([]Key, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "oct" {
+			return nil, fmt.Errorf("%s: key %q is not symmetric", path, jwk.Kid)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, jwk.Kid, err)
+		}
+		k := Key{ID: jwk.Kid, Algorithm: jwk.Alg, Secret: secret}
+		if k.Algorithm == "" {
+			k.Algorithm = "HS256"
+		}
+		if _, err = k.hash(); err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, jwk.Kid, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Claims are the JWT claims read into an identity, the subject becoming
+// both its Subject and CommonName.
+type Claims struct {
+	Subject            string   `json:"sub"`
+	OrganizationalUnit []string `json:"ou,omitempty"`
+	ExpiresAt          int64    `json:"exp"`
+	NotBefore          int64    `json:"nbf,omitempty"`
+	IssuedAt           int64    `json:"iat,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// SignJWT returns a compact JWT carrying claims signed with key.
+func SignJWT(key Key, claims Claims) (string, error) {
+	h, err := key.hash()
+	if err != nil {
+		return "", err
+	}
+	hb, err := json.Marshal(header{Alg: key.Algorithm, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	mac := hmac.New(h, key.Secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// JWTVerifier accepts unexpired JWTs signed with one of its keys.
+type JWTVerifier struct {
+	Keys []Key
+	// Leeway allows for clock skew on the expiry and not before times.
+	Leeway time.Duration
+}
+
+func (v *JWTVerifier) Verify(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("not a JWT")
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Identity{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, err
+	}
+	verified := false
+	for _, k := range v.Keys {
+		// the algorithm is the key's, never the token's to pick
+		if (h.Kid != "" && k.ID != h.Kid) || k.Algorithm != h.Alg {
+			continue
+		}
+		hf, err := k.hash()
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(hf, k.Secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Identity{}, errors.New("bad signature")
+	}
+
+	var c Claims
+	if err = decodeSegment(parts[1], &c); err != nil {
+		return Identity{}, err
+	}
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(v.Leeway)) {
+		return Identity{}, errors.New("token expired")
+	}
+	if c.NotBefore != 0 && now.Before(time.Unix(c.NotBefore, 0).Add(-v.Leeway)) {
+		return Identity{}, errors.New("token not valid yet")
+	}
+	if c.Subject == "" {
+		return Identity{}, errors.New("token has no subject")
+	}
+	return Identity{
+		Subject:            c.Subject,
+		CommonName:         c.Subject,
+		OrganizationalUnit: c.OrganizationalUnit,
+	}, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// APIKey maps a static key to the identity of its holder.
+type APIKey struct {
+	Key                string   `json:"key" yaml:"key"`
+	Subject            string   `json:"subject" yaml:"subject"`
+	OrganizationalUnit []string `json:"ou" yaml:"ou"`
+}
+
+// APIKeys accepts a fixed set of keys.
+type APIKeys struct {
+	// keys are indexed by their hash so lookup times tell nothing of
+	// how much of a key matched
+	keys map[[sha256.Size]byte]Identity
+}
+
+// LoadAPIKeys reads a JSON or YAML list of APIKey, told apart by the file
+// extension like policy files:
+//
+//	[{"key": "3f9c...", "subject": "nightly-export", "ou": ["jobs"]}]
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []APIKey
+	if err = config.Unmarshal(path, b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewAPIKeys(list)
+}
+
+func NewAPIKeys(list []APIKey) (*APIKeys, error) {
+	keys := &APIKeys{keys: make(map[[sha256.Size]byte]Identity, len(list))}
+	for _, k := range list {
+		if k.Key == "" || k.Subject == "" {
+			return nil, errors.New("API keys need a key and a subject")
+		}
+		keys.keys[sha256.Sum256([]byte(k.Key))] = Identity{
+			Subject:            k.Subject,
+			CommonName:         k.Subject,
+			OrganizationalUnit: k.OrganizationalUnit,
+		}
+	}
+	return keys, nil
+}
+
+func (k *APIKeys) Verify(token string) (Identity, error) {
+	id, OK := k.keys[sha256.Sum256([]byte(token))]
+	if !OK {
+		return Identity{}, errors.New("unknown API key")
+	}
+	return id, nil
+}
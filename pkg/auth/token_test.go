@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestJWT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys": [
+		{"kty": "oct", "kid": "jobs", "alg": "HS256", "k": "c2VjcmV0LW9mLWpvYnM"},
+		{"kty": "oct", "kid": "ops", "alg": "HS512", "k": "c2VjcmV0LW9mLW9wcw"}
+	]}`), 0644))
+	keys, err := LoadKeys(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret-of-jobs"), keys[0].Secret)
+	v := &JWTVerifier{Keys: keys}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, k := range keys {
+		token, err := SignJWT(k, Claims{Subject: "export", OrganizationalUnit: []string{"jobs"}, ExpiresAt: exp})
+		require.NoError(t, err)
+		id, err := v.Verify(token)
+		require.NoError(t, err)
+		require.Equal(t, Identity{Subject: "export", CommonName: "export", OrganizationalUnit: []string{"jobs"}}, id)
+	}
+
+	bad := map[string]Claims{
+		"expired":   {Subject: "export", ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		"no expiry": {Subject: "export"},
+		"not yet":   {Subject: "export", ExpiresAt: exp, NotBefore: exp},
+		"anonymous": {ExpiresAt: exp},
+	}
+	for name, c := range bad {
+		token, err := SignJWT(keys[0], c)
+		require.NoError(t, err)
+		_, err = v.Verify(token)
+		require.Error(t, err, name)
+	}
+
+	// neither another key, nor another algorithm for the key, nor
+	// tampered claims pass
+	other := Key{ID: "jobs", Algorithm: "HS256", Secret: []byte("guess")}
+	token, err := SignJWT(other, Claims{Subject: "export", ExpiresAt: exp})
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	require.Error(t, err)
+	token, err = SignJWT(Key{ID: "jobs", Algorithm: "HS384", Secret: keys[0].Secret}, Claims{Subject: "export", ExpiresAt: exp})
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	require.Error(t, err)
+	token, err = SignJWT(keys[0], Claims{Subject: "export", ExpiresAt: exp})
+	require.NoError(t, err)
+	admin, err := SignJWT(keys[0], Claims{Subject: "admin", ExpiresAt: exp})
+	require.NoError(t, err)
+	parts, adminParts := strings.Split(token, "."), strings.Split(admin, ".")
+	_, err = v.Verify(parts[0] + "." + adminParts[1] + "." + parts[2])
+	require.Error(t, err)
+}
+
+func TestTokens(t *testing.T) {
+	key := Key{ID: "jobs", Algorithm: "HS256", Secret: []byte("secret-of-jobs")}
+	apiKeys := filepath.Join(t.TempDir(), "api-keys.yaml")
+	require.NoError(t, os.WriteFile(apiKeys, []byte(`
+- {key: k-123, subject: nightly-export, ou: [jobs]}
+`), 0644))
+	keys, err := LoadAPIKeys(apiKeys)
+	require.NoError(t, err)
+	authenticator := &Authenticator{Verifiers: []TokenVerifier{&JWTVerifier{Keys: []Key{key}}, keys}}
+
+	// authenticate runs a call from a client holding cert, if not nil,
+	// and sending the metadata of creds, if not nil
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	authenticate := func(cert *x509.Certificate, creds credentials.PerRPCCredentials) (Identity, error) {
+		ctx := context.Background()
+		if cert != nil {
+			state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+		}
+		if creds != nil {
+			md, err := creds.GetRequestMetadata(ctx)
+			require.NoError(t, err)
+			ctx = metadata.NewIncomingContext(ctx, metadata.New(md))
+		}
+		var id Identity
+		_, err := authenticator.UnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				id, _ = FromContext(ctx)
+				return nil, nil
+			})
+		return id, err
+	}
+	mustAuthenticate := func(cert *x509.Certificate, creds credentials.PerRPCCredentials) Identity {
+		id, err := authenticate(cert, creds)
+		require.NoError(t, err)
+		return id
+	}
+
+	require.Equal(t, Identity{
+		Subject:            "nightly-export",
+		CommonName:         "nightly-export",
+		OrganizationalUnit: []string{"jobs"},
+	}, mustAuthenticate(nil, Bearer("k-123")))
+	require.Equal(t, Identity{
+		Subject:    "backfill",
+		CommonName: "backfill",
+	}, mustAuthenticate(nil, JWT(key, Claims{Subject: "backfill"}, time.Minute)))
+
+	// a token speaks for the caller over its certificate, which is used
+	// without one
+	require.Equal(t, "nightly-export", mustAuthenticate(certificate, Bearer("k-123")).Subject)
+	require.Equal(t, "client", mustAuthenticate(certificate, nil).Subject)
+
+	_, err = authenticate(nil, Bearer("k-456"))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authenticate(nil, JWT(key, Claims{Subject: "backfill"}, -time.Minute))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
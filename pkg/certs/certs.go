@@ -0,0 +1,407 @@
+// Package certs is a small certificate authority issuing the TLS files
+// config.GetTLSConfig loads: ca.pem and ca-key.pem for the authority and
+// <name>.pem and <name>-key.pem for each certificate it issues, server
+// and client by default.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/larkiee/distributed_logger/pkg/config"
+)
+
+// File names of the authority in a certificate directory.
+const (
+	CAFile    = "ca.pem"
+	CAKeyFile = "ca-key.pem"
+)
+
+// Kind is what a certificate may be used for.
+type Kind int
+
+const (
+	Server Kind = iota
+	Client
+)
+
+// Subject is who a certificate speaks for.
+type Subject struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+}
+
+func (s Subject) name() pkix.Name {
+	return pkix.Name{
+		CommonName:         s.CommonName,
+		Organization:       s.Organization,
+		OrganizationalUnit: s.OrganizationalUnit,
+	}
+}
+
+// Request describes a certificate to issue.
+type Request struct {
+	// Name is the base of the file names, <Name>.pem and <Name>-key.pem.
+	Name    string
+	Kind    Kind
+	Subject Subject
+	// SANs are host names, IP addresses or URIs such as SPIFFE IDs,
+	// told apart by their syntax.
+	SANs     []string
+	Validity time.Duration
+}
+
+// Fallbacks of a zero Validity.
+const (
+	DefaultCAValidity   = 10 * 365 * 24 * time.Hour
+	DefaultCertValidity = 365 * 24 * time.Hour
+)
+
+// InitCA creates a self signed authority in dir, failing if one is
+// already there.
+func InitCA(dir string, s Subject, validity time.Duration) error {
+	if _, err := os.Stat(filepath.Join(dir, CAFile)); err == nil {
+		return fmt.Errorf("%s already exists", filepath.Join(dir, CAFile))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cert, key, err := newCA(s, validity)
+	if err != nil {
+		return err
+	}
+	if err = writeKey(filepath.Join(dir, CAKeyFile), key); err != nil {
+		return err
+	}
+	return writeCerts(filepath.Join(dir, CAFile), cert)
+}
+
+func newCA(s Subject, validity time.Duration) ([]byte, crypto.Signer, error) {
+	if validity == 0 {
+		validity = DefaultCAValidity
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := template(s.name(), validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	return cert, key, err
+}
+
+// Issue signs a new certificate with the authority in dir, replacing the
+// files of one with the same name.
+func Issue(dir string, r Request) error {
+	if r.Name == "" {
+		return errors.New("certificate needs a name")
+	}
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	if r.Validity == 0 {
+		r.Validity = DefaultCertValidity
+	}
+	tmpl, err := template(r.Subject.name(), r.Validity)
+	if err != nil {
+		return err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	switch r.Kind {
+	case Server:
+		if len(r.SANs) == 0 {
+			return errors.New("server certificate needs at least one SAN")
+		}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case Client:
+		if r.Subject.CommonName == "" {
+			return errors.New("client certificate needs a common name")
+		}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return fmt.Errorf("unknown kind %d", r.Kind)
+	}
+	for _, san := range r.SANs {
+		switch {
+		case net.ParseIP(san) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(san))
+		case strings.Contains(san, "://"):
+			u, err := url.Parse(san)
+			if err != nil {
+				return err
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	return sign(dir, r.Name, tmpl, ca, caKey)
+}
+
+func sign(dir, name string, tmpl, ca *x509.Certificate, caKey crypto.Signer) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	// the key goes first so a reader seeing the new certificate finds its
+	// key too
+	if err = writeKey(filepath.Join(dir, name+"-key.pem"), key); err != nil {
+		return err
+	}
+	return writeCerts(filepath.Join(dir, name+".pem"), cert)
+}
+
+// Rotate gives every certificate in dir a new key and validity period,
+// keeping its subject, SANs and usage. With newCA the authority is
+// replaced first; ca.pem then holds the new authority followed by the
+// unexpired old ones, so peers still trust certificates they have not
+// reloaded yet. It returns the names of the rotated certificates.
+func Rotate(dir string, newCA bool) ([]string, error) {
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	if newCA {
+		if ca, caKey, err = rotateCA(dir, ca); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), "-key.pem")
+		if name == "ca" {
+			continue
+		}
+		certs, err := readCerts(filepath.Join(dir, name+".pem"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return names, err
+		}
+		old := certs[0]
+		tmpl, err := template(old.Subject, old.NotAfter.Sub(old.NotBefore))
+		if err != nil {
+			return names, err
+		}
+		tmpl.KeyUsage = old.KeyUsage
+		tmpl.ExtKeyUsage = old.ExtKeyUsage
+		tmpl.DNSNames = old.DNSNames
+		tmpl.IPAddresses = old.IPAddresses
+		tmpl.URIs = old.URIs
+		if err = sign(dir, name, tmpl, ca, caKey); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func rotateCA(dir string, old *x509.Certificate) (*x509.Certificate, crypto.Signer, error) {
+	der, key, err := newCA(Subject{
+		CommonName:         old.Subject.CommonName,
+		Organization:       old.Subject.Organization,
+		OrganizationalUnit: old.Subject.OrganizationalUnit,
+	}, old.NotAfter.Sub(old.NotBefore))
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	bundle := [][]byte{der}
+	previous, err := readCerts(filepath.Join(dir, CAFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range previous {
+		if time.Now().Before(c.NotAfter) {
+			bundle = append(bundle, c.Raw)
+		}
+	}
+	if err = writeKey(filepath.Join(dir, CAKeyFile), key); err != nil {
+		return nil, nil, err
+	}
+	return ca, key, writeCerts(filepath.Join(dir, CAFile), bundle...)
+}
+
+// template is a certificate valid from a minute ago, allowing for clock
+// skew, for validity.
+func template(name pkix.Name, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      name,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// loadCA reads the authority in dir, the first certificate of ca.pem.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certs, err := readCerts(filepath.Join(dir, CAFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no key in %s", CAKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, OK := key.(crypto.Signer)
+	if !OK {
+		return nil, nil, fmt.Errorf("%s cannot sign", CAKeyFile)
+	}
+	pub, OK := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !OK || !pub.Equal(certs[0].PublicKey) {
+		return nil, nil, fmt.Errorf("%s does not match %s", CAKeyFile, CAFile)
+	}
+	return certs[0], signer, nil
+}
+
+func readCerts(path string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return certs, nil
+}
+
+func writeCerts(path string, ders ...[]byte) error {
+	var b []byte
+	for _, der := range ders {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return writeFile(path, b, 0644)
+}
+
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// writeFile replaces path in one rename so readers never see half a file.
+func writeFile(path string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Dev sets dir up for a development cluster on this host: an authority,
+// a server certificate for localhost and a client one named client.
+func Dev(dir string) error {
+	if err := InitCA(dir, Subject{CommonName: "dlog development CA"}, 0); err != nil {
+		return err
+	}
+	err := Issue(dir, Request{
+		Name:    "server",
+		Kind:    Server,
+		Subject: Subject{CommonName: "127.0.0.1", OrganizationalUnit: []string{"Server"}},
+		SANs:    []string{"localhost", "127.0.0.1"},
+	})
+	if err != nil {
+		return err
+	}
+	return Issue(dir, Request{
+		Name:    "client",
+		Kind:    Client,
+		Subject: Subject{CommonName: "client", OrganizationalUnit: []string{"Client"}},
+	})
+}
+
+// DevTLSConfig sets dir up like Dev and names its files for
+// config.GetTLSConfig.
+func DevTLSConfig(dir string) (config.TLSConfig, error) {
+	if err := Dev(dir); err != nil {
+		return config.TLSConfig{}, err
+	}
+	return devFiles(dir), nil
+}
+
+func devFiles(dir string) config.TLSConfig {
+	return config.TLSConfig{
+		CAFile:         filepath.Join(dir, CAFile),
+		ServerCertFile: filepath.Join(dir, "server.pem"),
+		ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		ClientCertFile: filepath.Join(dir, "client.pem"),
+		ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+}
@@ -0,0 +1,89 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/pkg/certs/certstest"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCerts(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitCA(dir, Subject{CommonName: "test CA"}, 0))
+	require.Error(t, InitCA(dir, Subject{CommonName: "test CA"}, 0))
+	require.NoError(t, Issue(dir, Request{
+		Name: "server",
+		Kind: Server,
+		SANs: []string{"localhost", "127.0.0.1", "spiffe://dlog/server"},
+	}))
+	require.NoError(t, Issue(dir, Request{
+		Name: "client",
+		Kind: Client,
+		Subject: Subject{
+			CommonName:         "alice",
+			OrganizationalUnit: []string{"writers"},
+		},
+	}))
+	require.Error(t, Issue(dir, Request{Name: "server", Kind: Server}))
+	require.Error(t, Issue(dir, Request{Name: "client", Kind: Client}))
+
+	server, client := tlsConfigs(t, dir)
+	state := handshake(t, server, client)
+	peer := state.PeerCertificates[0]
+	require.Equal(t, "alice", peer.Subject.CommonName)
+	require.Equal(t, []string{"writers"}, peer.Subject.OrganizationalUnit)
+
+	old := readCert(t, dir, "server")
+	names, err := Rotate(dir, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"server", "client"}, names)
+	rotated := readCert(t, dir, "server")
+	require.NotEqual(t, old.SerialNumber, rotated.SerialNumber)
+	require.Equal(t, old.DNSNames, rotated.DNSNames)
+	require.Equal(t, old.URIs, rotated.URIs)
+	require.True(t, old.IPAddresses[0].Equal(rotated.IPAddresses[0]))
+	server, client = tlsConfigs(t, dir)
+	handshake(t, server, client)
+
+	// after a new authority the old client certificate is still trusted
+	// while the new ones verify against the bundle
+	_, oldClient := tlsConfigs(t, dir)
+	_, err = Rotate(dir, true)
+	require.NoError(t, err)
+	cas, err := readCerts(filepath.Join(dir, CAFile))
+	require.NoError(t, err)
+	require.Len(t, cas, 2)
+	server, client = tlsConfigs(t, dir)
+	handshake(t, server, client)
+	oldClient.RootCAs = client.RootCAs
+	handshake(t, server, oldClient)
+}
+
+func tlsConfigs(t *testing.T, dir string) (server, client *tls.Config) {
+	t.Helper()
+	c := devFiles(dir)
+	server, err := config.GetTLSConfig(c, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+	server.ClientAuth = tls.RequireAndVerifyClientCert
+	client, err = config.GetTLSConfig(c, config.TLSRequest{ServerAddr: "localhost"})
+	require.NoError(t, err)
+	return server, client
+}
+
+func handshake(t *testing.T, server, client *tls.Config) tls.ConnectionState {
+	t.Helper()
+	state, err := certstest.Handshake(server, client)
+	require.NoError(t, err)
+	return state
+}
+
+func readCert(t *testing.T, dir, name string) *x509.Certificate {
+	t.Helper()
+	certs, err := readCerts(filepath.Join(dir, name+".pem"))
+	require.NoError(t, err)
+	return certs[0]
+}
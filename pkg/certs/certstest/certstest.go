@@ -0,0 +1,41 @@
+// Package certstest has helpers for testing TLS setups built from the
+// files of package certs.
+package certstest
+
+import "crypto/tls"
+
+// Handshake connects client to server over loopback, returning what the
+// server saw or the error either side got.
+func Handshake(server, client *tls.Config) (tls.ConnectionState, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer ln.Close()
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		err = tc.Handshake()
+		done <- result{tc.ConnectionState(), err}
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		// unblock the server side, it may still be waiting for us
+		ln.Close()
+		<-done
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	r := <-done
+	return r.state, r.err
+}
@@ -4,69 +4,69 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"log"
 	"os"
-	"strings"
-
-	"github.com/spf13/viper"
 )
 
-var (
-	caFile, serverCertFile, serverKeyFile, clientCertFile, clientKeyFile string
-)
+// TLSConfig names the certificate files one node is set up from.
+type TLSConfig struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+	// RequireClientCert turns away clients without a certificate signed
+	// by the CA, servers only verify the certificates they are given
+	// without it.
+	RequireClientCert bool
+}
 
 type TLSRequest struct {
 	IsServer   bool
 	ServerAddr string
 }
 
-func getFilePath(name string) string {
-	crendsPath := viper.GetString("tls.crendsPath")
-	log.Println("crendsPath: ", crendsPath)
-	crendsPath = strings.TrimSuffix(crendsPath, "/")
-
-	return crendsPath + "/" + name
-}
-
-func GetTLSConfig(r TLSRequest) (*tls.Config, error) {
+// GetTLSConfig builds the TLS config of the server or the client side
+// from the files named in c. The certificate is left out when c names
+// none for that side, and so is the CA, which RequireClientCert needs.
+// The files are read once, a Reloader builds configs that follow
+// changes to them.
+func GetTLSConfig(c TLSConfig, r TLSRequest) (*tls.Config, error) {
+	if r.IsServer && c.RequireClientCert && c.CAFile == "" {
+		return nil, errors.New("requiring client certificates needs a CA")
+	}
 	tlsConfig := &tls.Config{}
-	var cert tls.Certificate
-	var err error
+	certFile, keyFile := c.ClientCertFile, c.ClientKeyFile
 	if r.IsServer {
-		cert, err = tls.LoadX509KeyPair(
-			serverCertFile,
-			serverKeyFile,
-		)
-	} else {
-		cert, err = tls.LoadX509KeyPair(
-			clientCertFile,
-			clientKeyFile,
-		)
+		certFile, keyFile = c.ServerCertFile, c.ServerKeyFile
 	}
-
-	if err != nil {
-		return nil, err
-	}
-	certs := []tls.Certificate{cert}
-	if r.IsServer {
-		tlsConfig.Certificates = certs
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	b, err := os.ReadFile(caFile)
-	if err != nil {
-		return nil, err
-	}
-	ca := x509.NewCertPool()
-	OK := ca.AppendCertsFromPEM(b)
-	if !OK {
-		return nil, errors.New("error in appending ca")
-	}
-	if r.IsServer {
-		tlsConfig.ClientCAs = ca
-		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
-	} else {
-		tlsConfig.RootCAs = ca
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		OK := ca.AppendCertsFromPEM(b)
+		if !OK {
+			return nil, errors.New("error in appending ca")
+		}
+		if r.IsServer {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if c.RequireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		} else {
+			tlsConfig.RootCAs = ca
+		}
 	}
 	tlsConfig.ServerName = r.ServerAddr
 	return tlsConfig, nil
-}
\ No newline at end of file
+}
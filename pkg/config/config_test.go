@@ -0,0 +1,85 @@
+package config_test
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/pkg/certs"
+	"github.com/larkiee/distributed_logger/pkg/certs/certstest"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	files, err := certs.DevTLSConfig(t.TempDir())
+	require.NoError(t, err)
+	anonymous := files
+	anonymous.ClientCertFile, anonymous.ClientKeyFile = "", ""
+	client, err := config.GetTLSConfig(files, config.TLSRequest{ServerAddr: "127.0.0.1"})
+	require.NoError(t, err)
+	noCert, err := config.GetTLSConfig(anonymous, config.TLSRequest{ServerAddr: "127.0.0.1"})
+	require.NoError(t, err)
+
+	server, err := config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+	require.NoError(t, handshake(server, client))
+	require.NoError(t, handshake(server, noCert))
+
+	files.RequireClientCert = true
+	server, err = config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+	require.NoError(t, handshake(server, client))
+	require.Error(t, handshake(server, noCert))
+
+	r, err := config.NewReloader(files)
+	require.NoError(t, err)
+	defer r.Close()
+	server = r.TLSConfig(config.TLSRequest{IsServer: true})
+	require.NoError(t, handshake(server, client))
+	require.Error(t, handshake(server, noCert))
+
+	files.CAFile = ""
+	_, err = config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.Error(t, err)
+	_, err = config.NewReloader(files)
+	require.Error(t, err)
+}
+
+func handshake(server, client *tls.Config) error {
+	_, err := certstest.Handshake(server, client)
+	return err
+}
+
+func TestReloaderVerifiesServerAddr(t *testing.T) {
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(dir)
+	require.NoError(t, err)
+	require.NoError(t, certs.Issue(dir, certs.Request{
+		Name: "elsewhere",
+		Kind: certs.Server,
+		SANs: []string{"10.0.0.1"},
+	}))
+	elsewhere := files
+	elsewhere.ServerCertFile = filepath.Join(dir, "elsewhere.pem")
+	elsewhere.ServerKeyFile = filepath.Join(dir, "elsewhere-key.pem")
+	server, err := config.GetTLSConfig(elsewhere, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+
+	r, err := config.NewReloader(files)
+	require.NoError(t, err)
+	defer r.Close()
+	// signed by the CA, but for another IP
+	require.Error(t, handshake(server, r.TLSConfig(config.TLSRequest{ServerAddr: "127.0.0.1"})))
+	require.NoError(t, handshake(server, r.TLSConfig(config.TLSRequest{ServerAddr: "10.0.0.1"})))
+
+	// an IP is not sent as the server name, which leaves nothing to
+	// verify even a certificate for the right one against
+	server, err = config.GetTLSConfig(files, config.TLSRequest{IsServer: true})
+	require.NoError(t, err)
+	client := r.TLSConfig(config.TLSRequest{})
+	client.ServerName = "127.0.0.1"
+	require.Error(t, handshake(server, client))
+	client.ServerName = "localhost"
+	require.NoError(t, handshake(server, client))
+}
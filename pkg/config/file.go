@@ -0,0 +1,20 @@
+package config
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Unmarshal decodes b, read from path, into v. Files ending in .yaml or
+// .yml are YAML, others JSON.
+func Unmarshal(path string, b []byte, v interface{}) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(b, v)
+	default:
+		return json.Unmarshal(b, v)
+	}
+}
@@ -0,0 +1,391 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything a node is set up from. Every setting has a yaml
+// key, a flag, an environment variable and a default, all given in its
+// struct tags. Flags take precedence over the environment, which takes
+// precedence over the config file.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	TLS       NodeTLSConfig   `yaml:"tls"`
+	Segment   SegmentConfig   `yaml:"segment"`
+	Retention RetentionConfig `yaml:"retention"`
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Telemetry TelemetryConfig `yaml:"telemetry"`
+}
+
+type ServerConfig struct {
+	DataDir    string `yaml:"dataDir" flag:"data-dir" env:"DLOGD_DATA_DIR" default:"/var/lib/dlogd" usage:"directory the logs and cluster state are kept in"`
+	RPCPort    int    `yaml:"rpcPort" flag:"rpc-port" env:"DLOGD_RPC_PORT" default:"8400" usage:"port RPCs are served on, on the host of the bind address"`
+	QuotasFile string `yaml:"quotasFile" flag:"quotas-file" env:"DLOGD_QUOTAS_FILE" default:"" usage:"JSON or YAML list of the produce quotas of clients"`
+}
+
+// NodeTLSConfig names the certificate files of the server the node runs
+// and of the client it dials the other nodes with. Each side goes in the
+// clear when it names no file.
+type NodeTLSConfig struct {
+	Server ServerTLSConfig `yaml:"server"`
+	Peer   PeerTLSConfig   `yaml:"peer"`
+}
+
+type ServerTLSConfig struct {
+	CertFile string `yaml:"certFile" flag:"server-tls-cert-file" env:"DLOGD_SERVER_TLS_CERT_FILE" default:"" usage:"server certificate"`
+	KeyFile  string `yaml:"keyFile" flag:"server-tls-key-file" env:"DLOGD_SERVER_TLS_KEY_FILE" default:"" usage:"server key"`
+	CAFile   string `yaml:"caFile" flag:"server-tls-ca-file" env:"DLOGD_SERVER_TLS_CA_FILE" default:"" usage:"CA verifying the client certificates"`
+	// RequireClientCert turns away clients without a certificate signed
+	// by the CA, servers only verify the certificates they are given
+	// without it.
+	RequireClientCert bool `yaml:"requireClientCert" flag:"server-tls-require-client-cert" env:"DLOGD_SERVER_TLS_REQUIRE_CLIENT_CERT" default:"false" usage:"turn away clients without a certificate signed by the CA"`
+}
+
+type PeerTLSConfig struct {
+	CertFile string `yaml:"certFile" flag:"peer-tls-cert-file" env:"DLOGD_PEER_TLS_CERT_FILE" default:"" usage:"client certificate"`
+	KeyFile  string `yaml:"keyFile" flag:"peer-tls-key-file" env:"DLOGD_PEER_TLS_KEY_FILE" default:"" usage:"client key"`
+	CAFile   string `yaml:"caFile" flag:"peer-tls-ca-file" env:"DLOGD_PEER_TLS_CA_FILE" default:"" usage:"CA verifying the server certificates"`
+}
+
+// SegmentConfig bounds the files each log segment is stored in.
+type SegmentConfig struct {
+	MaxStoreBytes uint64 `yaml:"maxStoreBytes" flag:"segment-max-store-bytes" env:"DLOGD_SEGMENT_MAX_STORE_BYTES" default:"1024" usage:"size a segment store is rolled at"`
+	MaxIndexBytes uint64 `yaml:"maxIndexBytes" flag:"segment-max-index-bytes" env:"DLOGD_SEGMENT_MAX_INDEX_BYTES" default:"1024" usage:"size a segment index is rolled at"`
+}
+
+// RetentionConfig bounds how much of each log is kept, zero keeping
+// everything, and how often that is enforced.
+type RetentionConfig struct {
+	MaxBytes uint64        `yaml:"maxBytes" flag:"retention-max-bytes" env:"DLOGD_RETENTION_MAX_BYTES" default:"0" usage:"bytes kept of each partition, all of them when 0"`
+	MaxAge   time.Duration `yaml:"maxAge" flag:"retention-max-age" env:"DLOGD_RETENTION_MAX_AGE" default:"0s" usage:"how long records are kept, forever when 0"`
+	Interval time.Duration `yaml:"interval" flag:"retention-interval" env:"DLOGD_RETENTION_INTERVAL" default:"1m" usage:"how often retention is enforced"`
+}
+
+// DiscoveryConfig is how the node finds the rest of the cluster.
+type DiscoveryConfig struct {
+	// NodeName is the host name when empty.
+	NodeName       string   `yaml:"nodeName" flag:"node-name" env:"DLOGD_NODE_NAME" default:"" usage:"unique name of the node, the host name when empty"`
+	BindAddr       string   `yaml:"bindAddr" flag:"bind-addr" env:"DLOGD_BIND_ADDR" default:"127.0.0.1:8401" usage:"address gossip binds to"`
+	StartJoinAddrs []string `yaml:"startJoinAddrs" flag:"join" env:"DLOGD_JOIN" default:"" usage:"comma separated gossip addresses of nodes to join"`
+	RetryJoin      bool     `yaml:"retryJoin" flag:"retry-join" env:"DLOGD_RETRY_JOIN" default:"false" usage:"keep trying to join in the background when it fails at first"`
+	Bootstrap      bool     `yaml:"bootstrap" flag:"bootstrap" env:"DLOGD_BOOTSTRAP" default:"false" usage:"lead the cluster, for its first node"`
+	// EncryptKey is base64 encoded, gossip goes in the clear without it.
+	EncryptKey string `yaml:"encryptKey" flag:"encrypt-key" env:"DLOGD_ENCRYPT_KEY" default:"" usage:"base64 AES key encrypting the gossip, in the clear when empty"`
+}
+
+// AuthConfig names the files clients are authenticated and authorized
+// with besides their certificates.
+type AuthConfig struct {
+	ACLFile     string `yaml:"aclFile" flag:"acl-file" env:"DLOGD_ACL_FILE" default:"" usage:"JSON or YAML policy authorizing client calls, reloaded when it changes"`
+	JWTKeysFile string `yaml:"jwtKeysFile" flag:"jwt-keys-file" env:"DLOGD_JWT_KEYS_FILE" default:"" usage:"JSON Web Key set of the HMAC keys bearer JWTs are signed with"`
+	APIKeysFile string `yaml:"apiKeysFile" flag:"api-keys-file" env:"DLOGD_API_KEYS_FILE" default:"" usage:"JSON or YAML list of the API keys clients may send as bearer tokens"`
+}
+
+type TelemetryConfig struct {
+	Exporter       string        `yaml:"exporter" flag:"telemetry-exporter" env:"DLOGD_TELEMETRY_EXPORTER" default:"" usage:"where spans and metrics are exported, otlp or stdout, nowhere when empty"`
+	Endpoint       string        `yaml:"endpoint" flag:"otlp-endpoint" env:"DLOGD_OTLP_ENDPOINT" default:"" usage:"host:port of the OTLP collector, $OTEL_EXPORTER_OTLP_ENDPOINT when empty"`
+	Insecure       bool          `yaml:"insecure" flag:"otlp-insecure" env:"DLOGD_OTLP_INSECURE" default:"false" usage:"talk to the OTLP collector in plaintext"`
+	MetricInterval time.Duration `yaml:"metricInterval" flag:"metric-interval" env:"DLOGD_METRIC_INTERVAL" default:"1m" usage:"how often metrics are exported"`
+	MetricsAddr    string        `yaml:"metricsAddr" flag:"metrics-addr" env:"DLOGD_METRICS_ADDR" default:"" usage:"address Prometheus metrics are served on at /metrics, not served when empty"`
+}
+
+// Load reads the config file at path over the defaults, applies the
+// environment overrides and validates the result. An empty path loads
+// the defaults and the environment only.
+func Load(path string) (Config, error) {
+	return LoadFlags(path, nil)
+}
+
+// LoadFlags is Load with the flags set on fs, registered by Flags,
+// applied last.
+func LoadFlags(path string, fs *flag.FlagSet) (Config, error) {
+	var c Config
+	v := reflect.ValueOf(&c).Elem()
+	err := walk(v, func(f reflect.StructField, fv reflect.Value) error {
+		if err := set(fv, f.Tag.Get("default")); err != nil {
+			return fmt.Errorf("default of %s: %w", f.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		if err = d.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	err = walk(v, func(f reflect.StructField, fv reflect.Value) error {
+		key := f.Tag.Get("env")
+		s, OK := os.LookupEnv(key)
+		if !OK {
+			return nil
+		}
+		if err := set(fv, s); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+	if fs != nil {
+		given := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		err = walk(v, func(f reflect.StructField, fv reflect.Value) error {
+			name := f.Tag.Get("flag")
+			if !given[name] {
+				return nil
+			}
+			return set(fv, fs.Lookup(name).Value.String())
+		})
+		if err != nil {
+			return c, err
+		}
+	}
+	if c.Discovery.NodeName == "" {
+		if c.Discovery.NodeName, err = os.Hostname(); err != nil {
+			return c, err
+		}
+	}
+	return c, c.Validate()
+}
+
+// Flags registers the flag of every setting on fs, for LoadFlags. Their
+// values are checked as they are parsed.
+func Flags(fs *flag.FlagSet) {
+	var c Config
+	walk(reflect.ValueOf(&c).Elem(), func(f reflect.StructField, fv reflect.Value) error {
+		def := f.Tag.Get("default")
+		fs.Var(&flagValue{typ: fv.Type(), s: def}, f.Tag.Get("flag"), f.Tag.Get("usage"))
+		return nil
+	})
+}
+
+// flagValue holds a setting given on the command line, checked against
+// the type of its field.
+type flagValue struct {
+	typ reflect.Type
+	s   string
+}
+
+func (v *flagValue) Set(s string) error {
+	if err := set(reflect.New(v.typ).Elem(), s); err != nil {
+		return err
+	}
+	v.s = s
+	return nil
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.s
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.typ.Kind() == reflect.Bool
+}
+
+// walk calls fn with every setting of v.
+func walk(v reflect.Value, fn func(f reflect.StructField, fv reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Duration(0)) {
+			if err := walk(fv, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(f, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func set(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case []string:
+		var list []string
+		if s != "" {
+			list = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(list))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// Validate reports every setting that cannot work.
+func (c Config) Validate() error {
+	var errs []error
+	for _, side := range []struct {
+		name  string
+		files TLSConfig
+	}{
+		{"tls.server", c.TLS.Server.Files()},
+		{"tls.peer", c.TLS.Peer.Files()},
+	} {
+		f := side.files
+		if (f.ServerCertFile == "") != (f.ServerKeyFile == "") || (f.ClientCertFile == "") != (f.ClientKeyFile == "") {
+			errs = append(errs, fmt.Errorf("%s: a certificate needs its key and the other way around", side.name))
+		}
+		for _, name := range []string{f.CAFile, f.ServerCertFile, f.ServerKeyFile, f.ClientCertFile, f.ClientKeyFile} {
+			if name == "" {
+				continue
+			}
+			if _, err := os.Stat(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", side.name, err))
+			}
+		}
+	}
+	if c.TLS.Server.RequireClientCert && c.TLS.Server.CAFile == "" {
+		errs = append(errs, errors.New("tls.server.requireClientCert: requiring client certificates needs a CA"))
+	}
+	if c.Server.DataDir == "" {
+		errs = append(errs, errors.New("server.dataDir: must be set"))
+	}
+	if c.Server.RPCPort < 0 || c.Server.RPCPort > 65535 {
+		errs = append(errs, fmt.Errorf("server.rpcPort: %d is out of range", c.Server.RPCPort))
+	}
+	if c.Segment.MaxStoreBytes == 0 {
+		errs = append(errs, errors.New("segment.maxStoreBytes: must be positive"))
+	}
+	if c.Segment.MaxIndexBytes < entWidth {
+		errs = append(errs, fmt.Errorf("segment.maxIndexBytes: must hold at least one %d byte entry", entWidth))
+	}
+	if c.Retention.MaxAge < 0 || c.Retention.Interval < 0 {
+		errs = append(errs, errors.New("retention: durations cannot be negative"))
+	}
+	if _, _, err := net.SplitHostPort(c.Discovery.BindAddr); err != nil {
+		errs = append(errs, fmt.Errorf("discovery.bindAddr: %w", err))
+	}
+	for _, addr := range c.Discovery.StartJoinAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("discovery.startJoinAddrs: %w", err))
+		}
+	}
+	if _, err := c.Discovery.Key(); err != nil {
+		errs = append(errs, fmt.Errorf("discovery.encryptKey: %w", err))
+	}
+	if c.Telemetry.MetricInterval < 0 {
+		errs = append(errs, errors.New("telemetry.metricInterval: cannot be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// entWidth is the size of a log index entry.
+const entWidth = 12
+
+// Files names the files of the server side for GetTLSConfig and
+// NewReloader.
+func (c ServerTLSConfig) Files() TLSConfig {
+	return TLSConfig{
+		CAFile:            c.CAFile,
+		ServerCertFile:    c.CertFile,
+		ServerKeyFile:     c.KeyFile,
+		RequireClientCert: c.RequireClientCert,
+	}
+}
+
+// Files names the files of the client side for GetTLSConfig and
+// NewReloader.
+func (c PeerTLSConfig) Files() TLSConfig {
+	return TLSConfig{
+		CAFile:         c.CAFile,
+		ClientCertFile: c.CertFile,
+		ClientKeyFile:  c.KeyFile,
+	}
+}
+
+// Key decodes EncryptKey, nil when it is empty.
+func (c DiscoveryConfig) Key() ([]byte, error) {
+	if c.EncryptKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(c.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, want 16, 24 or 32", len(key))
+}
+
+// LogConfig is the log setup of the node's topics.
+func (c Config) LogConfig() log.ManagerConfig {
+	return log.ManagerConfig{
+		DefaultTopic: log.TopicConfig{
+			Log: log.Config{
+				Segment: log.SegmentConfig{
+					MaxStoreBytes: c.Segment.MaxStoreBytes,
+					MaxIndexBytes: c.Segment.MaxIndexBytes,
+				},
+				Retention: log.RetentionConfig{
+					MaxBytes: c.Retention.MaxBytes,
+					MaxAge:   c.Retention.MaxAge,
+				},
+			},
+		},
+		RetentionInterval: c.Retention.Interval,
+	}
+}
@@ -0,0 +1,125 @@
+package config_test
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/pkg/certs"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := config.Load("")
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/dlogd", c.Server.DataDir)
+	require.Equal(t, 8400, c.Server.RPCPort)
+	require.Equal(t, uint64(1024), c.Segment.MaxIndexBytes)
+	require.Equal(t, time.Minute, c.Retention.Interval)
+	require.Equal(t, "127.0.0.1:8401", c.Discovery.BindAddr)
+	require.Nil(t, c.Discovery.StartJoinAddrs)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	require.Equal(t, hostname, c.Discovery.NodeName)
+
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(filepath.Join(dir, "certs"))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  rpcPort: 8400
+tls:
+  server:
+    certFile: `+files.ServerCertFile+`
+    keyFile: `+files.ServerKeyFile+`
+    caFile: `+files.CAFile+`
+    requireClientCert: true
+retention:
+  maxAge: 24h
+discovery:
+  nodeName: node-1
+  startJoinAddrs: [10.0.0.1:8401, 10.0.0.2:8401]
+`), 0644))
+	t.Setenv("DLOGD_RPC_PORT", "8500")
+	t.Setenv("DLOGD_SEGMENT_MAX_STORE_BYTES", "4096")
+	c, err = config.Load(path)
+	require.NoError(t, err)
+	require.Equal(t, 8500, c.Server.RPCPort)
+	require.Equal(t, "node-1", c.Discovery.NodeName)
+	require.Equal(t, []string{"10.0.0.1:8401", "10.0.0.2:8401"}, c.Discovery.StartJoinAddrs)
+	require.Equal(t, config.TLSConfig{
+		CAFile:            files.CAFile,
+		ServerCertFile:    files.ServerCertFile,
+		ServerKeyFile:     files.ServerKeyFile,
+		RequireClientCert: true,
+	}, c.TLS.Server.Files())
+	require.Equal(t, config.TLSConfig{}, c.TLS.Peer.Files())
+	lc := c.LogConfig()
+	require.Equal(t, uint64(4096), lc.DefaultTopic.Log.Segment.MaxStoreBytes)
+	require.Equal(t, 24*time.Hour, lc.DefaultTopic.Log.Retention.MaxAge)
+	require.Equal(t, time.Minute, lc.RetentionInterval)
+}
+
+func TestLoadFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  rpcPort: 8400
+  dataDir: /from/file
+segment:
+  maxStoreBytes: 2048
+`), 0644))
+	t.Setenv("DLOGD_RPC_PORT", "8500")
+	t.Setenv("DLOGD_SEGMENT_MAX_STORE_BYTES", "4096")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config.Flags(fs)
+	require.NoError(t, fs.Parse([]string{"-rpc-port", "8600", "-join", "10.0.0.1:8401", "-retry-join"}))
+	c, err := config.LoadFlags(path, fs)
+	require.NoError(t, err)
+	// flags over the environment over the file
+	require.Equal(t, 8600, c.Server.RPCPort)
+	require.Equal(t, uint64(4096), c.Segment.MaxStoreBytes)
+	require.Equal(t, "/from/file", c.Server.DataDir)
+	require.Equal(t, []string{"10.0.0.1:8401"}, c.Discovery.StartJoinAddrs)
+	require.True(t, c.Discovery.RetryJoin)
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config.Flags(fs)
+	require.Error(t, fs.Parse([]string{"-retention-max-age", "forever"}))
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":        "server:\n  rpcProt: 8400\n",
+		"port":               "server:\n  rpcPort: 65555\n",
+		"store":              "segment:\n  maxStoreBytes: 0\n",
+		"index":              "segment:\n  maxIndexBytes: 4\n",
+		"retention":          "retention:\n  maxAge: -1h\n",
+		"bind address":       "discovery:\n  bindAddr: localhost\n",
+		"join address":       "discovery:\n  startJoinAddrs: [10.0.0.1]\n",
+		"encrypt key":        "discovery:\n  encryptKey: c2hvcnQ=\n",
+		"missing key":        "tls:\n  peer:\n    certFile: client.pem\n",
+		"missing certs":      "tls:\n  server:\n    certFile: nowhere.pem\n    keyFile: nowhere-key.pem\n",
+		"client cert, no CA": "tls:\n  server:\n    requireClientCert: true\n",
+	}
+	for name, file := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(file), 0644))
+			_, err := config.Load(path)
+			require.Error(t, err)
+		})
+	}
+
+	t.Setenv("DLOGD_RETRY_JOIN", "maybe")
+	_, err := config.Load("")
+	require.ErrorContains(t, err, "DLOGD_RETRY_JOIN")
+}
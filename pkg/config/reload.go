@@ -0,0 +1,238 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Reloader keeps the certificates and CA named in a TLSConfig loaded,
+// reading them again on Reload and whenever the files change. The TLS
+// configs it builds look them up on every handshake, so connections made
+// before a reload carry on while new ones use the new files.
+type Reloader struct {
+	files  TLSConfig
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	server *tls.Certificate
+	client *tls.Certificate
+	pool   *x509.CertPool
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func NewReloader(c TLSConfig) (*Reloader, error) {
+	if c.RequireClientCert && c.CAFile == "" {
+		return nil, errors.New("requiring client certificates needs a CA")
+	}
+	r := &Reloader{
+		files:  c,
+		logger: zap.L().Named("tls"),
+		done:   make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	// watch the directories, rotated files are renamed into place
+	var err error
+	if r.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	for _, f := range r.names() {
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err = r.watcher.Add(dir); err != nil {
+			r.watcher.Close()
+			return nil, err
+		}
+	}
+	go r.watch()
+	return r, nil
+}
+
+// names are the files the reloader reads.
+func (r *Reloader) names() []string {
+	var names []string
+	for _, f := range []string{r.files.CAFile, r.files.ServerCertFile, r.files.ServerKeyFile, r.files.ClientCertFile, r.files.ClientKeyFile} {
+		if f != "" {
+			names = append(names, filepath.Clean(f))
+		}
+	}
+	return names
+}
+
+// Reload reads the files again. On error the files loaded before are
+// kept, all or none of them being replaced.
+func (r *Reloader) Reload() error {
+	var server, client *tls.Certificate
+	var pool *x509.CertPool
+	var err error
+	if r.files.ServerCertFile != "" || r.files.ServerKeyFile != "" {
+		if server, err = loadPair(r.files.ServerCertFile, r.files.ServerKeyFile); err != nil {
+			return err
+		}
+	}
+	if r.files.ClientCertFile != "" || r.files.ClientKeyFile != "" {
+		if client, err = loadPair(r.files.ClientCertFile, r.files.ClientKeyFile); err != nil {
+			return err
+		}
+	}
+	if r.files.CAFile != "" {
+		b, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate in %s", r.files.CAFile)
+		}
+	}
+	r.mu.Lock()
+	r.server, r.client, r.pool = server, client, pool
+	r.mu.Unlock()
+	return nil
+}
+
+func loadPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (r *Reloader) watch() {
+	defer close(r.done)
+	names := map[string]bool{}
+	for _, f := range r.names() {
+		names[f] = true
+	}
+	for {
+		select {
+		case e, OK := <-r.watcher.Events:
+			if !OK {
+				return
+			}
+			if !names[filepath.Clean(e.Name)] || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			// a certificate and its key are replaced one after the other,
+			// the first event may find them not matching yet
+			if err := r.Reload(); err != nil {
+				r.logger.Debug("failed to reload", zap.Error(err), zap.String("path", e.Name))
+				continue
+			}
+			r.logger.Info("reloaded", zap.String("path", e.Name))
+		case err, OK := <-r.watcher.Errors:
+			if !OK {
+				return
+			}
+			r.logger.Error("failed to watch", zap.Error(err))
+		}
+	}
+}
+
+// TLSConfig is the reloading counterpart of GetTLSConfig.
+func (r *Reloader) TLSConfig(req TLSRequest) *tls.Config {
+	c := &tls.Config{ServerName: req.ServerAddr}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if req.IsServer {
+		if r.server != nil {
+			c.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				r.mu.RLock()
+				defer r.mu.RUnlock()
+				return r.server, nil
+			}
+		}
+		if r.pool != nil {
+			// the client certificate is verified against the current
+			// CA rather than the fixed ClientCAs
+			c.ClientAuth = tls.RequestClientCert
+			if r.files.RequireClientCert {
+				c.ClientAuth = tls.RequireAnyClientCert
+			}
+			c.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+				if len(raw) == 0 {
+					return nil
+				}
+				certs := make([]*x509.Certificate, len(raw))
+				for i, b := range raw {
+					cert, err := x509.ParseCertificate(b)
+					if err != nil {
+						return err
+					}
+					certs[i] = cert
+				}
+				return r.verify(certs, "", x509.ExtKeyUsageClientAuth)
+			}
+		}
+		return c
+	}
+
+	if r.client != nil {
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.client, nil
+		}
+	}
+	if r.pool != nil {
+		// VerifyConnection rather than VerifyPeerCertificate, it is given
+		// the server name gRPC fills in for configs without one. That name
+		// is left out for IP addresses, so those need ServerAddr
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			name := req.ServerAddr
+			if name == "" {
+				name = cs.ServerName
+			}
+			if name == "" {
+				return errors.New("no server name to verify the certificate against")
+			}
+			return r.verify(cs.PeerCertificates, name, x509.ExtKeyUsageServerAuth)
+		}
+	}
+	return c
+}
+
+func (r *Reloader) verify(certs []*x509.Certificate, name string, usage x509.ExtKeyUsage) error {
+	r.mu.RLock()
+	pool := r.pool
+	r.mu.RUnlock()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       name,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// Close stops watching the files.
+func (r *Reloader) Close() error {
+	err := r.watcher.Close()
+	<-r.done
+	return err
+}
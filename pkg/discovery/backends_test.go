@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatic(t *testing.T) {
+	local := Member{Name: "0", RPCAddr: "127.0.0.1:1000"}
+	h := newRecorder()
+	s, err := NewStatic(local, []Member{
+		local,
+		{Name: "1", RPCAddr: "127.0.0.1:1001", Tags: map[string]string{"role": "leader"}},
+		{Name: "2", RPCAddr: "127.0.0.1:1002"},
+	}, h)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"1": "127.0.0.1:1001",
+		"2": "127.0.0.1:1002",
+	}, h.get())
+	alive := s.Alive()
+	require.Len(t, alive, 3)
+	require.Equal(t, "leader", alive[1].Tags["role"])
+	require.NoError(t, s.Leave())
+}
+
+func TestFile(t *testing.T) {
+	for name, content := range map[string][2]string{
+		"peers.json": {
+			`[{"name": "0", "rpc_addr": "127.0.0.1:1000"}, {"name": "1", "rpc_addr": "127.0.0.1:1001"}]`,
+			`[{"name": "1", "rpc_addr": "127.0.0.1:2001"}, {"name": "2", "rpc_addr": "127.0.0.1:1002"}]`,
+		},
+		"peers.yaml": {
+			"- name: \"0\"\n  rpc_addr: 127.0.0.1:1000\n- name: \"1\"\n  rpc_addr: 127.0.0.1:1001\n",
+			"- name: \"1\"\n  rpc_addr: 127.0.0.1:2001\n- name: \"2\"\n  rpc_addr: 127.0.0.1:1002\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(file, []byte(content[0]), 0644))
+
+			h := newRecorder()
+			f, err := NewFile(Member{Name: "0", RPCAddr: "127.0.0.1:1000"}, file, h)
+			require.NoError(t, err)
+			defer f.Leave()
+			require.Equal(t, map[string]string{"1": "127.0.0.1:1001"}, h.get())
+
+			// replace the file the way config management would
+			require.NoError(t, os.WriteFile(file+".tmp", []byte(content[1]), 0644))
+			require.NoError(t, os.Rename(file+".tmp", file))
+			require.Eventually(t, func() bool {
+				return len(h.get()) == 2 &&
+					h.get()["1"] == "127.0.0.1:2001" &&
+					h.get()["2"] == "127.0.0.1:1002"
+			}, 3*time.Second, 50*time.Millisecond)
+
+			// a broken file keeps the known members
+			require.NoError(t, os.WriteFile(file, []byte("{"), 0644))
+			require.Never(t, func() bool {
+				return len(h.get()) != 2
+			}, 300*time.Millisecond, 50*time.Millisecond)
+			require.Len(t, f.Alive(), 3)
+		})
+	}
+}
+
+func TestDNS(t *testing.T) {
+	srv := newSRVServer(t, "_dlog._tcp.cluster.test.")
+	srv.set([]*dns.SRV{
+		{Target: "node-0.cluster.test.", Port: 1000},
+		{Target: "node-1.cluster.test.", Port: 1001},
+	})
+
+	h := newRecorder()
+	d, err := NewDNS(Member{Name: "0", RPCAddr: "node-0.cluster.test:1000"}, DNSConfig{
+		Name:     "_dlog._tcp.cluster.test.",
+		Server:   srv.addr,
+		Interval: 50 * time.Millisecond,
+	}, h)
+	require.NoError(t, err)
+	defer d.Leave()
+	require.Equal(t, map[string]string{
+		"node-1.cluster.test:1001": "node-1.cluster.test:1001",
+	}, h.get())
+
+	srv.set([]*dns.SRV{
+		{Target: "node-0.cluster.test.", Port: 1000},
+		{Target: "node-2.cluster.test.", Port: 1002},
+	})
+	require.Eventually(t, func() bool {
+		got := h.get()
+		_, OK := got["node-2.cluster.test:1002"]
+		return len(got) == 1 && OK
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Len(t, d.Alive(), 2)
+}
+
+func TestDNSTags(t *testing.T) {
+	srv := newSRVServer(t, "_dlog._tcp.cluster.test.")
+	srv.set([]*dns.SRV{
+		{Target: "node-0.cluster.test.", Port: 1000},
+		{Target: "node-1.cluster.test.", Port: 1001},
+	})
+
+	var mu sync.Mutex
+	role := "leader"
+	h := newRecorder()
+	d, err := NewDNS(Member{Name: "0", RPCAddr: "node-0.cluster.test:1000"}, DNSConfig{
+		Name:     "_dlog._tcp.cluster.test.",
+		Server:   srv.addr,
+		Interval: 50 * time.Millisecond,
+		Tags: func(addr string) (map[string]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if role == "" {
+				return nil, errors.New("unreachable")
+			}
+			return map[string]string{"role": role}, nil
+		},
+	}, h)
+	require.NoError(t, err)
+	defer d.Leave()
+	require.Equal(t, "leader", h.tagsOf("node-1.cluster.test:1001")["role"])
+
+	// tags are asked for again on every lookup
+	mu.Lock()
+	role = "follower"
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		return h.tagsOf("node-1.cluster.test:1001")["role"] == "follower"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// and kept when the member can't be asked
+	mu.Lock()
+	role = ""
+	mu.Unlock()
+	require.Never(t, func() bool {
+		return h.tagsOf("node-1.cluster.test:1001")["role"] != "follower"
+	}, 300*time.Millisecond, 50*time.Millisecond)
+}
+
+// recorder keeps the members a Handler was told about.
+type recorder struct {
+	mu      sync.Mutex
+	members map[string]string
+	tags    map[string]map[string]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		members: make(map[string]string),
+		tags:    make(map[string]map[string]string),
+	}
+}
+
+func (r *recorder) Join(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members[name] = addr
+	return nil
+}
+
+func (r *recorder) Update(name string, tags map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members[name] = tags["rpc_addr"]
+	r.tags[name] = tags
+	return nil
+}
+
+func (r *recorder) tagsOf(name string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tags[name]
+}
+
+func (r *recorder) Leave(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, name)
+	return nil
+}
+
+func (r *recorder) get() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make(map[string]string, len(r.members))
+	for k, v := range r.members {
+		members[k] = v
+	}
+	return members
+}
+
+// srvServer is a DNS server answering a single SRV name.
+type srvServer struct {
+	addr string
+	name string
+
+	mu      sync.Mutex
+	records []*dns.SRV
+}
+
+func newSRVServer(t *testing.T, name string) *srvServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &srvServer{addr: pc.LocalAddr().String(), name: name}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           s,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return s
+}
+
+func (s *srvServer) set(records []*dns.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+func (s *srvServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := new(dns.Msg)
+	res.SetReply(req)
+	s.mu.Lock()
+	for _, q := range req.Question {
+		if q.Qtype != dns.TypeSRV || q.Name != s.name {
+			continue
+		}
+		for _, r := range s.records {
+			rr := *r
+			rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 0}
+			res.Answer = append(res.Answer, &rr)
+		}
+	}
+	s.mu.Unlock()
+	w.WriteMsg(res)
+}
@@ -1,12 +1,33 @@
 package discovery
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 )
 
+// Discoverer finds the other members of the cluster and tells a Handler
+// as they come and go. Membership, which gossips through serf, is the
+// default one; Static, File and DNS find members without gossip.
+type Discoverer interface {
+	// Alive returns the members currently in the cluster, the local
+	// member included.
+	Alive() []Member
+	// Leave stops discovery, telling the others when the backend can.
+	Leave() error
+}
+
+// Member is a node of the cluster as found by a Discoverer.
+type Member struct {
+	Name string `json:"name" yaml:"name"`
+	RPCAddr string `json:"rpc_addr" yaml:"rpc_addr"`
+	// Tags are what the member advertises about itself, such as its role.
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
 
 type Membership struct {
 	Config
@@ -14,6 +35,11 @@ type Membership struct {
 	serf *serf.Serf
 	events chan serf.Event
 	logger *zap.Logger
+	leave chan struct{}
+	// mu guards left, Leave being called from shutdown and from failed
+	// starts alike.
+	mu sync.Mutex
+	left bool
 }
 
 type Config struct {
@@ -21,11 +47,70 @@ type Config struct {
 	BindAddr string
 	Tags map[string]string
 	StartJoinAddrs []string
+	// EncryptKey is the primary key gossip is encrypted with, 16, 24 or
+	// 32 bytes long. Gossip goes in the clear without it.
+	EncryptKey []byte
+	// Keyring holds extra keys accepted on incoming gossip, so members
+	// keep talking to each other while a new key is rolled out.
+	Keyring [][]byte
+	// KeyringFile is where changes made through the key operations are
+	// persisted. When it exists it is loaded in place of EncryptKey and
+	// Keyring.
+	KeyringFile string
+	// SnapshotPath is where serf records the members it knows of, so a
+	// restarted member rejoins them on its own, even after leaving.
+	SnapshotPath string
+	// RetryJoin keeps trying StartJoinAddrs in the background when the
+	// first attempt fails, waiting RetryInterval (1 second by default)
+	// and doubling the wait up to RetryMaxInterval (30 seconds by
+	// default). Without it a failed join is only reported, the member
+	// waiting for the others to join it.
+	RetryJoin bool
+	RetryInterval time.Duration
+	RetryMaxInterval time.Duration
+	// JoinFailed, when set, is told about every failed background join.
+	JoinFailed func(err error)
 }
 
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error 
+	// Update is called with a member's tags, rpc_addr included, right
+	// after it joins and whenever it changes them.
+	Update(name string, tags map[string]string) error
+}
+
+// Handlers passes every event on to each of its handlers.
+type Handlers []Handler
+
+func (hs Handlers) Join(name, addr string) error {
+	var errs []error
+	for _, h := range hs {
+		if err := h.Join(name, addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (hs Handlers) Leave(name string) error {
+	var errs []error
+	for _, h := range hs {
+		if err := h.Leave(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (hs Handlers) Update(name string, tags map[string]string) error {
+	var errs []error
+	for _, h := range hs {
+		if err := h.Update(name, tags); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func NewMembership(c Config, h Handler) (*Membership, error){
@@ -33,8 +118,15 @@ func NewMembership(c Config, h Handler) (*Membership, error){
 		Config: c,
 		handler: h,
 		logger: zap.L().Named("membership"),
+		leave: make(chan struct{}),
+	}
+	if m.RetryInterval == 0 {
+		m.RetryInterval = time.Second
+	}
+	if m.RetryMaxInterval == 0 {
+		m.RetryMaxInterval = 30 * time.Second
 	}
-	
+
 	if err := m.initSerif(); err != nil {
 		return nil, err
 	}
@@ -53,6 +145,12 @@ func (m *Membership) initSerif() error{
 	sc.MemberlistConfig.BindPort = addr.Port
 	sc.Tags = m.Tags
 	sc.NodeName = m.NodeName
+	sc.KeyringFile = m.KeyringFile
+	sc.SnapshotPath = m.SnapshotPath
+	sc.RejoinAfterLeave = m.SnapshotPath != ""
+	if sc.MemberlistConfig.Keyring, err = m.keyring(); err != nil {
+		return err
+	}
 
 	eChan := make(chan serf.Event)
 	m.events = eChan
@@ -63,15 +161,50 @@ func (m *Membership) initSerif() error{
 		return err
 	}
 	go m.handleEvents()
-	if m.StartJoinAddrs != nil {
-		_, err := m.serf.Join(m.StartJoinAddrs, true)
-		if err != nil {
-			return nil
-		}
+	if len(m.StartJoinAddrs) == 0 {
+		return nil
+	}
+	if _, err = m.serf.Join(m.StartJoinAddrs, true); err == nil {
+		return nil
+	}
+	m.joinFailed(err)
+	if m.RetryJoin {
+		go m.retryJoin()
 	}
 	return nil
 }
 
+// retryJoin tries StartJoinAddrs until one of them lets us in, backing
+// off between attempts.
+func (m *Membership) retryJoin() {
+	wait := m.RetryInterval
+	for {
+		select {
+		case <-m.leave:
+			return
+		case <-time.After(wait):
+		}
+		if _, err := m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			m.joinFailed(err)
+			wait = min(2*wait, m.RetryMaxInterval)
+			continue
+		}
+		m.logger.Info("joined cluster", zap.Strings("addrs", m.StartJoinAddrs))
+		return
+	}
+}
+
+func (m *Membership) joinFailed(err error) {
+	m.logger.Warn(
+		"failed to join cluster",
+		zap.Error(err),
+		zap.Strings("addrs", m.StartJoinAddrs),
+	)
+	if m.JoinFailed != nil {
+		m.JoinFailed(err)
+	}
+}
+
 func (m *Membership) handleEvents() {
 	for e := range m.events {
 		switch e.EventType(){
@@ -83,7 +216,15 @@ func (m *Membership) handleEvents() {
 				}
 				m.handleJoin(member)
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		case serf.EventMemberUpdate:
+			e := e.(serf.MemberEvent)
+			for _, member := range e.Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleUpdate(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed, serf.EventMemberReap:
 			e := e.(serf.MemberEvent)
 			for _, member := range e.Members {
 				if m.isLocal(member){
@@ -103,6 +244,13 @@ func (m *Membership) handleJoin(member serf.Member) {
 	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
 		m.errLog(err, "error in join", member)
 	}
+	m.handleUpdate(member)
+}
+
+func (m *Membership) handleUpdate(member serf.Member) {
+	if err := m.handler.Update(member.Name, member.Tags); err != nil {
+		m.errLog(err, "error in update", member)
+	}
 }
 
 func (m *Membership) handleLeave(member serf.Member){
@@ -124,6 +272,43 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// SetTags replaces the tags the local member advertises, telling the
+// other members through an update.
+func (m *Membership) SetTags(tags map[string]string) error {
+	if err := m.serf.SetTags(tags); err != nil {
+		return err
+	}
+	m.Tags = tags
+	return nil
+}
+
+// Alive makes Membership a Discoverer.
+func (m *Membership) Alive() []Member {
+	var members []Member
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		members = append(members, Member{
+			Name: member.Name,
+			RPCAddr: member.Tags["rpc_addr"],
+			Tags: member.Tags,
+		})
+	}
+	return members
+}
+
+// Leave tells the cluster the member is leaving and shuts serf down.
 func (m *Membership) Leave() error {
-	return m.serf.Leave()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.left {
+		return nil
+	}
+	m.left = true
+	close(m.leave)
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
 }
\ No newline at end of file
@@ -35,6 +35,31 @@ func TestDoscovery(t *testing.T){
 }
 
 
+func TestUpdate(t *testing.T) {
+	m0 := setupMemberWith(t, "0", Config{})
+	h := m0.handler.(*handler)
+	m1 := setupMemberWith(t, "1", Config{
+		StartJoinAddrs: []string{m0.BindAddr},
+	})
+	require.Equal(t, "1", (<-h.joins)["id"])
+
+	require.NoError(t, m1.SetTags(map[string]string{"rpc_addr": "127.0.0.1:1"}))
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case u := <-h.updates:
+			// the first update carries the tags member 1 joined with
+			if u["addr"] == m1.BindAddr {
+				continue
+			}
+			require.Equal(t, map[string]string{"id": "1", "addr": "127.0.0.1:1"}, u)
+			return
+		case <-timeout:
+			t.Fatal("no update")
+		}
+	}
+}
+
 func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler){
 	t.Helper()
 	id := fmt.Sprintf("%d", len(members))
@@ -65,6 +90,7 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler){
 
 type handler struct{
 	joins chan map[string]string
+	updates chan map[string]string
 	leaves chan string
 }
 
@@ -76,6 +102,16 @@ func (h *handler) Join(id, addr string) error {
 	return nil
 }
 
+func (h *handler) Update(id string, tags map[string]string) error {
+	if h.updates != nil {
+		h.updates <- map[string]string{
+			"id": id,
+			"addr": tags["rpc_addr"],
+		}
+	}
+	return nil
+}
+
 func (h *handler) Leave(id string) error {
 	h.leaves <- id
 	return nil
@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type DNSConfig struct {
+	// Name is the SRV record listing the cluster, such as
+	// _dlog._tcp.example.com.
+	Name string
+	// Server is the address of the DNS server to ask, the system's
+	// resolver is used when empty.
+	Server string
+	// Interval is how often the record is looked up again, 30 seconds by
+	// default.
+	Interval time.Duration
+	// Tags, when set, asks a member found at addr for its tags on every
+	// lookup, as ClusterTags does. Members carry no tags without it, so
+	// nothing that relies on them, such as following the leader, works.
+	Tags func(addr string) (map[string]string, error)
+}
+
+// ClusterTags returns a DNSConfig.Tags asking members over the GetTags
+// RPC, dialing them with opts.
+func ClusterTags(opts ...grpc.DialOption) func(addr string) (map[string]string, error) {
+	return func(addr string) (map[string]string, error) {
+		cc, err := grpc.Dial(addr, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer cc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		res, err := api.NewClusterClient(cc).GetTags(ctx, &api.GetTagsRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return res.Tags, nil
+	}
+}
+
+// DNS is a Discoverer polling an SRV record. Every target of the record
+// is a member named and reached by its host:port, so the local member
+// should use that same address as its RPCAddr to be told apart. Members
+// get their tags through DNSConfig.Tags.
+type DNS struct {
+	*tracker
+	DNSConfig
+
+	resolver *net.Resolver
+	close    chan struct{}
+	done     chan struct{}
+}
+
+func NewDNS(local Member, c DNSConfig, h Handler) (*DNS, error) {
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	d := &DNS{
+		tracker:   newTracker(local, h, "dns"),
+		DNSConfig: c,
+		resolver:  net.DefaultResolver,
+		close:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if c.Server != "" {
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, c.Server)
+			},
+		}
+	}
+	if err := d.refresh(); err != nil {
+		return nil, err
+	}
+	go d.poll()
+	return d, nil
+}
+
+func (d *DNS) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Interval)
+	defer cancel()
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return err
+	}
+	members := make([]Member, 0, len(records))
+	for _, r := range records {
+		addr := net.JoinHostPort(
+			strings.TrimSuffix(r.Target, "."),
+			strconv.Itoa(int(r.Port)),
+		)
+		members = append(members, Member{Name: addr, RPCAddr: addr, Tags: d.tags(addr)})
+	}
+	d.set(members)
+	return nil
+}
+
+// tags asks the member at addr for its tags, keeping the ones it had
+// when it can't be asked.
+func (d *DNS) tags(addr string) map[string]string {
+	if d.Tags == nil {
+		return nil
+	}
+	tags, err := d.Tags(addr)
+	if err == nil {
+		return tags
+	}
+	d.logger.Warn("failed to get tags", zap.Error(err), zap.String("addr", addr))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.members[addr].Tags
+}
+
+func (d *DNS) poll() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.close:
+			return
+		case <-ticker.C:
+			if err := d.refresh(); err != nil {
+				// a failed lookup isn't the members leaving, keep them
+				d.logger.Error("failed to look up peers", zap.Error(err), zap.String("name", d.Name))
+			}
+		}
+	}
+}
+
+func (d *DNS) Alive() []Member {
+	return d.alive()
+}
+
+func (d *DNS) Leave() error {
+	select {
+	case <-d.close:
+	default:
+		close(d.close)
+	}
+	<-d.done
+	return nil
+}
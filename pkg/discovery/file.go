@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"go.uber.org/zap"
+)
+
+// File is a Discoverer reading the peers from a JSON or YAML file and
+// following changes to it. The file holds a list of members:
+//
+//	[{"name": "node-1", "rpc_addr": "10.0.0.1:8400", "tags": {"role": "leader"}}]
+//
+// Files ending in .yaml or .yml are read as YAML, others as JSON.
+type File struct {
+	*tracker
+	Path string
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func NewFile(local Member, path string, h Handler) (*File, error) {
+	f := &File{
+		tracker: newTracker(local, h, "file"),
+		Path:    path,
+		done:    make(chan struct{}),
+	}
+	members, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	f.set(members)
+
+	// watch the directory, editors and config management replace the
+	// file rather than write to it
+	if f.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	if err = f.watcher.Add(filepath.Dir(path)); err != nil {
+		f.watcher.Close()
+		return nil, err
+	}
+	go f.watch()
+	return f, nil
+}
+
+func (f *File) read() ([]Member, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		// caught between truncating and writing, an empty cluster is
+		// written as an empty list
+		return nil, errors.New("peers file is empty")
+	}
+	var members []Member
+	err = config.Unmarshal(f.Path, b, &members)
+	return members, err
+}
+
+func (f *File) watch() {
+	defer close(f.done)
+	name := filepath.Clean(f.Path)
+	for {
+		select {
+		case e, OK := <-f.watcher.Events:
+			if !OK {
+				return
+			}
+			if filepath.Clean(e.Name) != name || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			members, err := f.read()
+			if err != nil {
+				// keep the members we know of until the file is fixed
+				f.logger.Error("failed to read peers", zap.Error(err), zap.String("path", f.Path))
+				continue
+			}
+			f.set(members)
+		case err, OK := <-f.watcher.Errors:
+			if !OK {
+				return
+			}
+			f.logger.Error("failed to watch peers", zap.Error(err), zap.String("path", f.Path))
+		}
+	}
+}
+
+func (f *File) Alive() []Member {
+	return f.alive()
+}
+
+func (f *File) Leave() error {
+	err := f.watcher.Close()
+	<-f.done
+	return err
+}
@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"fmt"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestJoinFailure(t *testing.T) {
+	var failures int32
+	m, err := NewMembership(Config{
+		NodeName:       "0",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		StartJoinAddrs: []string{fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])},
+		JoinFailed: func(err error) {
+			atomic.AddInt32(&failures, 1)
+		},
+	}, &handler{})
+	// the member starts alone, told about the failure but not retrying
+	require.NoError(t, err)
+	defer m.Leave()
+	require.Equal(t, int32(1), atomic.LoadInt32(&failures))
+	require.Never(t, func() bool {
+		return atomic.LoadInt32(&failures) > 1
+	}, 300*time.Millisecond, 50*time.Millisecond)
+	require.Len(t, m.Alive(), 1)
+}
+
+func TestRetryJoin(t *testing.T) {
+	seed := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	var failures int32
+	m1 := setupMemberWith(t, "1", Config{
+		StartJoinAddrs: []string{seed},
+		RetryJoin:      true,
+		RetryInterval:  50 * time.Millisecond,
+		JoinFailed: func(err error) {
+			atomic.AddInt32(&failures, 1)
+		},
+	})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&failures) >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the seed comes up late
+	c := Config{NodeName: "0", BindAddr: seed}
+	m0, err := NewMembership(c, &handler{
+		joins:   make(chan map[string]string, 10),
+		updates: make(chan map[string]string, 10),
+		leaves:  make(chan string, 10),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { m0.Leave() })
+	require.Eventually(t, func() bool {
+		return len(m1.Members()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestSnapshotRejoin(t *testing.T) {
+	m0 := setupMemberWith(t, "0", Config{})
+	snapshot := path.Join(t.TempDir(), "serf.snapshot")
+	c := Config{
+		NodeName:       "1",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		StartJoinAddrs: []string{m0.BindAddr},
+		SnapshotPath:   snapshot,
+	}
+	h := &handler{
+		joins:   make(chan map[string]string, 10),
+		updates: make(chan map[string]string, 10),
+		leaves:  make(chan string, 10),
+	}
+	m1, err := NewMembership(c, h)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(m0.Alive()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, m1.Leave())
+	require.Eventually(t, func() bool {
+		return len(m0.Alive()) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// restarted without any seed, it finds its way back from the snapshot
+	c.StartJoinAddrs = nil
+	m1, err = NewMembership(c, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { m1.Leave() })
+	require.Eventually(t, func() bool {
+		for _, member := range m0.Members() {
+			if member.Name == "1" && member.Status == serf.StatusAlive {
+				return len(m1.Alive()) == 2
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// keyring builds the gossip keyring from the keyring file, or from the
+// configured keys when there is no file yet. It returns nil when gossip
+// isn't encrypted.
+func (m *Membership) keyring() (*memberlist.Keyring, error) {
+	primary, keys := m.EncryptKey, m.Keyring
+	if m.KeyringFile != "" {
+		b, err := os.ReadFile(m.KeyringFile)
+		if err == nil {
+			if keys, err = decodeKeys(b); err != nil {
+				return nil, fmt.Errorf("keyring file %s: %w", m.KeyringFile, err)
+			}
+			// serf writes the primary key first
+			primary = nil
+			if len(keys) > 0 {
+				primary = keys[0]
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if primary == nil {
+		if len(keys) > 0 {
+			return nil, errors.New("keyring has no primary key")
+		}
+		return nil, nil
+	}
+	for _, k := range append([][]byte{primary}, keys...) {
+		if err := memberlist.ValidateKey(k); err != nil {
+			return nil, err
+		}
+	}
+	return memberlist.NewKeyring(keys, primary)
+}
+
+func decodeKeys(b []byte) ([][]byte, error) {
+	var encoded []string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		k, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// InstallKey, UseKey, RemoveKey and ListKeys change and inspect the
+// gossip keyring of every member of the cluster. Keys are base64
+// encoded. A key is rotated by installing the new key, using it as the
+// primary key once every member has it and then removing the old one.
+func (m *Membership) InstallKey(key string) (*serf.KeyResponse, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().InstallKey(key)
+}
+
+func (m *Membership) UseKey(key string) (*serf.KeyResponse, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().UseKey(key)
+}
+
+func (m *Membership) RemoveKey(key string) (*serf.KeyResponse, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().RemoveKey(key)
+}
+
+func (m *Membership) ListKeys() (*serf.KeyResponse, error) {
+	return m.serf.KeyManager().ListKeys()
+}
+
+// ErrInvalidKey is returned for keys that aren't valid base64 encoded
+// gossip keys.
+var ErrInvalidKey = errors.New("invalid gossip key")
+
+func validateKey(key string) error {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if err = memberlist.ValidateKey(k); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return nil
+}
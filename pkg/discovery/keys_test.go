@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestEncryptedGossip(t *testing.T) {
+	oldKey, newKey := newKey(t), newKey(t)
+	dir := t.TempDir()
+	keyringFile := path.Join(dir, "keyring")
+
+	m0 := setupMemberWith(t, "0", Config{
+		EncryptKey:  oldKey,
+		KeyringFile: keyringFile,
+	})
+	setupMemberWith(t, "1", Config{
+		EncryptKey:     oldKey,
+		StartJoinAddrs: []string{m0.BindAddr},
+	})
+	require.Eventually(t, func() bool {
+		return len(m0.Members()) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// members without the key can't join or listen in
+	for name, key := range map[string][]byte{"outsider": nil, "wrong": newKey} {
+		var joinErr error
+		m, err := NewMembership(Config{
+			NodeName:       name,
+			BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+			EncryptKey:     key,
+			StartJoinAddrs: []string{m0.BindAddr},
+			JoinFailed: func(err error) {
+				joinErr = err
+			},
+		}, &handler{})
+		require.NoError(t, err)
+		require.Error(t, joinErr)
+		require.NoError(t, m.Leave())
+	}
+	require.Len(t, m0.Members(), 2)
+
+	// rotate to the new key without taking anyone down
+	encOld := base64.StdEncoding.EncodeToString(oldKey)
+	encNew := base64.StdEncoding.EncodeToString(newKey)
+	res, err := m0.InstallKey(encNew)
+	require.NoError(t, err)
+	require.Equal(t, 0, res.NumErr)
+	_, err = m0.UseKey(encNew)
+	require.NoError(t, err)
+	_, err = m0.RemoveKey(encOld)
+	require.NoError(t, err)
+
+	res, err = m0.ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{encNew: 2}, res.Keys)
+	require.Equal(t, map[string]int{encNew: 2}, res.PrimaryKeys)
+
+	setupMemberWith(t, "3", Config{
+		EncryptKey:     newKey,
+		StartJoinAddrs: []string{m0.BindAddr},
+	})
+	require.Eventually(t, func() bool {
+		return len(m0.Members()) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// the rotation outlives restarts through the keyring file
+	b, err := os.ReadFile(keyringFile)
+	require.NoError(t, err)
+	keys, err := decodeKeys(b)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{newKey}, keys)
+	m := &Membership{Config: Config{EncryptKey: oldKey, KeyringFile: keyringFile}}
+	keyring, err := m.keyring()
+	require.NoError(t, err)
+	require.Equal(t, newKey, keyring.GetPrimaryKey())
+
+	_, err = m0.InstallKey("not a key")
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = m0.InstallKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	k := make([]byte, 32)
+	_, err := rand.Read(k)
+	require.NoError(t, err)
+	return k
+}
+
+func setupMemberWith(t *testing.T, name string, c Config) *Membership {
+	t.Helper()
+	c.NodeName = name
+	c.BindAddr = fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	c.Tags = map[string]string{"rpc_addr": c.BindAddr}
+	h := &handler{
+		joins:   make(chan map[string]string, 10),
+		updates: make(chan map[string]string, 10),
+		leaves:  make(chan string, 10),
+	}
+	m, err := NewMembership(c, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Leave() })
+	return m
+}
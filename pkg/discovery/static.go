@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"maps"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// tracker turns successive listings of the cluster into join and leave
+// events for the backends that list members instead of being told
+// about them.
+type tracker struct {
+	local   Member
+	handler Handler
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	members map[string]Member
+}
+
+func newTracker(local Member, h Handler, name string) *tracker {
+	return &tracker{
+		local:   local,
+		handler: h,
+		logger:  zap.L().Named(name),
+		members: make(map[string]Member),
+	}
+}
+
+// set replaces the known members with members. Members that are gone
+// leave, new ones join and those whose address or tags changed are
+// updated.
+func (t *tracker) set(members []Member) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := make(map[string]Member, len(members))
+	for _, m := range members {
+		if m.Name == t.local.Name || m.RPCAddr == t.local.RPCAddr {
+			continue
+		}
+		next[m.Name] = m
+	}
+	for name, m := range t.members {
+		if _, OK := next[name]; !OK {
+			if err := t.handler.Leave(name); err != nil {
+				t.errLog(err, "error in leave cluster", m)
+			}
+		}
+	}
+	for name, m := range next {
+		old, OK := t.members[name]
+		switch {
+		case !OK:
+			if err := t.handler.Join(name, m.RPCAddr); err != nil {
+				t.errLog(err, "error in join", m)
+			}
+			fallthrough
+		case old.RPCAddr != m.RPCAddr || !maps.Equal(old.Tags, m.Tags):
+			if err := t.handler.Update(name, m.tags()); err != nil {
+				t.errLog(err, "error in update", m)
+			}
+		}
+	}
+	t.members = next
+}
+
+func (t *tracker) alive() []Member {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	members := []Member{t.local}
+	for _, m := range t.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+func (t *tracker) errLog(err error, msg string, m Member) {
+	t.logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", m.Name),
+		zap.String("rpc_addr", m.RPCAddr),
+	)
+}
+
+// tags returns the member's tags along with its rpc_addr, the way serf
+// members carry it.
+func (m Member) tags() map[string]string {
+	tags := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags["rpc_addr"] = m.RPCAddr
+	return tags
+}
+
+// Static is a Discoverer over a fixed list of peers, for clusters whose
+// members are known up front.
+type Static struct {
+	*tracker
+}
+
+// NewStatic joins every peer but local. Peers listing local are fine,
+// so every node can share the same list.
+func NewStatic(local Member, peers []Member, h Handler) (*Static, error) {
+	s := &Static{tracker: newTracker(local, h, "static")}
+	s.set(peers)
+	return s, nil
+}
+
+func (s *Static) Alive() []Member {
+	return s.alive()
+}
+
+func (s *Static) Leave() error {
+	return nil
+}
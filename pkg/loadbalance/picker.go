@@ -0,0 +1,143 @@
+package loadbalance
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	)
+}
+
+type preferZoneKey struct{}
+
+// PreferZone makes the consume calls made with ctx go to a server in
+// zone, when there is one, so reads stay within the client's zone.
+func PreferZone(ctx context.Context, zone string) context.Context {
+	return context.WithValue(ctx, preferZoneKey{}, zone)
+}
+
+type fromLeaderKey struct{}
+
+// FromLeader makes the consume calls made with ctx go to the leader, for
+// leader-only and linearizable consumes.
+func FromLeader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fromLeaderKey{}, true)
+}
+
+// Picker sends produce calls to the leader and spreads consume calls
+// across the followers. It is rebuilt by the balancer every time the
+// resolver reports servers joining or leaving.
+type Picker struct {
+	mu        sync.RWMutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	zones     map[balancer.SubConn]string
+	current   uint64
+}
+
+var _ base.PickerBuilder = (*Picker)(nil)
+
+func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var followers []balancer.SubConn
+	var leader balancer.SubConn
+	zones := make(map[balancer.SubConn]string)
+	for sc, scInfo := range buildInfo.ReadySCs {
+		if zone, _ := scInfo.Address.Attributes.Value(zoneKey{}).(string); zone != "" {
+			zones[sc] = zone
+		}
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderKey{}).(bool)
+		if isLeader {
+			leader = sc
+			continue
+		}
+		followers = append(followers, sc)
+	}
+	return &Picker{
+		leader:    leader,
+		followers: followers,
+		zones:     zones,
+	}
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+// consumes are the methods followers can serve, produces the ones only
+// the leader can.
+var (
+	consumes = map[string]bool{
+		api.Log_Consume_FullMethodName:       true,
+		api.Log_ConsumeStream_FullMethodName: true,
+	}
+	produces = map[string]bool{
+		api.Log_Produce_FullMethodName:       true,
+		api.Log_ProduceStream_FullMethodName: true,
+	}
+)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result balancer.PickResult
+	consume := consumes[info.FullMethodName]
+	if consume && info.Ctx != nil && info.Ctx.Value(fromLeaderKey{}) != nil {
+		consume = false
+	}
+	if consume {
+		result.SubConn = p.inZone(info.Ctx)
+	}
+	switch {
+	case result.SubConn != nil:
+		// a server in the client's zone
+	case consume && len(p.followers) > 0:
+		result.SubConn = p.nextFollower()
+	case p.leader != nil:
+		result.SubConn = p.leader
+	case !produces[info.FullMethodName] && len(p.followers) > 0:
+		result.SubConn = p.nextFollower()
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+// inZone picks a follower in the zone preferred by ctx, or the leader
+// when it is the only server there.
+func (p *Picker) inZone(ctx context.Context) balancer.SubConn {
+	if ctx == nil {
+		return nil
+	}
+	zone, _ := ctx.Value(preferZoneKey{}).(string)
+	if zone == "" {
+		return nil
+	}
+	var local []balancer.SubConn
+	for _, sc := range p.followers {
+		if p.zones[sc] == zone {
+			local = append(local, sc)
+		}
+	}
+	if len(local) > 0 {
+		cur := atomic.AddUint64(&p.current, uint64(1))
+		return local[cur%uint64(len(local))]
+	}
+	if p.leader != nil && p.zones[p.leader] == zone {
+		return p.leader
+	}
+	return nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	return p.followers[cur%uint64(len(p.followers))]
+}
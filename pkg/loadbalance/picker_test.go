@@ -0,0 +1,149 @@
+package loadbalance
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPicker()
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceStream",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPickerMatchesExactMethods(t *testing.T) {
+	picker, subConns := setupPicker()
+	// methods merely named like consumes go to the leader
+	for _, method := range []string{
+		"/log.v1.Admin/ConsumeOffsets",
+		"/log.v1.Log/ConsumeStreamV2",
+	} {
+		gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPicker()
+	for _, method := range []string{
+		"/log.v1.Log/Consume",
+		"/log.v1.Log/ConsumeStream",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		seen := map[balancer.SubConn]int{}
+		for i := 0; i < 4; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.NotEqual(t, subConns[0], gotPick.SubConn)
+			seen[gotPick.SubConn]++
+		}
+		require.Equal(t, 2, seen[subConns[1]])
+		require.Equal(t, 2, seen[subConns[2]])
+	}
+}
+
+func TestPickerConsumesInZone(t *testing.T) {
+	picker, subConns := setupPicker()
+	consume := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+
+	// follower 2 is the only follower in zone b
+	consume.Ctx = PreferZone(context.Background(), "b")
+	for i := 0; i < 4; i++ {
+		gotPick, err := picker.Pick(consume)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], gotPick.SubConn)
+	}
+
+	// only the leader is in zone a
+	consume.Ctx = PreferZone(context.Background(), "a")
+	gotPick, err := picker.Pick(consume)
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+
+	// nobody is in zone c, spread across the followers as usual
+	consume.Ctx = PreferZone(context.Background(), "c")
+	gotPick, err = picker.Pick(consume)
+	require.NoError(t, err)
+	require.NotEqual(t, subConns[0], gotPick.SubConn)
+
+	// produces ignore the zone
+	produce := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Produce",
+		Ctx:            PreferZone(context.Background(), "b"),
+	}
+	gotPick, err = picker.Pick(produce)
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+}
+
+func TestPickerConsumesFromLeader(t *testing.T) {
+	picker, subConns := setupPicker()
+	consume := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+		Ctx:            FromLeader(PreferZone(context.Background(), "b")),
+	}
+	for i := 0; i < 4; i++ {
+		gotPick, err := picker.Pick(consume)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func setupPicker() (*Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderKey{}, i == 0).
+				WithValue(zoneKey{}, []string{"a", "", "b"}[i]),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo).(*Picker)
+	return picker, subConns
+}
+
+type subConn struct {
+	balancer.SubConn
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
@@ -0,0 +1,151 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the scheme of the targets handled by the resolver and the name
+// of the balancer it selects, e.g. dlog:///127.0.0.1:8400.
+const Name = "dlog"
+
+// DefaultRefreshInterval is how often the resolver asks the cluster for
+// its servers when no interval is given.
+const DefaultRefreshInterval = 10 * time.Second
+
+type isLeaderKey struct{}
+
+type zoneKey struct{}
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+// WithResolver returns a dial option that resolves dlog targets and
+// refreshes the server list every interval.
+func WithResolver(interval time.Duration) grpc.DialOption {
+	return grpc.WithResolvers(&Builder{RefreshInterval: interval})
+}
+
+// Builder builds resolvers that discover the cluster's servers through
+// the Cluster.GetServers RPC of the target address.
+type Builder struct {
+	RefreshInterval time.Duration
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		interval:   b.RefreshInterval,
+		close:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if r.interval == 0 {
+		r.interval = DefaultRefreshInterval
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if opts.DialCreds != nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(opts.DialCreds)}
+	}
+	r.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.Dial(target.Endpoint(), dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+// Resolver keeps the ClientConn's addresses in sync with the cluster by
+// polling the servers it knows about.
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+	interval      time.Duration
+	close         chan struct{}
+	done          chan struct{}
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+func (r *Resolver) refresh() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := api.NewClusterClient(r.resolverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		attrs := attributes.New(isLeaderKey{}, server.IsLeader)
+		if server.Zone != "" {
+			attrs = attrs.WithValue(zoneKey{}, server.Zone)
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attrs,
+		})
+	}
+	err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+	if err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+	}
+}
+
+func (r *Resolver) Close() {
+	close(r.close)
+	<-r.done
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
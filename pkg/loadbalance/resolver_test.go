@@ -0,0 +1,103 @@
+package loadbalance
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	getter := &getServers{servers: []*api.Server{
+		{Id: "leader", RpcAddr: "localhost:9001", IsLeader: true},
+		{Id: "follower", RpcAddr: "localhost:9002"},
+	}}
+	srv := grpc.NewServer()
+	server.RegisterClusterServer(srv, getter)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	b := &Builder{RefreshInterval: 100 * time.Millisecond}
+	r, err := b.Build(
+		resolver.Target{URL: url.URL{Path: l.Addr().String()}},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	want := resolver.State{
+		Addresses: []resolver.Address{
+			{Addr: "localhost:9001", Attributes: attributes.New(isLeaderKey{}, true)},
+			{Addr: "localhost:9002", Attributes: attributes.New(isLeaderKey{}, false)},
+		},
+	}
+	require.Equal(t, want.Addresses, conn.state().Addresses)
+
+	// a node joining shows up on the next refresh
+	getter.set(append(getter.get(), &api.Server{Id: "new", RpcAddr: "localhost:9003"}))
+	require.Eventually(t, func() bool {
+		return len(conn.state().Addresses) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+type getServers struct {
+	mu      sync.Mutex
+	servers []*api.Server
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return s.get(), nil
+}
+
+func (s *getServers) get() []*api.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers
+}
+
+func (s *getServers) set(servers []*api.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+type clientConn struct {
+	resolver.ClientConn
+	mu sync.Mutex
+	s  resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s = state
+	return nil
+}
+
+func (c *clientConn) state() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.s
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
@@ -0,0 +1,251 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RepairReport sums up what anti-entropy found and fixed.
+type RepairReport struct {
+	// Partitions is how many partitions were compared.
+	Partitions int
+	// Diverged is how many of them disagreed with their authority.
+	Diverged int
+	// Removed is how many local records were dropped.
+	Removed uint64
+	// Fetched is how many records were copied back from the authority.
+	Fetched uint64
+}
+
+func (r *RepairReport) add(o RepairReport) {
+	r.Partitions += o.Partitions
+	r.Diverged += o.Diverged
+	r.Removed += o.Removed
+	r.Fetched += o.Fetched
+}
+
+// AntiEntropy periodically compares the partitions of this node with
+// their authoritative replicas and repairs the ranges that diverged.
+type AntiEntropy struct {
+	Log         *Manager
+	DialOptions []grpc.DialOption
+	// Authority returns the RPC address of the replica a partition is
+	// repaired from, or "" when the local copy is authoritative.
+	Authority func(topic string, partition uint32) string
+	Interval  time.Duration
+
+	mu     sync.Mutex
+	logger *zap.Logger
+	total  RepairReport
+	close  chan struct{}
+	closed bool
+}
+
+func (ae *AntiEntropy) init() {
+	if ae.logger == nil {
+		ae.logger = zap.L().Named("anti-entropy")
+	}
+	if ae.close == nil {
+		ae.close = make(chan struct{})
+	}
+	if ae.Interval == 0 {
+		ae.Interval = time.Minute
+	}
+}
+
+// Start runs a pass every Interval until the process is closed.
+func (ae *AntiEntropy) Start() {
+	ae.mu.Lock()
+	ae.init()
+	ae.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(ae.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ae.close:
+				return
+			case <-ticker.C:
+				ae.Run()
+			}
+		}
+	}()
+}
+
+// Run compares every local partition with its authority once.
+func (ae *AntiEntropy) Run() RepairReport {
+	ae.mu.Lock()
+	ae.init()
+	ae.mu.Unlock()
+	var report RepairReport
+	for _, t := range ae.Log.Topics() {
+		for i := uint32(0); i < t.Config.Partitions; i++ {
+			addr := ae.Authority(t.Name, i)
+			if addr == "" {
+				continue
+			}
+			r, err := ae.Repair(t.Name, i, addr)
+			report.add(r)
+			if err != nil {
+				ae.logger.Error(
+					"failed to repair partition",
+					zap.Error(err),
+					zap.String("topic", t.Name),
+					zap.Uint32("partition", i),
+					zap.String("authority", addr),
+				)
+			}
+		}
+	}
+	if report.Diverged > 0 {
+		ae.logger.Warn(
+			"repaired diverged partitions",
+			zap.Int("partitions", report.Partitions),
+			zap.Int("diverged", report.Diverged),
+			zap.Uint64("removed", report.Removed),
+			zap.Uint64("fetched", report.Fetched),
+		)
+	}
+	ae.mu.Lock()
+	ae.total.add(report)
+	ae.mu.Unlock()
+	return report
+}
+
+// Total returns what every pass so far has repaired.
+func (ae *AntiEntropy) Total() RepairReport {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	return ae.total
+}
+
+// Repair compares a partition with the replica at addr, narrowing a
+// disagreeing range down to the first differing record, and replaces
+// everything from that record on with the replica's records.
+func (ae *AntiEntropy) Repair(topic string, partition uint32, addr string) (RepairReport, error) {
+	report := RepairReport{Partitions: 1}
+	l, err := ae.Log.Partition(topic, partition)
+	if err != nil {
+		return report, err
+	}
+	// replication waits, it picks up from wherever the repair leaves
+	// the log
+	l.LockWriters()
+	defer l.UnlockWriters()
+	cc, err := grpc.Dial(addr, ae.DialOptions...)
+	if err != nil {
+		return report, err
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := api.NewPeerClient(cc)
+
+	res, err := peer.GetDigests(ctx, &api.GetDigestsRequest{
+		Topic:     topic,
+		Partition: partition,
+		Ranges:    l.Ranges(),
+	})
+	if err != nil {
+		return report, err
+	}
+	var bad *api.OffsetRange
+	for _, d := range res.Digests {
+		equal, err := ae.matches(l, d)
+		if err != nil {
+			return report, err
+		}
+		if !equal {
+			bad = d.Range
+			break
+		}
+	}
+
+	diverged := l.NextOffset()
+	if bad != nil {
+		for bad.To-bad.From > 1 {
+			half := &api.OffsetRange{From: bad.From, To: bad.From + (bad.To-bad.From)/2}
+			res, err := peer.GetDigests(ctx, &api.GetDigestsRequest{
+				Topic:     topic,
+				Partition: partition,
+				Ranges:    []*api.OffsetRange{half},
+			})
+			if err != nil {
+				return report, err
+			}
+			equal := false
+			if len(res.Digests) == 1 {
+				if equal, err = ae.matches(l, res.Digests[0]); err != nil {
+					return report, err
+				}
+			}
+			if equal {
+				bad.From = half.To
+			} else {
+				bad.To = half.To
+			}
+		}
+		diverged = bad.From
+	} else if diverged > res.NextOffset {
+		// we hold records the authority never had
+		diverged = res.NextOffset
+	}
+	if diverged == l.NextOffset() {
+		return report, nil
+	}
+
+	report.Diverged = 1
+	report.Removed = l.NextOffset() - diverged
+	if err = l.RemoveFrom(diverged); err != nil {
+		return report, err
+	}
+	stream, err := api.NewLogClient(cc).ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    diverged,
+	})
+	if err != nil {
+		return report, err
+	}
+	for {
+		rec, err := stream.Recv()
+		if err != nil {
+			if status.Code(err) == codes.OutOfRange {
+				return report, nil
+			}
+			return report, err
+		}
+		if _, err = l.Append(rec.Record); err != nil {
+			return report, err
+		}
+		report.Fetched++
+	}
+}
+
+func (ae *AntiEntropy) matches(l *Log, d *api.RangeDigest) (bool, error) {
+	local, err := l.Digest(d.Range.From, d.Range.To)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(local, d.Checksum), nil
+}
+
+func (ae *AntiEntropy) Close() error {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	ae.init()
+	if ae.closed {
+		return nil
+	}
+	ae.closed = true
+	close(ae.close)
+	return nil
+}
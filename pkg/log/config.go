@@ -1,11 +1,21 @@
 package log
 
+import "time"
+
 type SegmentConfig struct {
 	MaxStoreBytes uint64
 	MaxIndexBytes uint64
 	InitialOffset uint64
 }
 
+// RetentionConfig bounds how much of a log is kept around. Zero values
+// keep everything.
+type RetentionConfig struct {
+	MaxBytes uint64
+	MaxAge time.Duration
+}
+
 type Config struct {
 	Segment SegmentConfig
-}
\ No newline at end of file
+	Retention RetentionConfig
+}
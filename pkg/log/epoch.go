@@ -0,0 +1,77 @@
+package log
+
+import (
+	"context"
+	"sort"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+)
+
+// LastEpoch returns the epoch of the last record, 0 when the log is
+// empty.
+func (l *Log) LastEpoch() (uint64, error) {
+	next := l.NextOffset()
+	if next == l.LowestOffset() {
+		return 0, nil
+	}
+	r, err := l.Read(next - 1)
+	if err != nil {
+		return 0, err
+	}
+	return r.Epoch, nil
+}
+
+// EpochEnd returns the offset of the first record from an epoch later
+// than epoch, or the next offset when there is none. Epochs only grow
+// along a log, so it binary searches the records.
+func (l *Log) EpochEnd(epoch uint64) (uint64, error) {
+	lowest, next := l.LowestOffset(), l.NextOffset()
+	var err error
+	i := sort.Search(int(next-lowest), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var r *api.Record
+		if r, err = l.Read(lowest + uint64(i)); err != nil {
+			return true
+		}
+		return r.Epoch > epoch
+	})
+	if err != nil {
+		return 0, err
+	}
+	return lowest + uint64(i), nil
+}
+
+// TruncateDiverged drops the records of l the leader behind client does
+// not have. The leader tells where the epoch of the last local record
+// ended on its side, and everything after that was written by a leader
+// that was since replaced. It returns how many records were dropped.
+func TruncateDiverged(ctx context.Context, client api.PeerClient, l *Log, topic string, partition uint32) (uint64, error) {
+	var removed uint64
+	for {
+		next := l.NextOffset()
+		if next == l.LowestOffset() {
+			return removed, nil
+		}
+		epoch, err := l.LastEpoch()
+		if err != nil {
+			return removed, err
+		}
+		res, err := client.GetEpochEnd(ctx, &api.GetEpochEndRequest{
+			Topic:     topic,
+			Partition: partition,
+			Epoch:     epoch,
+		})
+		if err != nil {
+			return removed, err
+		}
+		if res.EndOffset >= next {
+			return removed, nil
+		}
+		if err = l.RemoveFrom(res.EndOffset); err != nil {
+			return removed, err
+		}
+		removed += next - l.NextOffset()
+	}
+}
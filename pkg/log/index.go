@@ -52,6 +52,11 @@ func (ind *index) Close() error {
 		return err
 	}
 
+	// drop the preallocated tail so the size is right when reopened
+	if err = ind.file.Truncate(int64(ind.size)); err != nil {
+		return err
+	}
+
 	return ind.file.Close()
 }
 
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,18 +12,35 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/larkiee/distributed_logger/api/v1"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	ErrOffsetOutOfRange = errors.New("out of range")
+	ErrClosed           = errors.New("log is closed")
 )
 
 type Log struct {
 	mu sync.RWMutex
+	// closed logs fail appends, so writers holding on to a log that was
+	// closed or replaced don't write into files nobody reads.
+	closed bool
+	// writers serializes the processes copying records in from other
+	// nodes, so a repair never interleaves with replication.
+	writers sync.Mutex
 
 	Dir string
 	Config Config
 
 	segments []*segment
 	activeSegment *segment
+	// metrics are recorded with attrs, the topic and partition of the log
+	// when a Manager opened it.
+	metrics *metrics
+	attrs metric.MeasurementOption
 }
 
 
@@ -28,6 +48,8 @@ func NewLog(dir string, c Config) (*Log, error) {
 	l := &Log{
 		Dir: dir,
 		Config: c,
+		metrics: globalMetrics,
+		attrs: metric.WithAttributes(),
 	}
 
 	if c.Segment.MaxIndexBytes == 0 {
@@ -41,9 +63,8 @@ func NewLog(dir string, c Config) (*Log, error) {
 	return l, l.setup()
 }
 
+// newSegment must be called with l.mu held or before the log is shared.
 func (l *Log) newSegment(bOff uint64) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
 	ns, err := newSegment(l.Dir, bOff, l.Config)
 	if err != nil {
 		return err
@@ -88,23 +109,40 @@ func (l *Log) setup() error {
 		}
 	}
 
+	if l.activeSegment.IsMaxed() {
+		return l.newSegment(l.activeSegment.nextOffset)
+	}
+
 	return nil
 }
 
 func (l *Log) Append(r *api.Record) (uint64, error) {
+	start := time.Now()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	size := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(r)
 	if err != nil {
 		return 0, err
 	}
+	ctx := context.Background()
+	l.metrics.recordsWritten.Add(ctx, 1, l.attrs)
+	l.metrics.bytesWritten.Add(ctx, int64(l.activeSegment.store.size-size), l.attrs)
 	if l.activeSegment.IsMaxed() {
+		l.metrics.segmentRolls.Add(ctx, 1, l.attrs)
 		err = l.newSegment(off + 1)
 	}
+	l.metrics.appendDuration.Record(ctx, since(start), l.attrs)
 	return off, err
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	defer func(start time.Time) {
+		l.metrics.readDuration.Record(context.Background(), since(start), l.attrs)
+	}(time.Now())
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	var s *segment
@@ -114,14 +152,25 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		}
 	}
 	if s == nil || off >= s.nextOffset {
-		return nil, fmt.Errorf("offset %d out of range", off)
+		return nil, fmt.Errorf("offset %d %w", off, ErrOffsetOutOfRange)
 	}
 	return s.Read(off)
 }
 
+// LockWriters holds off the other processes copying records into the
+// log, replication, repairs and partition moves, until UnlockWriters.
+func (l *Log) LockWriters() {
+	l.writers.Lock()
+}
+
+func (l *Log) UnlockWriters() {
+	l.writers.Unlock()
+}
+
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.closed = true
 	var err error
 	for _, seg := range l.segments {
 		if err = seg.Close(); err != nil {
@@ -139,11 +188,19 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
+// Reset throws the records away, leaving the log empty and open again.
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
+	l.closed = false
 	return l.setup()
 }
 
@@ -153,6 +210,13 @@ func (l *Log) LowestOffset() uint64 {
 	return l.segments[0].baseOffset
 }
 
+// NextOffset is the offset the next appended record gets.
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
 func (l *Log) HighestOffset() uint64 {
 	return l.activeSegment.nextOffset - 1
 }
@@ -178,6 +242,125 @@ func (l *Log) Truncate(off uint64) error {
 	return nil
 }
 
+// RemoveFrom drops every record at or after off, so the log can be
+// refilled from a replica that disagrees with it.
+func (l *Log) RemoveFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var segments []*segment
+	for _, seg := range l.segments {
+		switch {
+		case seg.baseOffset >= off && len(segments) > 0:
+			if err := seg.Remove(); err != nil {
+				return err
+			}
+		case seg.baseOffset > off:
+			// nothing is left, start over from off in an empty segment
+			if err := seg.Remove(); err != nil {
+				return err
+			}
+			ns, err := newSegment(l.Dir, off, l.Config)
+			if err != nil {
+				return err
+			}
+			segments = append(segments, ns)
+		case seg.baseOffset == off:
+			// keep the first segment around, emptied, so offsets go on
+			// from off
+			if err := seg.truncate(off); err != nil && err != io.EOF {
+				return err
+			}
+			segments = append(segments, seg)
+		case off < seg.nextOffset:
+			if err := seg.truncate(off); err != nil {
+				return err
+			}
+			segments = append(segments, seg)
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	if l.activeSegment.IsMaxed() {
+		return l.newSegment(l.activeSegment.nextOffset)
+	}
+	return nil
+}
+
+// Digest hashes the records in [from, to) as they are stored, so two
+// replicas holding the same records get the same digest.
+func (l *Log) Digest(from, to uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	h := sha256.New()
+	for _, seg := range l.segments {
+		for off := max(from, seg.baseOffset); off < min(to, seg.nextOffset); off++ {
+			b, err := seg.readRaw(off)
+			if err != nil {
+				return nil, err
+			}
+			h.Write(b)
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// Ranges returns the offsets held by each non empty segment.
+func (l *Log) Ranges() []*api.OffsetRange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var ranges []*api.OffsetRange
+	for _, seg := range l.segments {
+		if seg.nextOffset > seg.baseOffset {
+			ranges = append(ranges, &api.OffsetRange{
+				From: seg.baseOffset,
+				To: seg.nextOffset,
+			})
+		}
+	}
+	return ranges
+}
+
+// Retain removes the oldest sealed segments that fall outside the
+// retention config and returns how many segments it removed.
+func (l *Log) Retain() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rc := l.Config.Retention
+	var total uint64
+	for _, seg := range l.segments {
+		total += seg.store.size
+	}
+
+	removed := 0
+	for len(l.segments) > 1 {
+		seg := l.segments[0]
+		expired := false
+		if rc.MaxAge > 0 {
+			fi, err := os.Stat(seg.store.Name())
+			if err != nil {
+				return removed, err
+			}
+			expired = time.Since(fi.ModTime()) > rc.MaxAge
+		}
+		oversized := rc.MaxBytes > 0 && total > rc.MaxBytes
+		if !expired && !oversized {
+			break
+		}
+		if err := seg.Remove(); err != nil {
+			return removed, err
+		}
+		total -= seg.store.size
+		l.segments = l.segments[1:]
+		removed++
+		l.metrics.retentionDeletions.Add(context.Background(), 1, l.attrs)
+	}
+	return removed, nil
+}
+
 type originReader struct {
 	*store
 	offset uint64
@@ -1,2 +1,220 @@
 package log
 
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestLogRetain(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * irLen
+	c.Retention.MaxBytes = 200
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 12; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("retained record")})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 5)
+
+	n, err := l.Retain()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, uint64(6), l.LowestOffset())
+
+	_, err = l.Read(0)
+	require.Error(t, err)
+	r, err := l.Read(11)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), r.Offset)
+	require.NoError(t, l.Remove())
+}
+
+func TestLogRollsBeforeIndexIsFull(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// an index size that is not a multiple of the entry width
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3*irLen + irLen/2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 3)
+	require.NoError(t, l.Remove())
+}
+
+func TestLogReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * irLen
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+
+	// appends racing the reset either fail on the closed log or land
+	// in the new one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Append(&api.Record{Value: []byte("racing")})
+		}
+	}()
+	require.NoError(t, l.Reset())
+	<-done
+	require.NoError(t, l.Reset())
+	require.Len(t, l.segments, 1)
+	require.Equal(t, uint64(0), l.NextOffset())
+	off, err := l.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, l.Remove())
+}
+
+func TestLogRemoveFrom(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * irLen
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("original")})
+		require.NoError(t, err)
+	}
+	before, err := l.Digest(0, 4)
+	require.NoError(t, err)
+	all, err := l.Digest(0, 8)
+	require.NoError(t, err)
+	require.NotEqual(t, before, all)
+
+	// cut in the middle of the second segment
+	require.NoError(t, l.RemoveFrom(4))
+	require.Equal(t, uint64(4), l.NextOffset())
+	_, err = l.Read(4)
+	require.Error(t, err)
+	after, err := l.Digest(0, 8)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	for i := 0; i < 4; i++ {
+		off, err := l.Append(&api.Record{Value: []byte("original")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(4+i), off)
+	}
+	refilled, err := l.Digest(0, 8)
+	require.NoError(t, err)
+	require.Equal(t, all, refilled)
+
+	require.NoError(t, l.RemoveFrom(0))
+	require.Equal(t, uint64(0), l.NextOffset())
+	require.Empty(t, l.Ranges())
+	require.NoError(t, l.Remove())
+
+	// cut before the first segment, as when retention dropped the
+	// records the authority still has
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	c.Segment.InitialOffset = 10
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("original")})
+	require.NoError(t, err)
+	require.NoError(t, l.RemoveFrom(5))
+	require.Equal(t, uint64(5), l.NextOffset())
+	off, err := l.Append(&api.Record{Value: []byte("original")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, l.Remove())
+}
+
+func TestRepairWaitsForWriters(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	l, err := m.Partition(DefaultTopic, 0)
+	require.NoError(t, err)
+
+	ae := &AntiEntropy{
+		Log:         m,
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}
+	l.LockWriters()
+	done := make(chan struct{})
+	go func() {
+		// nothing listens there, the repair fails once it gets going
+		ae.Repair(DefaultTopic, 0, "127.0.0.1:1")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("repair ran while replication was writing")
+	case <-time.After(100 * time.Millisecond):
+	}
+	l.UnlockWriters()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("repair never ran")
+	}
+}
+
+func TestExportSegmentsOutlivesRemoval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * irLen
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("original")})
+		require.NoError(t, err)
+	}
+
+	var chunks []*api.SegmentChunk
+	err = l.ExportSegments(0, func(chunk *api.SegmentChunk) error {
+		if len(chunks) == 0 {
+			// the segments go away while they are being sent
+			require.NoError(t, l.RemoveFrom(0))
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	require.NoError(t, err)
+	// two sealed segments, a store and an index each
+	require.Len(t, chunks, 4)
+	for _, chunk := range chunks {
+		require.True(t, chunk.Last)
+		require.NotEmpty(t, chunk.Data)
+	}
+	require.NoError(t, l.Remove())
+}
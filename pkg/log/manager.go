@@ -0,0 +1,472 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// DefaultTopic receives the records produced without naming a topic.
+const DefaultTopic = "default"
+
+const topicConfigFile = "topic.json"
+
+var (
+	ErrTopicNotFound     = errors.New("topic not found")
+	ErrTopicExists       = errors.New("topic already exists")
+	ErrPartitionNotFound = errors.New("partition not found")
+	ErrInvalidTopic      = errors.New("invalid topic name")
+	ErrDefaultTopic      = fmt.Errorf("%s topic can not be deleted", DefaultTopic)
+
+	topicName = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]*$`)
+)
+
+// TopicConfig describes how a topic is split and how each of its
+// partitions stores and retains records.
+type TopicConfig struct {
+	Partitions uint32
+	Log        Config
+}
+
+// Topic is a named stream of records spread over a fixed number of
+// partitions, each one being its own Log.
+type Topic struct {
+	Name   string
+	Config TopicConfig
+
+	// mu guards the logs in partitions, which are replaced when a
+	// partition is reset. Their number never changes.
+	mu         sync.RWMutex
+	partitions []*Log
+	next       uint32
+}
+
+// Partition returns the log backing the given partition.
+func (t *Topic) Partition(p uint32) (*Log, error) {
+	if p >= uint32(len(t.partitions)) {
+		return nil, ErrPartitionNotFound
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.partitions[p], nil
+}
+
+// logs returns the logs of the partitions, in order.
+func (t *Topic) logs() []*Log {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]*Log(nil), t.partitions...)
+}
+
+// partitionFor hashes key onto a partition, or rotates through the
+// partitions when there is no key.
+func (t *Topic) partitionFor(key []byte) uint32 {
+	n := uint32(len(t.partitions))
+	if len(key) == 0 {
+		return (atomic.AddUint32(&t.next, 1) - 1) % n
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % n
+}
+
+func (t *Topic) close() error {
+	for _, p := range t.logs() {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ManagerConfig struct {
+	// DefaultTopic is used to create the default topic and to fill in
+	// the zero fields of created topics.
+	DefaultTopic TopicConfig
+	// RetentionInterval is how often retention is enforced, disabled
+	// when zero.
+	RetentionInterval time.Duration
+	// MeterProvider records the metrics of the partitions, the global
+	// provider when nil.
+	MeterProvider metric.MeterProvider
+}
+
+// Manager hosts the topics of a node, storing every partition under
+// Dir/<topic>/<partition>.
+type Manager struct {
+	mu sync.RWMutex
+
+	Dir    string
+	Config ManagerConfig
+
+	topics map[string]*Topic
+	logger      *zap.Logger
+	instruments *metrics
+	metrics     metric.Registration
+	close   chan struct{}
+	closed  bool
+}
+
+func NewManager(dir string, c ManagerConfig) (*Manager, error) {
+	if c.DefaultTopic.Partitions == 0 {
+		c.DefaultTopic.Partitions = 1
+	}
+	m := &Manager{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*Topic),
+		logger: zap.L().Named("manager"),
+		close:  make(chan struct{}),
+	}
+	mp := c.MeterProvider
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	var err error
+	if m.instruments, err = newMetrics(mp); err != nil {
+		return nil, err
+	}
+	if err = m.setup(); err != nil {
+		return nil, err
+	}
+	if m.metrics, err = m.registerMetrics(); err != nil {
+		return nil, err
+	}
+	if c.RetentionInterval > 0 {
+		go m.retain()
+	}
+	return m, nil
+}
+
+func (m *Manager) setup() error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	if err := m.migrate(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(path.Join(m.Dir, e.Name(), topicConfigFile))
+		if errors.Is(err, os.ErrNotExist) {
+			// not a topic directory
+			continue
+		} else if err != nil {
+			return err
+		}
+		var c TopicConfig
+		if err = json.Unmarshal(b, &c); err != nil {
+			return fmt.Errorf("topic %s: %w", e.Name(), err)
+		}
+		t, err := m.openTopic(e.Name(), c)
+		if err != nil {
+			return err
+		}
+		m.topics[t.Name] = t
+	}
+	if _, OK := m.topics[DefaultTopic]; !OK {
+		if _, err = m.CreateTopic(DefaultTopic, m.Config.DefaultTopic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate moves the segments of the single log that was kept in the root
+// of the directory before topics into partition 0 of the default topic.
+func (m *Manager) migrate() error {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return err
+	}
+	var segments []string
+	for _, e := range entries {
+		ext := path.Ext(e.Name())
+		if e.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
+		if _, err = strconv.ParseUint(strings.TrimSuffix(e.Name(), ext), 10, 64); err == nil {
+			segments = append(segments, e.Name())
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	// moves cut short are finished on the next start, the topic config
+	// being written only once they are all in place
+	if _, err = os.Stat(path.Join(m.Dir, DefaultTopic, topicConfigFile)); err == nil {
+		return fmt.Errorf("%s holds segments of a log from before topics besides the %s topic, move them out of the way", m.Dir, DefaultTopic)
+	}
+	dir := path.Join(m.Dir, DefaultTopic, "0")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if err = os.Rename(path.Join(m.Dir, name), path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	m.logger.Info("moved the log from before topics into the default topic", zap.Int("files", len(segments)))
+	return nil
+}
+
+func (m *Manager) openTopic(name string, c TopicConfig) (*Topic, error) {
+	t := &Topic{Name: name, Config: c}
+	for i := uint32(0); i < c.Partitions; i++ {
+		dir := path.Join(m.Dir, name, strconv.FormatUint(uint64(i), 10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		l, err := NewLog(dir, c.Log)
+		if err != nil {
+			return nil, err
+		}
+		l.metrics, l.attrs = m.instruments, partitionAttributes(name, i)
+		t.partitions = append(t.partitions, l)
+	}
+	return t, nil
+}
+
+// CreateTopic creates and persists a topic. Zero fields of c are taken
+// from the manager's default topic config.
+func (m *Manager) CreateTopic(name string, c TopicConfig) (*Topic, error) {
+	if !topicName.MatchString(name) {
+		return nil, ErrInvalidTopic
+	}
+	def := m.Config.DefaultTopic
+	if c.Partitions == 0 {
+		c.Partitions = def.Partitions
+	}
+	if c.Log.Segment.MaxStoreBytes == 0 {
+		c.Log.Segment.MaxStoreBytes = def.Log.Segment.MaxStoreBytes
+	}
+	if c.Log.Segment.MaxIndexBytes == 0 {
+		c.Log.Segment.MaxIndexBytes = def.Log.Segment.MaxIndexBytes
+	}
+	if c.Log.Retention == (RetentionConfig{}) {
+		c.Log.Retention = def.Log.Retention
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, OK := m.topics[name]; OK {
+		return nil, ErrTopicExists
+	}
+	dir := path.Join(m.Dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t, err := m.openTopic(name, c)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	// the config file marks the directory as a topic, write it last
+	if err = os.WriteFile(path.Join(dir, topicConfigFile), b, 0644); err != nil {
+		return nil, err
+	}
+	m.topics[name] = t
+	return t, nil
+}
+
+// DeleteTopic closes a topic and removes all of its partitions.
+func (m *Manager) DeleteTopic(name string) error {
+	if name == DefaultTopic {
+		return ErrDefaultTopic
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, OK := m.topics[name]
+	if !OK {
+		return ErrTopicNotFound
+	}
+	if err := t.close(); err != nil {
+		return err
+	}
+	delete(m.topics, name)
+	return os.RemoveAll(path.Join(m.Dir, name))
+}
+
+// ResetPartition throws away the records of a partition, leaving it
+// empty.
+func (m *Manager) ResetPartition(topic string, partition uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, OK := m.topics[topic]
+	if !OK {
+		return ErrTopicNotFound
+	}
+	if partition >= uint32(len(t.partitions)) {
+		return ErrPartitionNotFound
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// removing the old log closes it, so whoever still holds it fails
+	// to append instead of writing records that are thrown away
+	l := t.partitions[partition]
+	if err := l.Remove(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	reset, err := NewLog(l.Dir, t.Config.Log)
+	if err != nil {
+		return err
+	}
+	reset.metrics, reset.attrs = l.metrics, l.attrs
+	t.partitions[partition] = reset
+	return nil
+}
+
+// Topics returns the hosted topics sorted by name.
+func (m *Manager) Topics() []*Topic {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	topics := make([]*Topic, 0, len(m.topics))
+	for _, t := range m.topics {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+func (m *Manager) Topic(name string) (*Topic, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, OK := m.topics[name]
+	if !OK {
+		return nil, ErrTopicNotFound
+	}
+	return t, nil
+}
+
+// Partition returns the log of a topic's partition.
+func (m *Manager) Partition(topic string, partition uint32) (*Log, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, OK := m.topics[topic]
+	if !OK {
+		return nil, ErrTopicNotFound
+	}
+	return t.Partition(partition)
+}
+
+// PartitionFor picks the partition of topic a record with key goes to.
+func (m *Manager) PartitionFor(topic string, key []byte) (uint32, error) {
+	t, err := m.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return t.partitionFor(key), nil
+}
+
+// Append, Read and Remove make the manager usable wherever a single log
+// is, by working on the first partition of the default topic.
+func (m *Manager) Append(r *api.Record) (uint64, error) {
+	l, err := m.Partition(DefaultTopic, 0)
+	if err != nil {
+		return 0, err
+	}
+	return l.Append(r)
+}
+
+func (m *Manager) Read(off uint64) (*api.Record, error) {
+	l, err := m.Partition(DefaultTopic, 0)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+func (m *Manager) Remove() error {
+	if err := m.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(m.Dir)
+}
+
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.close)
+	if err := m.metrics.Unregister(); err != nil {
+		return err
+	}
+	for _, t := range m.topics {
+		if err := t.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) retain() {
+	ticker := time.NewTicker(m.Config.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.close:
+			return
+		case <-ticker.C:
+			m.Retain()
+		}
+	}
+}
+
+// Retain enforces the retention config of every partition.
+func (m *Manager) Retain() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.topics {
+		for i, p := range t.logs() {
+			n, err := p.Retain()
+			if err != nil {
+				m.logger.Error(
+					"failed to enforce retention",
+					zap.Error(err),
+					zap.String("topic", t.Name),
+					zap.Int("partition", i),
+				)
+			}
+			if n > 0 {
+				m.logger.Info(
+					"removed segments",
+					zap.String("topic", t.Name),
+					zap.Int("partition", i),
+					zap.Int("segments", n),
+				)
+			}
+		}
+	}
+}
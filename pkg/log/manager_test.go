@@ -0,0 +1,114 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manager_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+
+	// the default topic backs the single log methods
+	off, err := m.Append(&api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = m.CreateTopic("orders", TopicConfig{Partitions: 3})
+	require.NoError(t, err)
+	_, err = m.CreateTopic("orders", TopicConfig{})
+	require.ErrorIs(t, err, ErrTopicExists)
+	_, err = m.CreateTopic("../escape", TopicConfig{})
+	require.ErrorIs(t, err, ErrInvalidTopic)
+
+	// records with the same key always land on the same partition
+	p, err := m.PartitionFor("orders", []byte("customer-1"))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		got, err := m.PartitionFor("orders", []byte("customer-1"))
+		require.NoError(t, err)
+		require.Equal(t, p, got)
+	}
+	l, err := m.Partition("orders", p)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("order"), Key: []byte("customer-1")})
+	require.NoError(t, err)
+
+	_, err = m.Partition("orders", 3)
+	require.ErrorIs(t, err, ErrPartitionNotFound)
+	_, err = m.Partition("missing", 0)
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	// topics and their records survive a restart
+	require.NoError(t, m.Close())
+	m, err = NewManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	topics := m.Topics()
+	require.Len(t, topics, 2)
+	require.Equal(t, "default", topics[0].Name)
+	require.Equal(t, "orders", topics[1].Name)
+	require.Equal(t, uint32(3), topics[1].Config.Partitions)
+
+	l, err = m.Partition("orders", p)
+	require.NoError(t, err)
+	r, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), r.Value)
+	_, err = l.Read(1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	// a reset partition starts over, the log it replaced takes no more
+	// records
+	require.NoError(t, m.ResetPartition("orders", p))
+	_, err = l.Append(&api.Record{Value: []byte("stale")})
+	require.ErrorIs(t, err, ErrClosed)
+	reset, err := m.Partition("orders", p)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), reset.NextOffset())
+
+	require.NoError(t, m.DeleteTopic("orders"))
+	require.Len(t, m.Topics(), 1)
+	require.NoDirExists(t, dir+"/orders")
+	require.ErrorIs(t, m.DeleteTopic(DefaultTopic), ErrDefaultTopic)
+
+	require.NoError(t, m.Remove())
+}
+
+func TestManagerMovesOldLayout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manager_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a log written before topics, straight into the data directory
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("before topics")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	m, err := NewManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	r, err := m.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before topics"), r.Value)
+	off, err := m.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, m.Close())
+
+	// segments showing up next to an existing default topic are refused
+	// rather than ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), nil, 0644))
+	_, err = NewManager(dir, ManagerConfig{})
+	require.ErrorContains(t, err, "before topics")
+}
@@ -0,0 +1,114 @@
+package log
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// metrics are the instruments logs record their measurements with.
+type metrics struct {
+	meter              metric.Meter
+	appendDuration     metric.Float64Histogram
+	readDuration       metric.Float64Histogram
+	recordsWritten     metric.Int64Counter
+	bytesWritten       metric.Int64Counter
+	segmentRolls       metric.Int64Counter
+	retentionDeletions metric.Int64Counter
+	segments           metric.Int64ObservableGauge
+	bytes              metric.Int64ObservableGauge
+	indexFill          metric.Float64ObservableGauge
+}
+
+// globalMetrics are used by the logs opened with NewLog, and follow the
+// global meter provider once it is first set.
+var globalMetrics, _ = newMetrics(otel.GetMeterProvider())
+
+func newMetrics(mp metric.MeterProvider) (*metrics, error) {
+	m := &metrics{meter: mp.Meter("github.com/larkiee/distributed_logger/pkg/log")}
+	var err error
+	if m.appendDuration, err = m.meter.Float64Histogram("dlog.log.append.duration",
+		metric.WithDescription("time taken to append a record"), metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if m.readDuration, err = m.meter.Float64Histogram("dlog.log.read.duration",
+		metric.WithDescription("time taken to read a record"), metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if m.recordsWritten, err = m.meter.Int64Counter("dlog.log.records.written",
+		metric.WithDescription("records appended")); err != nil {
+		return nil, err
+	}
+	if m.bytesWritten, err = m.meter.Int64Counter("dlog.log.bytes.written",
+		metric.WithDescription("bytes appended to the stores, length prefixes included"), metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if m.segmentRolls, err = m.meter.Int64Counter("dlog.log.segment.rolls",
+		metric.WithDescription("segments started because the active one was full")); err != nil {
+		return nil, err
+	}
+	if m.retentionDeletions, err = m.meter.Int64Counter("dlog.log.retention.deletions",
+		metric.WithDescription("segments removed by retention")); err != nil {
+		return nil, err
+	}
+	if m.segments, err = m.meter.Int64ObservableGauge("dlog.log.segments",
+		metric.WithDescription("segments held by a partition")); err != nil {
+		return nil, err
+	}
+	if m.bytes, err = m.meter.Int64ObservableGauge("dlog.log.bytes",
+		metric.WithDescription("bytes held by the stores of a partition"), metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if m.indexFill, err = m.meter.Float64ObservableGauge("dlog.log.index.fill",
+		metric.WithDescription("share of the active index of a partition in use")); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// partitionAttributes are the attributes the measurements of a partition
+// log carry.
+func partitionAttributes(topic string, partition uint32) metric.MeasurementOption {
+	return metric.WithAttributeSet(attribute.NewSet(
+		attribute.String("topic", topic),
+		attribute.String("partition", strconv.FormatUint(uint64(partition), 10)),
+	))
+}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// registerMetrics reports the size of the partitions of m until the
+// returned registration is unregistered.
+func (m *Manager) registerMetrics() (metric.Registration, error) {
+	return m.instruments.meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		for _, t := range m.topics {
+			for _, p := range t.logs() {
+				segments, size, fill := p.stats()
+				o.ObserveInt64(m.instruments.segments, int64(segments), p.attrs)
+				o.ObserveInt64(m.instruments.bytes, int64(size), p.attrs)
+				o.ObserveFloat64(m.instruments.indexFill, fill, p.attrs)
+			}
+		}
+		return nil
+	}, m.instruments.segments, m.instruments.bytes, m.instruments.indexFill)
+}
+
+// stats returns how many segments the log has, the bytes they store and
+// the share of the active index in use.
+func (l *Log) stats() (segments int, size uint64, fill float64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, seg := range l.segments {
+		size += seg.store.size
+	}
+	fill = float64(l.activeSegment.index.size) / float64(l.Config.Segment.MaxIndexBytes)
+	return len(l.segments), size, fill
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"context"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	m, err := NewManager(t.TempDir(), ManagerConfig{
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		DefaultTopic: TopicConfig{Log: Config{
+			// three records a segment
+			Segment:   SegmentConfig{MaxIndexBytes: 3 * irLen},
+			Retention: RetentionConfig{MaxBytes: 1},
+		}},
+	})
+	require.NoError(t, err)
+	defer m.Close()
+	for i := 0; i < 7; i++ {
+		_, err = m.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	_, err = m.Read(6)
+	require.NoError(t, err)
+
+	collect := func() map[string]metricdata.Aggregation {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		metrics := make(map[string]metricdata.Aggregation)
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				metrics[metric.Name] = metric.Data
+			}
+		}
+		return metrics
+	}
+	metrics := collect()
+	partition := attribute.NewSet(attribute.String("topic", DefaultTopic), attribute.String("partition", "0"))
+	records := metrics["dlog.log.records.written"].(metricdata.Sum[int64]).DataPoints[0]
+	require.Equal(t, int64(7), records.Value)
+	require.Equal(t, partition, records.Attributes)
+	require.Equal(t, int64(2), metrics["dlog.log.segment.rolls"].(metricdata.Sum[int64]).DataPoints[0].Value)
+	require.Greater(t, metrics["dlog.log.bytes.written"].(metricdata.Sum[int64]).DataPoints[0].Value, int64(7*5))
+	require.Equal(t, uint64(7), metrics["dlog.log.append.duration"].(metricdata.Histogram[float64]).DataPoints[0].Count)
+	require.Equal(t, uint64(1), metrics["dlog.log.read.duration"].(metricdata.Histogram[float64]).DataPoints[0].Count)
+	require.Equal(t, int64(3), metrics["dlog.log.segments"].(metricdata.Gauge[int64]).DataPoints[0].Value)
+	require.InDelta(t, 1.0/3, metrics["dlog.log.index.fill"].(metricdata.Gauge[float64]).DataPoints[0].Value, 0.01)
+
+	m.Retain()
+	metrics = collect()
+	require.Equal(t, int64(2), metrics["dlog.log.retention.deletions"].(metricdata.Sum[int64]).DataPoints[0].Value)
+	require.Equal(t, int64(1), metrics["dlog.log.segments"].(metricdata.Gauge[int64]).DataPoints[0].Value)
+}
@@ -2,25 +2,49 @@ package log
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/larkiee/distributed_logger/api/v1"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// pollInterval is how long replication waits before asking a server
+// that had nothing more for new records.
+const pollInterval = 250 * time.Millisecond
+
 type Replicator struct {
 	DialOptions []grpc.DialOption
 	LocalServer api.LogClient
-	mu          sync.Mutex
-	logger      *zap.Logger
-	servers     map[string]chan struct{}
-	closed      bool
-	close       chan struct{}
+	// Local, when set, lets the replicator copy whole segments into the
+	// local log before streaming records, drop the records a replaced
+	// leader wrote and append records without going through LocalServer.
+	Local *Manager
+	// Follow, when set, picks the one member to replicate from its tags,
+	// usually the leader. Every member is replicated when it is nil.
+	Follow func(name string, tags map[string]string) bool
+	// Zone is the zone of the local node. With Local set, sealed
+	// segments are copied from a member of the same zone when there is
+	// one, sparing the traffic across zones, and only the records after
+	// them come from the member followed.
+	Zone    string
+	mu      sync.Mutex
+	logger  *zap.Logger
+	servers map[string]chan struct{}
+	addrs   map[string]string
+	// locations holds where every member updated so far is.
+	locations map[string]location
+	closed    bool
+	close     chan struct{}
+}
+
+// location is the address and zone of a member.
+type location struct {
+	addr string
+	zone string
 }
 
 func (r *Replicator) init() {
@@ -30,13 +54,18 @@ func (r *Replicator) init() {
 	if r.servers == nil {
 		r.servers = make(map[string]chan struct{})
 	}
+	if r.addrs == nil {
+		r.addrs = make(map[string]string)
+	}
+	if r.locations == nil {
+		r.locations = make(map[string]location)
+	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
 }
 
 func (r *Replicator) Join(name, addr string) error {
-	fmt.Println("GGGGGGGGGGG", addr, name)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
@@ -47,56 +76,148 @@ func (r *Replicator) Join(name, addr string) error {
 		// already replicating this server
 		return nil
 	}
+	if r.Follow != nil {
+		// the tags telling whether to follow come with Update
+		return nil
+	}
+	r.start(name, addr)
+	return nil
+}
+
+// Update reconnects to a server that moved to another address and, with
+// Follow set, switches to the member to follow.
+func (r *Replicator) Update(name string, tags map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	addr := tags["rpc_addr"]
+	if r.closed || addr == "" {
+		return nil
+	}
+	r.locations[name] = location{addr: addr, zone: tags["zone"]}
+	if r.Follow != nil && !r.Follow(name, tags) {
+		r.stop(name)
+		return nil
+	}
+	if _, OK := r.servers[name]; OK && r.addrs[name] == addr {
+		return nil
+	}
+	r.stop(name)
+	if r.Follow != nil {
+		for other := range r.servers {
+			r.stop(other)
+		}
+	}
+	r.start(name, addr)
+	return nil
+}
+
+// start must be called with r.mu held.
+func (r *Replicator) start(name, addr string) {
 	ch := make(chan struct{})
 	r.servers[name] = ch
+	r.addrs[name] = addr
 	go r.replicate(addr, ch)
-	return nil
+}
+
+// stop must be called with r.mu held.
+func (r *Replicator) stop(name string) {
+	if ch, OK := r.servers[name]; OK {
+		close(ch)
+	}
+	delete(r.servers, name)
+	delete(r.addrs, name)
 }
 
 func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	cc, err := grpc.Dial(addr, r.DialOptions...)
 	if err != nil {
 		r.logError(err, "error in replication", "addr", addr)
+		return
 	}
-	fmt.Println("HiiiByee")
-	client := api.NewLogClient(cc)
-	records := make(chan *api.Record)
+	defer cc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	go func() {
-		i := 0
-		stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: 0})
-		if err != nil {
-			r.logError(err, "failed got stream", "addr", addr)
+	var offset uint64
+	var local *Log
+	if r.Local != nil {
+		if local, err = r.Local.Partition(DefaultTopic, 0); err != nil {
+			r.logError(err, "failed to open local log", "addr", addr)
+			return
 		}
+		if offset, err = r.catchUp(ctx, cc, addr, local); err != nil {
+			r.logError(err, "failed to catch up", "addr", addr)
+		}
+	}
 
-		for {
-			res, err := stream.Recv()
-			if i != 0 {
-				os.Exit(1)
-			}
-			s, _ := status.FromError(err)
+	client := api.NewLogClient(cc)
+	records := make(chan *api.Record)
 
-			if err != nil && strings.Contains(s.Message(), "range") {
-				continue
-			} else if err != nil {
+	consume := func(ctx context.Context, offset uint64) {
+		for {
+			stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: offset})
+			if err != nil {
+				r.logError(err, "failed got stream", "addr", addr)
 				return
+			}
 
+			for {
+				res, err := stream.Recv()
+				if err != nil {
+					if status.Code(err) != codes.OutOfRange {
+						return
+					}
+					break
+				}
+				// the record is appended as soon as it is sent
+				next := res.Record.Offset + 1
+				select {
+				case records <- res.Record:
+					offset = next
+				case <-ctx.Done():
+					return
+				}
 			}
 
-			records <- res.Record
+			// read everything there is, wait for more
+			select {
+			case <-time.After(pollInterval):
+			case <-ctx.Done():
+				return
+			}
 		}
-	}()
+	}
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	go consume(consumeCtx, offset)
 
 	for {
 		select {
 		case <-leave:
+			stopConsuming()
 			return
 		case <-r.close:
+			stopConsuming()
 			return
 		case rec := <-records:
-			_, err = r.LocalServer.Produce(context.Background(), &api.ProduceRequest{
-				Record: rec,
-			})
+			if local != nil {
+				local.LockWriters()
+				if next := local.NextOffset(); rec.Offset != next {
+					// a repair rewrote the log under us, stream again
+					// from where it ends now
+					local.UnlockWriters()
+					stopConsuming()
+					consumeCtx, stopConsuming = context.WithCancel(ctx)
+					go consume(consumeCtx, next)
+					continue
+				}
+				_, err = local.Append(rec)
+				local.UnlockWriters()
+			} else {
+				_, err = r.LocalServer.Produce(context.Background(), &api.ProduceRequest{
+					Record: rec,
+				})
+			}
 			if err != nil {
 				r.logError(
 					err,
@@ -109,6 +230,61 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	}
 }
 
+// catchUp drops the local records the server does not have and installs
+// the sealed segments it has beyond the local log, from a member of our
+// own zone when there is one, returning the offset to stream records
+// from.
+func (r *Replicator) catchUp(ctx context.Context, cc *grpc.ClientConn, addr string, l *Log) (uint64, error) {
+	l.LockWriters()
+	defer l.UnlockWriters()
+	peer := api.NewPeerClient(cc)
+	removed, err := TruncateDiverged(ctx, peer, l, DefaultTopic, 0)
+	if removed > 0 {
+		r.logger.Warn("dropped diverged records", zap.Uint64("records", removed))
+	}
+	if err != nil {
+		return l.NextOffset(), err
+	}
+	if near := r.nearby(addr); near != "" {
+		n, err := r.fetchSegments(ctx, near, l)
+		if err != nil {
+			r.logError(err, "failed to fetch segments nearby", "addr", near)
+		} else if n > 0 {
+			r.logger.Info("installed segments", zap.Int("segments", n), zap.String("addr", near))
+		}
+	}
+	n, err := FetchSegments(ctx, peer, l, DefaultTopic, 0)
+	if n > 0 {
+		r.logger.Info("installed segments", zap.Int("segments", n), zap.String("addr", addr))
+	}
+	return l.NextOffset(), err
+}
+
+// nearby returns the address of a member in the local zone other than
+// the one at addr, or "" when there is none.
+func (r *Replicator) nearby(addr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Zone == "" {
+		return ""
+	}
+	for _, loc := range r.locations {
+		if loc.zone == r.Zone && loc.addr != addr {
+			return loc.addr
+		}
+	}
+	return ""
+}
+
+func (r *Replicator) fetchSegments(ctx context.Context, addr string, l *Log) (int, error) {
+	cc, err := grpc.Dial(addr, r.DialOptions...)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.Close()
+	return FetchSegments(ctx, api.NewPeerClient(cc), l, DefaultTopic, 0)
+}
+
 func (r *Replicator) logError(err error, msg string, args ...string) {
 	fields := []zap.Field{zap.Error(err)}
 	for i := 0; i < len(args); i += 2 {
@@ -127,11 +303,8 @@ func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
-	if _, OK := r.servers[name]; !OK {
-		return nil
-	}
-	close(r.servers[name])
-	delete(r.servers, name)
+	r.stop(name)
+	delete(r.locations, name)
 	return nil
 }
 
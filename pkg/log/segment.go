@@ -107,9 +107,32 @@ func (seg *segment) Read(offset uint64) (*api.Record, error) {
 	return r, nil
 }
 
+// readRaw returns the record at offset as it is stored on disk.
+func (seg *segment) readRaw(offset uint64) ([]byte, error) {
+	_, pos, err := seg.index.Read(int32(offset - seg.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	return seg.store.Read(pos)
+}
+
+// truncate drops the records at and after offset.
+func (seg *segment) truncate(offset uint64) error {
+	_, pos, err := seg.index.Read(int32(offset - seg.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = seg.store.Truncate(pos); err != nil {
+		return err
+	}
+	seg.index.size = (offset - seg.baseOffset) * irLen
+	seg.nextOffset = offset
+	return nil
+}
+
 func (seg *segment) IsMaxed() bool {
 	return seg.store.size >= seg.config.Segment.MaxStoreBytes || 
-			seg.index.size >= seg.config.Segment.MaxIndexBytes
+			seg.index.size+irLen > seg.config.Segment.MaxIndexBytes
 }
 
 func (seg *segment) Close() error {
@@ -0,0 +1,217 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+)
+
+const chunkSize = 64 * 1024
+
+// ExportSegments sends the store and index of every sealed segment
+// starting at or after from, in offset order, as checksummed chunks.
+func (l *Log) ExportSegments(from uint64, send func(*api.SegmentChunk) error) error {
+	type export struct {
+		base  uint64
+		store io.Reader
+		index io.Reader
+	}
+	var exports []export
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	open := func(name string, size uint64) (io.Reader, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		return io.NewSectionReader(f, 0, int64(size)), nil
+	}
+
+	// the files are opened under the lock and read from without it, so
+	// the stream holds up neither appends nor retention removing them
+	l.mu.RLock()
+	for _, seg := range l.segments {
+		if seg == l.activeSegment || seg.baseOffset < from {
+			continue
+		}
+		if err := seg.store.Flush(); err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+		e := export{base: seg.baseOffset}
+		var err error
+		if e.store, err = open(seg.store.Name(), seg.store.size); err == nil {
+			e.index, err = open(seg.index.Name(), seg.index.size)
+		}
+		if err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+		exports = append(exports, e)
+	}
+	l.mu.RUnlock()
+
+	for _, e := range exports {
+		if err := sendFile(e.base, "store", e.store, send); err != nil {
+			return err
+		}
+		if err := sendFile(e.base, "index", e.index, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendFile(base uint64, name string, r io.Reader, send func(*api.SegmentChunk) error) error {
+	h := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			h.Write(buf[:n])
+			return send(&api.SegmentChunk{
+				BaseOffset: base,
+				File:       name,
+				Data:       buf[:n],
+				Last:       true,
+				Checksum:   h.Sum(nil),
+			})
+		} else if err != nil {
+			return err
+		}
+		h.Write(buf[:n])
+		if err = send(&api.SegmentChunk{BaseOffset: base, File: name, Data: buf[:n]}); err != nil {
+			return err
+		}
+	}
+}
+
+// FetchSegments copies whole sealed segments of a partition from a peer
+// in place of replaying their records one by one. It only does so when
+// the peer's segments line up with the start of the local active
+// segment, and returns how many segments it installed; record streaming
+// picks up from the log's next offset afterwards.
+func FetchSegments(ctx context.Context, client api.PeerClient, l *Log, topic string, partition uint32) (int, error) {
+	l.mu.RLock()
+	base := l.activeSegment.baseOffset
+	l.mu.RUnlock()
+
+	stream, err := client.FetchSegments(ctx, &api.FetchSegmentsRequest{
+		Topic:      topic,
+		Partition:  partition,
+		FromOffset: base,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	staging := l.Dir + ".snapshot"
+	if err = os.RemoveAll(staging); err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(staging, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+
+	var f *os.File
+	var h hash.Hash
+	var bases []uint64
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if len(bases) == 0 && chunk.BaseOffset != base {
+			// the peer's segments are split differently from ours
+			return 0, nil
+		}
+		if f == nil {
+			if chunk.File != "store" && chunk.File != "index" {
+				return 0, fmt.Errorf("unexpected segment file %q", chunk.File)
+			}
+			f, err = os.Create(path.Join(staging, fmt.Sprintf("%d.%s", chunk.BaseOffset, chunk.File)))
+			if err != nil {
+				return 0, err
+			}
+			h = sha256.New()
+		}
+		if _, err = f.Write(chunk.Data); err != nil {
+			f.Close()
+			return 0, err
+		}
+		h.Write(chunk.Data)
+		if !chunk.Last {
+			continue
+		}
+		if err = f.Sync(); err != nil {
+			f.Close()
+			return 0, err
+		}
+		if err = f.Close(); err != nil {
+			return 0, err
+		}
+		f = nil
+		if !bytes.Equal(h.Sum(nil), chunk.Checksum) {
+			return 0, fmt.Errorf("checksum mismatch for segment %d %s", chunk.BaseOffset, chunk.File)
+		}
+		if len(bases) == 0 || bases[len(bases)-1] != chunk.BaseOffset {
+			bases = append(bases, chunk.BaseOffset)
+		}
+	}
+	if f != nil {
+		f.Close()
+		return 0, errors.New("segment stream ended in the middle of a file")
+	}
+	if len(bases) == 0 {
+		return 0, nil
+	}
+	return len(bases), l.installSegments(staging, bases)
+}
+
+// installSegments swaps the log's empty or partial active segment for
+// the verified segments in staging, all under the log's lock so readers
+// see either the old log or the new one.
+func (l *Log) installSegments(staging string, bases []uint64) error {
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment.baseOffset != bases[0] {
+		return errors.New("log moved on while fetching segments")
+	}
+	if err := l.activeSegment.Remove(); err != nil {
+		return err
+	}
+	l.segments = l.segments[:len(l.segments)-1]
+
+	for _, base := range bases {
+		for _, ext := range []string{"index", "store"} {
+			name := fmt.Sprintf("%d.%s", base, ext)
+			if err := os.Rename(path.Join(staging, name), path.Join(l.Dir, name)); err != nil {
+				return err
+			}
+		}
+		if err := l.newSegment(base); err != nil {
+			return err
+		}
+	}
+	// the installed segments are sealed, appends go to a fresh one
+	return l.newSegment(l.activeSegment.nextOffset)
+}
@@ -84,3 +84,36 @@ func (s *store) ReadAt(b []byte, off uint64) (nn int, err error) {
 
 	return s.File.ReadAt(b,  int64(off))
 }
+
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buf.Flush()
+}
+
+// Truncate cuts the store down to size bytes.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	return s.File.Close()
+}
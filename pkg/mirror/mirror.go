@@ -0,0 +1,400 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// OriginHeader names the cluster a record was first produced in. It is
+// set on every mirrored record and kept as records are mirrored on, so
+// a record is never mirrored back into the cluster it came from.
+const OriginHeader = "dlog-origin"
+
+// DefaultCheckpointTopic prefixes the target topic progress is kept
+// in, each mirror using DefaultCheckpointTopic.<name> by default.
+const DefaultCheckpointTopic = "_mirror_checkpoints"
+
+// A checkpoint topic keeps only its latest bytes, so loading the
+// checkpoints does not replay every checkpoint ever stored.
+const (
+	checkpointSegmentBytes   = 16 << 10
+	checkpointRetentionBytes = 64 << 10
+)
+
+type Config struct {
+	// Name tells the checkpoints of this mirror from those of others
+	// writing to the same target.
+	Name string
+	// SourceAddr and TargetAddr are the dial targets of the two
+	// clusters, such as dlog:///host:port with loadbalance.WithResolver.
+	SourceAddr        string
+	SourceDialOptions []grpc.DialOption
+	TargetAddr        string
+	TargetDialOptions []grpc.DialOption
+	// SourceCluster and TargetCluster name the clusters for the origin
+	// header.
+	SourceCluster string
+	TargetCluster string
+	// Topics are the source topics to mirror.
+	Topics []string
+	// Rename maps source topics onto differently named target topics.
+	Rename map[string]string
+	// CheckpointTopic is where progress is stored in the target,
+	// DefaultCheckpointTopic.<name> by default. It retains only the
+	// latest snapshots, so a mirror sharing it with busier ones may lose
+	// its checkpoints.
+	CheckpointTopic string
+	// CheckpointInterval is how often progress is stored, every second
+	// by default. Records mirrored since the last checkpoint are mirrored
+	// again after a crash.
+	CheckpointInterval time.Duration
+	// PollInterval is how long a partition that is caught up waits
+	// before asking the source again, 250ms by default.
+	PollInterval time.Duration
+}
+
+// Mirror copies topics from a source cluster into a target cluster,
+// partition by partition, keeping its progress in the target.
+type Mirror struct {
+	Config
+
+	source *grpc.ClientConn
+	target *grpc.ClientConn
+	logger *zap.Logger
+
+	mu          sync.Mutex
+	checkpoints map[string]uint64
+	stored      map[string]uint64
+	mirrored    uint64
+	skipped     uint64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+func New(c Config) (*Mirror, error) {
+	if c.Name == "" || c.SourceCluster == "" || c.TargetCluster == "" {
+		return nil, errors.New("mirror needs a name and both cluster names")
+	}
+	if c.SourceCluster == c.TargetCluster {
+		return nil, errors.New("source and target cluster are the same")
+	}
+	if c.CheckpointTopic == "" {
+		c.CheckpointTopic = DefaultCheckpointTopic + "." + c.Name
+	}
+	if c.CheckpointInterval == 0 {
+		c.CheckpointInterval = time.Second
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 250 * time.Millisecond
+	}
+	m := &Mirror{
+		Config:      c,
+		logger:      zap.L().Named("mirror"),
+		checkpoints: make(map[string]uint64),
+		stored:      make(map[string]uint64),
+		done:        make(chan struct{}),
+	}
+	var err error
+	if m.source, err = grpc.Dial(c.SourceAddr, c.SourceDialOptions...); err != nil {
+		return nil, err
+	}
+	if m.target, err = grpc.Dial(c.TargetAddr, c.TargetDialOptions...); err != nil {
+		m.source.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	if err = m.setup(ctx); err != nil {
+		cancel()
+		m.wg.Wait()
+		m.source.Close()
+		m.target.Close()
+		return nil, err
+	}
+	go m.checkpoint(ctx)
+	return m, nil
+}
+
+// setup creates the target topics and the checkpoint topic, loads the
+// checkpoints and starts mirroring every partition.
+func (m *Mirror) setup(ctx context.Context) error {
+	res, err := api.NewAdminClient(m.source).ListTopics(ctx, &api.ListTopicsRequest{})
+	if err != nil {
+		return err
+	}
+	source := make(map[string]*api.Topic, len(res.Topics))
+	for _, t := range res.Topics {
+		source[t.Name] = t
+	}
+	admin := api.NewAdminClient(m.target)
+	err = createTopic(ctx, admin, &api.Topic{
+		Name:           m.CheckpointTopic,
+		Partitions:     1,
+		MaxStoreBytes:  checkpointSegmentBytes,
+		RetentionBytes: checkpointRetentionBytes,
+	})
+	if err != nil {
+		return err
+	}
+	if err = m.loadCheckpoints(ctx); err != nil {
+		return err
+	}
+
+	for _, name := range m.Topics {
+		t, OK := source[name]
+		if !OK {
+			return fmt.Errorf("source has no topic %s", name)
+		}
+		target := proto.Clone(t).(*api.Topic)
+		target.Name = m.rename(name)
+		if err = createTopic(ctx, admin, target); err != nil {
+			return err
+		}
+		for p := uint32(0); p < t.Partitions; p++ {
+			m.wg.Add(1)
+			go m.mirror(ctx, name, p)
+		}
+	}
+	return nil
+}
+
+func createTopic(ctx context.Context, admin api.AdminClient, t *api.Topic) error {
+	_, err := admin.CreateTopic(ctx, &api.CreateTopicRequest{Topic: t})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func (m *Mirror) rename(topic string) string {
+	if name, OK := m.Rename[topic]; OK {
+		return name
+	}
+	return topic
+}
+
+func checkpointKey(topic string, partition uint32) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
+}
+
+// loadCheckpoints reads what is left of the checkpoint topic, the last
+// snapshot of this mirror winning.
+func (m *Mirror) loadCheckpoints(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// older segments are gone once retention ran, start from the oldest
+	// record still held
+	res, err := api.NewPeerClient(m.target).GetDigests(ctx, &api.GetDigestsRequest{
+		Topic: m.CheckpointTopic,
+	})
+	if err != nil {
+		return err
+	}
+	stream, err := api.NewLogClient(m.target).ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:  m.CheckpointTopic,
+		Offset: res.LowestOffset,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if endOfLog(err) {
+				return nil
+			}
+			return err
+		}
+		if string(res.Record.Key) != m.Name {
+			continue
+		}
+		var checkpoints map[string]uint64
+		if err = json.Unmarshal(res.Record.Value, &checkpoints); err != nil {
+			return fmt.Errorf("checkpoint %d: %w", res.Record.Offset, err)
+		}
+		m.checkpoints = checkpoints
+		m.stored = make(map[string]uint64, len(checkpoints))
+		for key, off := range checkpoints {
+			m.stored[key] = off
+		}
+	}
+}
+
+// endOfLog tells the error a stream ends with once it read everything.
+func endOfLog(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	return status.Code(err) == codes.OutOfRange
+}
+
+// mirror copies one source partition into the same partition of the
+// target topic, following the source as it grows.
+func (m *Mirror) mirror(ctx context.Context, topic string, partition uint32) {
+	defer m.wg.Done()
+	key := checkpointKey(topic, partition)
+	target := m.rename(topic)
+	source := api.NewLogClient(m.source)
+	producer := api.NewLogClient(m.target)
+
+	m.mu.Lock()
+	offset := m.checkpoints[key]
+	m.mu.Unlock()
+	for {
+		stream, err := source.ConsumeStream(ctx, &api.ConsumeRequest{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    offset,
+		})
+		for err == nil {
+			var res *api.ConsumeResponse
+			if res, err = stream.Recv(); err != nil {
+				break
+			}
+			if err = m.produce(ctx, producer, target, partition, res.Record); err != nil {
+				break
+			}
+			offset = res.Record.Offset + 1
+			m.mu.Lock()
+			m.checkpoints[key] = offset
+			m.mu.Unlock()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !endOfLog(err) {
+			m.logger.Error(
+				"failed to mirror",
+				zap.Error(err),
+				zap.String("topic", topic),
+				zap.Uint32("partition", partition),
+			)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.PollInterval):
+		}
+	}
+}
+
+func (m *Mirror) produce(ctx context.Context, producer api.LogClient, topic string, partition uint32, r *api.Record) error {
+	headers := make(map[string]string, len(r.Headers)+1)
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+	if headers[OriginHeader] == "" {
+		headers[OriginHeader] = m.SourceCluster
+	}
+	if headers[OriginHeader] == m.TargetCluster {
+		// it was mirrored out of the target in the first place
+		m.mu.Lock()
+		m.skipped++
+		m.mu.Unlock()
+		return nil
+	}
+	_, err := producer.Produce(ctx, &api.ProduceRequest{
+		Topic:     topic,
+		Partition: &partition,
+		Record: &api.Record{
+			Value:   r.Value,
+			Key:     r.Key,
+			Headers: headers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.mirrored++
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Mirror) checkpoint(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.storeCheckpoints(ctx); err != nil {
+				m.logger.Error("failed to store checkpoints", zap.Error(err))
+			}
+		}
+	}
+}
+
+// storeCheckpoints produces a snapshot of every checkpoint once any of
+// them moved since the last one was stored.
+func (m *Mirror) storeCheckpoints(ctx context.Context) error {
+	m.mu.Lock()
+	changed := false
+	checkpoints := make(map[string]uint64, len(m.checkpoints))
+	for key, off := range m.checkpoints {
+		checkpoints[key] = off
+		changed = changed || m.stored[key] != off
+	}
+	m.mu.Unlock()
+	if !changed {
+		return nil
+	}
+
+	value, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	var partition uint32
+	_, err = api.NewLogClient(m.target).Produce(ctx, &api.ProduceRequest{
+		Topic:     m.CheckpointTopic,
+		Partition: &partition,
+		Record: &api.Record{
+			Key:   []byte(m.Name),
+			Value: value,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.stored = checkpoints
+	m.mu.Unlock()
+	return nil
+}
+
+// Stats returns how many records were mirrored and how many were
+// skipped for coming from the target.
+func (m *Mirror) Stats() (mirrored, skipped uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mirrored, m.skipped
+}
+
+// Close stops mirroring and stores the final checkpoints.
+func (m *Mirror) Close() error {
+	m.cancel()
+	m.wg.Wait()
+	<-m.done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.storeCheckpoints(ctx)
+	m.target.Close()
+	m.source.Close()
+	return err
+}
@@ -0,0 +1,207 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestMirror(t *testing.T) {
+	east, eastAddr := setupCluster(t)
+	west, westAddr := setupCluster(t)
+	ctx := context.Background()
+
+	_, err := api.NewAdminClient(east).CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: 2},
+	})
+	require.NoError(t, err)
+	produce(t, east, "orders", 0, 3)
+
+	c := Config{
+		Name:               "east-west",
+		SourceAddr:         eastAddr,
+		SourceDialOptions:  dialOptions(),
+		TargetAddr:         westAddr,
+		TargetDialOptions:  dialOptions(),
+		SourceCluster:      "east",
+		TargetCluster:      "west",
+		Topics:             []string{"orders"},
+		Rename:             map[string]string{"orders": "east-orders"},
+		CheckpointInterval: 50 * time.Millisecond,
+		PollInterval:       50 * time.Millisecond,
+	}
+	m, err := New(c)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(readAll(t, west, "east-orders", 2)) == 6
+	}, 5*time.Second, 50*time.Millisecond)
+	for _, r := range readAll(t, west, "east-orders", 2) {
+		require.Equal(t, "east", r.Headers[OriginHeader])
+	}
+	require.NoError(t, m.Close())
+
+	// restarting picks up from the checkpoints kept in the target
+	produce(t, east, "orders", 3, 2)
+	m, err = New(c)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(readAll(t, west, "east-orders", 2)) == 10
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Never(t, func() bool {
+		return len(readAll(t, west, "east-orders", 2)) != 10
+	}, 300*time.Millisecond, 50*time.Millisecond)
+	defer m.Close()
+
+	// mirroring back does not bring east's own records home again
+	produce(t, west, "east-orders", 0, 1)
+	back, err := New(Config{
+		Name:               "west-east",
+		SourceAddr:         westAddr,
+		SourceDialOptions:  dialOptions(),
+		TargetAddr:         eastAddr,
+		TargetDialOptions:  dialOptions(),
+		SourceCluster:      "west",
+		TargetCluster:      "east",
+		Topics:             []string{"east-orders"},
+		Rename:             map[string]string{"east-orders": "orders"},
+		CheckpointInterval: 50 * time.Millisecond,
+		PollInterval:       50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer back.Close()
+	require.Eventually(t, func() bool {
+		mirrored, skipped := back.Stats()
+		return mirrored == 2 && skipped == 10
+	}, 5*time.Second, 50*time.Millisecond)
+	// east got west's own records only, which east-west then skips
+	require.Len(t, readAll(t, east, "orders", 2), 12)
+	require.Eventually(t, func() bool {
+		_, skipped := m.Stats()
+		return skipped == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Len(t, readAll(t, west, "east-orders", 2), 12)
+}
+
+func TestCheckpointRetention(t *testing.T) {
+	east, eastAddr := setupCluster(t)
+	west, westAddr := setupCluster(t)
+	ctx := context.Background()
+	_, err := api.NewAdminClient(east).CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: 2},
+	})
+	require.NoError(t, err)
+
+	c := Config{
+		Name:               "east-west",
+		SourceAddr:         eastAddr,
+		SourceDialOptions:  dialOptions(),
+		TargetAddr:         westAddr,
+		TargetDialOptions:  dialOptions(),
+		SourceCluster:      "east",
+		TargetCluster:      "west",
+		Topics:             []string{"orders"},
+		CheckpointInterval: time.Hour,
+	}
+	m, err := New(c)
+	require.NoError(t, err)
+	require.Equal(t, DefaultCheckpointTopic+".east-west", m.CheckpointTopic)
+	// every store is a snapshot of all checkpoints
+	for i := uint64(1); i <= 2000; i++ {
+		m.mu.Lock()
+		m.checkpoints[checkpointKey("orders", 0)] = i
+		m.checkpoints[checkpointKey("orders", 1)] = 2 * i
+		m.mu.Unlock()
+		require.NoError(t, m.storeCheckpoints(ctx))
+	}
+	require.NoError(t, m.Close())
+
+	// retention dropped the older snapshots
+	peer := api.NewPeerClient(west)
+	require.Eventually(t, func() bool {
+		res, err := peer.GetDigests(ctx, &api.GetDigestsRequest{Topic: m.CheckpointTopic})
+		return err == nil && res.LowestOffset > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	m, err = New(c)
+	require.NoError(t, err)
+	defer m.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, map[string]uint64{"orders/0": 2000, "orders/1": 4000}, m.checkpoints)
+}
+
+// setupCluster starts a single server cluster.
+func setupCluster(t *testing.T) (*grpc.ClientConn, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "mirror_test")
+	require.NoError(t, err)
+	m, err := log.NewManager(dir, log.ManagerConfig{RetentionInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, cleanup, err := server.NewGRPCServer(m)
+	require.NoError(t, err)
+	go s.Serve(lst)
+	cc, err := grpc.Dial(lst.Addr().String(), dialOptions()...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cc.Close()
+		s.Stop()
+		cleanup()
+		m.Remove()
+	})
+	return cc, lst.Addr().String()
+}
+
+func dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+}
+
+// produce writes n records to every partition of a two partition topic.
+func produce(t *testing.T, cc *grpc.ClientConn, topic string, from, n int) {
+	t.Helper()
+	client := api.NewLogClient(cc)
+	for p := uint32(0); p < 2; p++ {
+		partition := p
+		for i := from; i < from+n; i++ {
+			_, err := client.Produce(context.Background(), &api.ProduceRequest{
+				Topic:     topic,
+				Partition: &partition,
+				Record:    &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			})
+			require.NoError(t, err)
+		}
+	}
+}
+
+func readAll(t *testing.T, cc *grpc.ClientConn, topic string, partitions uint32) []*api.Record {
+	t.Helper()
+	var records []*api.Record
+	client := api.NewLogClient(cc)
+	for p := uint32(0); p < partitions; p++ {
+		stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{
+			Topic:     topic,
+			Partition: p,
+		})
+		require.NoError(t, err)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				require.True(t, endOfLog(err), err)
+				break
+			}
+			records = append(records, res.Record)
+		}
+	}
+	return records
+}
@@ -0,0 +1,543 @@
+package placement
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const assignmentFile = "placement.json"
+
+// Partition identifies one partition of a topic.
+type Partition struct {
+	Topic string
+	ID    uint32
+}
+
+func (p Partition) String() string {
+	return fmt.Sprintf("%s/%d", p.Topic, p.ID)
+}
+
+// Member is a node partitions can be placed on.
+type Member struct {
+	Name    string
+	RPCAddr string
+	// Zone is the failure domain the member runs in, replicas of a
+	// partition are spread over as many zones as possible.
+	Zone string
+	// Rack breaks ties within a zone, replicas sharing a zone go to
+	// different racks when they can.
+	Rack string
+	// Draining members are given no partitions, so the ones they hold
+	// move to the others.
+	Draining bool
+	// LeaderEpoch is the epoch the member leads, zero when it leads
+	// none. The leader of the newest epoch takes every produce, so it
+	// is the primary replica of every partition.
+	LeaderEpoch uint64
+}
+
+// Mover does the data work decided by the engine.
+type Mover interface {
+	// Partitions lists the partitions found on the given members along
+	// with the names of the members holding them.
+	Partitions(members []Member) (map[Partition][]string, error)
+	// Fetch copies p onto the local node from one of from.
+	Fetch(p Partition, from []Member) error
+	// CaughtUp reports whether m holds everything the local node has of p.
+	CaughtUp(p Partition, m Member) (bool, error)
+	// Drop removes the local copy of p.
+	Drop(p Partition) error
+}
+
+type Config struct {
+	// Local is the node the engine runs on.
+	Local Member
+	// ReplicationFactor is how many members hold each partition.
+	ReplicationFactor int
+	// Dir is where the assignment is stored.
+	Dir string
+	// Interval is how often the engine reconciles without membership
+	// changes.
+	Interval time.Duration
+}
+
+// state is what the engine persists between restarts.
+type state struct {
+	// Assignment maps each partition onto the members replicating it,
+	// the first one being the primary.
+	Assignment map[string][]string
+	// Held are the partitions the local node has a complete copy of.
+	Held map[string]Partition
+}
+
+// Engine decides which members replicate which partitions using
+// rendezvous hashing, so every node computes the same assignment from
+// the same membership, and moves the local node's data to match it.
+type Engine struct {
+	Config
+
+	mu      sync.Mutex
+	mover   Mover
+	members map[string]Member
+	state   state
+	// holders are the members found holding each partition by the
+	// last reconcile.
+	holders map[Partition][]string
+	logger  *zap.Logger
+	trigger chan struct{}
+	close   chan struct{}
+	done    chan struct{}
+}
+
+func New(c Config, mover Mover) (*Engine, error) {
+	if c.ReplicationFactor == 0 {
+		c.ReplicationFactor = 3
+	}
+	if c.Interval == 0 {
+		c.Interval = 30 * time.Second
+	}
+	e := &Engine{
+		Config:  c,
+		mover:   mover,
+		members: map[string]Member{c.Local.Name: c.Local},
+		state: state{
+			Assignment: make(map[string][]string),
+			Held:       make(map[string]Partition),
+		},
+		logger:  zap.L().Named("placement"),
+		trigger: make(chan struct{}, 1),
+		close:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *Engine) load() error {
+	b, err := os.ReadFile(path.Join(e.Dir, assignmentFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var s state
+	if err = json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s.Assignment != nil {
+		e.state.Assignment = s.Assignment
+	}
+	if s.Held != nil {
+		e.state.Held = s.Held
+	}
+	return nil
+}
+
+// store writes the state next to the old one and renames it over, so a
+// crash never leaves a half written assignment behind.
+func (e *Engine) store() error {
+	b, err := json.Marshal(e.state)
+	if err != nil {
+		return err
+	}
+	name := path.Join(e.Dir, assignmentFile)
+	if err = os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Join, Update and Leave make the engine a discovery.Handler.
+func (e *Engine) Join(name, addr string) error {
+	e.mu.Lock()
+	m := e.members[name]
+	m.Name, m.RPCAddr = name, addr
+	e.members[name] = m
+	e.mu.Unlock()
+	e.Rebalance()
+	return nil
+}
+
+func (e *Engine) Update(name string, tags map[string]string) error {
+	next := Member{
+		Name:     name,
+		RPCAddr:  tags["rpc_addr"],
+		Zone:     tags["zone"],
+		Rack:     tags["rack"],
+		Draining: tags["draining"] == "true",
+	}
+	if tags["role"] == "leader" {
+		next.LeaderEpoch, _ = strconv.ParseUint(tags["epoch"], 10, 64)
+	}
+	e.mu.Lock()
+	m, OK := e.members[name]
+	changed := !OK || m != next
+	e.members[name] = next
+	e.mu.Unlock()
+	if changed {
+		e.Rebalance()
+	}
+	return nil
+}
+
+func (e *Engine) Leave(name string) error {
+	e.mu.Lock()
+	delete(e.members, name)
+	e.mu.Unlock()
+	e.Rebalance()
+	return nil
+}
+
+// Drain moves every partition off the local node, or with draining
+// false lets it take partitions again. The other members learn about it
+// through the draining tag.
+func (e *Engine) Drain(draining bool) {
+	e.mu.Lock()
+	e.Local.Draining = draining
+	e.members[e.Local.Name] = e.Local
+	e.mu.Unlock()
+	e.Rebalance()
+}
+
+// Lead makes the local node the primary of every partition while it
+// leads epoch, or with epoch zero gives that up. The other members learn
+// about it through the role and epoch tags.
+func (e *Engine) Lead(epoch uint64) {
+	e.mu.Lock()
+	e.Local.LeaderEpoch = epoch
+	e.members[e.Local.Name] = e.Local
+	e.mu.Unlock()
+	e.Rebalance()
+}
+
+// Rebalance asks the engine to reconcile as soon as possible.
+func (e *Engine) Rebalance() {
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Assignment returns the replicas of every known partition.
+func (e *Engine) Assignment() map[string][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a := make(map[string][]string, len(e.state.Assignment))
+	for p, replicas := range e.state.Assignment {
+		a[p] = append([]string(nil), replicas...)
+	}
+	return a
+}
+
+// Replicas returns the members assigned to p, primary first.
+func (e *Engine) Replicas(p Partition) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.state.Assignment[p.String()]...)
+}
+
+// Primary returns the first member assigned to p.
+func (e *Engine) Primary(p Partition) (Member, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	replicas := e.state.Assignment[p.String()]
+	if len(replicas) == 0 {
+		return Member{}, false
+	}
+	m, OK := e.members[replicas[0]]
+	return m, OK
+}
+
+// Writable reports whether the local node may append to p: it holds a
+// complete copy of p, or no other member holds any of it. A node that
+// lost or never had its copy takes no records until it caught up, so it
+// cannot reuse the offsets of the ones the others hold.
+func (e *Engine) Writable(p Partition) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, OK := e.state.Held[p.String()]; OK {
+		return true
+	}
+	for _, name := range e.holders[p] {
+		if name != e.Local.Name {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Engine) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	e.reconcile()
+	for {
+		select {
+		case <-e.close:
+			return
+		case <-ticker.C:
+		case <-e.trigger:
+		}
+		e.reconcile()
+	}
+}
+
+func (e *Engine) reconcile() {
+	e.mu.Lock()
+	members := make([]Member, 0, len(e.members))
+	for _, m := range e.members {
+		members = append(members, m)
+	}
+	e.mu.Unlock()
+
+	holders, err := e.mover.Partitions(members)
+	if err != nil {
+		e.logger.Error("failed to list partitions", zap.Error(err))
+		return
+	}
+
+	var candidates []Member
+	for _, m := range members {
+		if !m.Draining {
+			candidates = append(candidates, m)
+		}
+	}
+
+	e.mu.Lock()
+	e.holders = holders
+	prev := e.state.Assignment
+	// partitions only unreachable members hold keep their replicas
+	// until those members come back or leave
+	next := make(map[string][]string, len(prev)+len(holders))
+	for p, replicas := range prev {
+		next[p] = replicas
+	}
+	for p := range holders {
+		next[p.String()] = place(p, candidates, e.ReplicationFactor)
+	}
+	e.state.Assignment = next
+	if err = e.store(); err != nil {
+		e.logger.Error("failed to store assignment", zap.Error(err))
+	}
+	e.mu.Unlock()
+
+	byName := make(map[string]Member, len(members))
+	for _, m := range members {
+		byName[m.Name] = m
+	}
+	for p, h := range holders {
+		e.move(p, h, prev[p.String()], next[p.String()], byName)
+	}
+}
+
+// move brings the local copy of p in line with its replicas.
+func (e *Engine) move(p Partition, holders, prev, next []string, members map[string]Member) {
+	e.mu.Lock()
+	_, held := e.state.Held[p.String()]
+	e.mu.Unlock()
+	assigned := contains(next, e.Local.Name)
+
+	switch {
+	case assigned && !held:
+		// copy from the members holding it, falling back to whoever was
+		// assigned it before, from our own zone first
+		var from []Member
+		for _, names := range [][]string{holders, prev} {
+			for _, name := range names {
+				if m, OK := members[name]; OK && name != e.Local.Name && !containsMember(from, name) {
+					from = append(from, m)
+				}
+			}
+		}
+		sort.SliceStable(from, func(i, j int) bool {
+			return from[i].Zone == e.Local.Zone && from[j].Zone != e.Local.Zone
+		})
+		if len(from) > 0 {
+			if err := e.mover.Fetch(p, from); err != nil {
+				e.logger.Error("failed to fetch partition", zap.Error(err), zap.String("partition", p.String()))
+				return
+			}
+		} else if !contains(holders, e.Local.Name) {
+			// nobody alive has it and neither do we, wait for them
+			return
+		}
+		e.setHeld(p, true)
+	case assigned && held:
+		// keep following the primary, appending what it took since. The
+		// primary itself picks up what other holders took while the
+		// partition moved.
+		var from []Member
+		if next[0] == e.Local.Name {
+			for _, name := range holders {
+				if m, OK := members[name]; OK && name != e.Local.Name {
+					from = append(from, m)
+				}
+			}
+		} else if primary, OK := members[next[0]]; OK {
+			from = append(from, primary)
+		}
+		for _, m := range from {
+			if err := e.mover.Fetch(p, []Member{m}); err != nil {
+				e.logger.Warn("failed to sync partition", zap.Error(err), zap.String("partition", p.String()))
+			}
+		}
+	case !assigned && (held || contains(holders, e.Local.Name)):
+		// only let go once every new replica has what we have
+		for _, name := range next {
+			m, OK := members[name]
+			if !OK {
+				return
+			}
+			caughtUp, err := e.mover.CaughtUp(p, m)
+			if err != nil || !caughtUp {
+				return
+			}
+		}
+		if err := e.mover.Drop(p); err != nil {
+			e.logger.Error("failed to drop partition", zap.Error(err), zap.String("partition", p.String()))
+			return
+		}
+		e.setHeld(p, false)
+	}
+}
+
+func (e *Engine) setHeld(p Partition, held bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if held {
+		e.state.Held[p.String()] = p
+	} else {
+		delete(e.state.Held, p.String())
+	}
+	if err := e.store(); err != nil {
+		e.logger.Error("failed to store assignment", zap.Error(err))
+	}
+}
+
+// Held reports whether the local node holds a complete copy of p.
+func (e *Engine) Held(p Partition) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, OK := e.state.Held[p.String()]
+	return OK
+}
+
+func (e *Engine) Close() error {
+	select {
+	case <-e.close:
+		return nil
+	default:
+	}
+	close(e.close)
+	<-e.done
+	return nil
+}
+
+// place picks the rf members with the highest rendezvous score for p,
+// taking the best member of each zone before a second one of any zone,
+// and the best member of each rack before a second one of any rack.
+// Members without a zone or rack count as zones or racks of their own.
+// The leader of the newest epoch goes first, whatever its score.
+func place(p Partition, members []Member, rf int) []string {
+	type scored struct {
+		name  string
+		zone  string
+		rack  string
+		score uint64
+	}
+	scores := make([]scored, 0, len(members))
+	var leader *scored
+	var newest uint64
+	for _, m := range members {
+		scores = append(scores, scored{m.Name, m.Zone, m.Rack, score(p, m.Name)})
+		if m.LeaderEpoch > newest {
+			leader, newest = &scored{m.Name, m.Zone, m.Rack, 0}, m.LeaderEpoch
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score == scores[j].score {
+			return scores[i].name < scores[j].name
+		}
+		return scores[i].score > scores[j].score
+	})
+	if rf > len(scores) {
+		rf = len(scores)
+	}
+	replicas := make([]string, 0, rf)
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	take := func(s scored) {
+		replicas = append(replicas, s.name)
+		zones[s.zone] = true
+		racks[s.zone+"/"+s.rack] = true
+	}
+	if leader != nil && rf > 0 {
+		take(*leader)
+	}
+	for _, s := range scores {
+		if len(replicas) == rf {
+			break
+		}
+		if contains(replicas, s.name) || s.zone != "" && zones[s.zone] {
+			continue
+		}
+		take(s)
+	}
+	// fewer zones than replicas, fill up from the racks not used yet
+	for _, s := range scores {
+		if len(replicas) == rf {
+			break
+		}
+		if contains(replicas, s.name) || s.rack != "" && racks[s.zone+"/"+s.rack] {
+			continue
+		}
+		take(s)
+	}
+	// and then with the best of the rest
+	for _, s := range scores {
+		if len(replicas) == rf {
+			break
+		}
+		if !contains(replicas, s.name) {
+			take(s)
+		}
+	}
+	return replicas
+}
+
+func score(p Partition, member string) uint64 {
+	h := sha256.Sum256([]byte(p.String() + "\x00" + member))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMember(members []Member, name string) bool {
+	for _, m := range members {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,485 @@
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlace(t *testing.T) {
+	members := []Member{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	p := Partition{Topic: "orders", ID: 1}
+
+	replicas := place(p, members, 2)
+	require.Len(t, replicas, 2)
+	require.NotEqual(t, replicas[0], replicas[1])
+
+	// the order members are seen in does not matter
+	reversed := []Member{members[3], members[2], members[1], members[0]}
+	require.Equal(t, replicas, place(p, reversed, 2))
+
+	// removing a member that is not a replica moves nothing
+	var rest []Member
+	for _, m := range members {
+		if !contains(replicas, m.Name) {
+			rest = append(rest, m)
+			break
+		}
+	}
+	for _, m := range members {
+		if contains(replicas, m.Name) {
+			rest = append(rest, m)
+		}
+	}
+	require.Equal(t, replicas, place(p, rest, 2))
+
+	require.Len(t, place(p, members[:1], 3), 1)
+}
+
+func TestPlaceLeaderFirst(t *testing.T) {
+	members := []Member{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	for id := uint32(0); id < 8; id++ {
+		p := Partition{Topic: "orders", ID: id}
+		// lead with the member the partition would go to last
+		var last string
+		for _, m := range members {
+			if !contains(place(p, members, 3), m.Name) {
+				last = m.Name
+			}
+		}
+		led := append([]Member(nil), members...)
+		for i := range led {
+			switch led[i].Name {
+			case last:
+				led[i].LeaderEpoch = 2
+			case "a", "b":
+				// stale leaders of older epochs do not count
+				led[i].LeaderEpoch = 1
+			}
+		}
+		replicas := place(p, led, 3)
+		require.Len(t, replicas, 3)
+		require.Equal(t, last, replicas[0])
+		require.Len(t, place(p, led, 1), 1)
+		require.Equal(t, last, place(p, led, 1)[0])
+	}
+}
+
+func TestPlaceAcrossZones(t *testing.T) {
+	members := []Member{
+		{Name: "a", Zone: "east"},
+		{Name: "b", Zone: "east"},
+		{Name: "c", Zone: "east"},
+		{Name: "d", Zone: "west"},
+		{Name: "e", Zone: "west"},
+	}
+	zone := make(map[string]string)
+	for _, m := range members {
+		zone[m.Name] = m.Zone
+	}
+	for id := uint32(0); id < 50; id++ {
+		p := Partition{Topic: "orders", ID: id}
+		replicas := place(p, members, 3)
+		require.Len(t, replicas, 3)
+		seen := map[string]int{}
+		for _, r := range replicas {
+			seen[zone[r]]++
+		}
+		// both zones hold a copy whatever the hash says
+		require.Equal(t, 2, len(seen), "partition %d: %v", id, replicas)
+	}
+}
+
+func TestPlaceAcrossRacks(t *testing.T) {
+	members := []Member{
+		{Name: "a", Zone: "east", Rack: "r1"},
+		{Name: "b", Zone: "east", Rack: "r1"},
+		{Name: "c", Zone: "east", Rack: "r1"},
+		{Name: "d", Zone: "east", Rack: "r2"},
+		{Name: "e", Zone: "east", Rack: "r3"},
+	}
+	rack := make(map[string]string)
+	for _, m := range members {
+		rack[m.Name] = m.Rack
+	}
+	for id := uint32(0); id < 50; id++ {
+		p := Partition{Topic: "orders", ID: id}
+		replicas := place(p, members, 3)
+		require.Len(t, replicas, 3)
+		seen := map[string]bool{}
+		for _, r := range replicas {
+			seen[rack[r]] = true
+		}
+		// one zone, so the racks keep the replicas apart
+		require.Len(t, seen, 3, "partition %d: %v", id, replicas)
+	}
+
+	// more replicas than racks still fills up
+	require.Len(t, place(Partition{Topic: "orders"}, members[:3], 2), 2)
+}
+
+func TestConvergesAfterChurn(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.close()
+
+	c.add("node-0")
+	c.mu.Lock()
+	for i := uint32(0); i < 6; i++ {
+		c.nodes["node-0"].data[Partition{Topic: "orders", ID: i}] = 10
+	}
+	c.mu.Unlock()
+	c.add("node-1")
+	c.add("node-2")
+	c.requireConverged(6)
+
+	c.add("node-3")
+	c.add("node-4")
+	c.requireConverged(6)
+
+	// with two replicas the cluster survives losing one node at a time
+	c.remove("node-0")
+	c.requireConverged(6)
+	c.remove("node-3")
+	c.requireConverged(6)
+}
+
+func TestDrain(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.close()
+
+	c.add("node-0")
+	c.mu.Lock()
+	for i := uint32(0); i < 4; i++ {
+		c.nodes["node-0"].data[Partition{Topic: "orders", ID: i}] = 10
+	}
+	c.mu.Unlock()
+	c.add("node-1")
+	c.add("node-2")
+	c.requireConverged(4)
+
+	c.nodes["node-1"].engine.Drain(true)
+	for _, n := range c.alive() {
+		if n.name != "node-1" {
+			n.engine.Update("node-1", map[string]string{
+				"rpc_addr": "node-1",
+				"draining": "true",
+			})
+		}
+	}
+	c.requireConverged(4)
+	c.mu.Lock()
+	require.Empty(t, c.nodes["node-1"].data)
+	c.mu.Unlock()
+	for _, replicas := range c.nodes["node-0"].engine.Assignment() {
+		require.NotContains(t, replicas, "node-1")
+	}
+}
+
+func TestAssignmentIsDurable(t *testing.T) {
+	dir, err := os.MkdirTemp("", "placement_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := Partition{Topic: "orders", ID: 0}
+	mover := &staticMover{holders: map[Partition][]string{p: {"a"}}}
+	c := Config{Local: Member{Name: "a"}, Dir: dir, Interval: time.Hour}
+	e, err := New(c, mover)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return e.Held(p)
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, e.Close())
+
+	mover.holders = nil
+	e, err = New(c, &staticMover{err: errors.New("offline")})
+	require.NoError(t, err)
+	defer e.Close()
+	require.Equal(t, map[string][]string{"orders/0": {"a"}}, e.Assignment())
+	require.True(t, e.Held(p))
+}
+
+func TestAssignmentKeepsUnreachablePartitions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "placement_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := Partition{Topic: "orders", ID: 0}
+	c := Config{Local: Member{Name: "a"}, Dir: dir, Interval: time.Hour}
+	e, err := New(c, &staticMover{holders: map[Partition][]string{p: {"a", "b"}}})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return e.Held(p)
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, e.Close())
+
+	// b holding orders/0 is unreachable now, its replicas stay as they
+	// were next to the new partition
+	q := Partition{Topic: "payments", ID: 0}
+	e, err = New(c, &staticMover{holders: map[Partition][]string{q: {"a"}}})
+	require.NoError(t, err)
+	defer e.Close()
+	require.Eventually(t, func() bool {
+		return len(e.Assignment()) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a"}, e.Replicas(p))
+}
+
+func TestHeldPartitionsFollowThePrimary(t *testing.T) {
+	dir, err := os.MkdirTemp("", "placement_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := Partition{Topic: "orders", ID: 0}
+	// a member the partition prefers over the local node
+	primary := "a"
+	for i := 0; score(p, primary) < score(p, "b"); i++ {
+		primary = fmt.Sprintf("a%d", i)
+	}
+	mover := &staticMover{holders: map[Partition][]string{p: {primary}}}
+	e, err := New(Config{
+		Local:             Member{Name: "b"},
+		ReplicationFactor: 2,
+		Dir:               dir,
+		Interval:          10 * time.Millisecond,
+	}, mover)
+	require.NoError(t, err)
+	defer e.Close()
+	e.Join(primary, primary)
+
+	require.Eventually(t, func() bool {
+		return e.Held(p) && mover.fetched() > 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPrimaryCatchesUpWithHolders(t *testing.T) {
+	dir, err := os.MkdirTemp("", "placement_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := Partition{Topic: "orders", ID: 0}
+	// a member the partition ranks below the local node
+	other := "a"
+	for i := 0; score(p, other) > score(p, "b"); i++ {
+		other = fmt.Sprintf("a%d", i)
+	}
+	mover := &staticMover{holders: map[Partition][]string{p: {other}}}
+	e, err := New(Config{
+		Local:             Member{Name: "b"},
+		ReplicationFactor: 2,
+		Dir:               dir,
+		Interval:          10 * time.Millisecond,
+	}, mover)
+	require.NoError(t, err)
+	defer e.Close()
+	e.Join(other, other)
+
+	require.Eventually(t, func() bool {
+		replicas := e.Replicas(p)
+		return len(replicas) == 2 && replicas[0] == "b" && e.Held(p) && mover.fetched() > 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+type staticMover struct {
+	holders map[Partition][]string
+	err     error
+
+	mu      sync.Mutex
+	fetches int
+}
+
+func (m *staticMover) Partitions([]Member) (map[Partition][]string, error) {
+	return m.holders, m.err
+}
+
+func (m *staticMover) Fetch(Partition, []Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches++
+	return nil
+}
+
+func (m *staticMover) fetched() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fetches
+}
+
+func (m *staticMover) CaughtUp(Partition, Member) (bool, error) {
+	return true, nil
+}
+
+func (m *staticMover) Drop(Partition) error {
+	return nil
+}
+
+// cluster is an in-process set of engines whose data moves through fake
+// movers, so convergence can be checked without any networking.
+type cluster struct {
+	t     *testing.T
+	rf    int
+	mu    sync.Mutex
+	nodes map[string]*node
+}
+
+type node struct {
+	name   string
+	dir    string
+	engine *Engine
+	data   map[Partition]int
+}
+
+func newCluster(t *testing.T, rf int) *cluster {
+	return &cluster{t: t, rf: rf, nodes: make(map[string]*node)}
+}
+
+func (c *cluster) add(name string) {
+	dir, err := os.MkdirTemp("", "placement_test")
+	require.NoError(c.t, err)
+	n := &node{name: name, dir: dir, data: make(map[Partition]int)}
+	c.mu.Lock()
+	c.nodes[name] = n
+	c.mu.Unlock()
+	n.engine, err = New(Config{
+		Local:             Member{Name: name},
+		ReplicationFactor: c.rf,
+		Dir:               dir,
+		Interval:          20 * time.Millisecond,
+	}, &mover{c: c, local: name})
+	require.NoError(c.t, err)
+
+	for _, other := range c.alive() {
+		if other.name == name {
+			continue
+		}
+		other.engine.Join(name, name)
+		n.engine.Join(other.name, other.name)
+	}
+}
+
+func (c *cluster) remove(name string) {
+	c.mu.Lock()
+	n := c.nodes[name]
+	delete(c.nodes, name)
+	c.mu.Unlock()
+	n.engine.Close()
+	os.RemoveAll(n.dir)
+	for _, other := range c.alive() {
+		other.engine.Leave(name)
+	}
+}
+
+func (c *cluster) alive() []*node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func (c *cluster) close() {
+	for _, n := range c.alive() {
+		c.remove(n.name)
+	}
+}
+
+// requireConverged waits until every engine agrees on the assignment and
+// every partition lives exactly on its replicas with all of its data.
+func (c *cluster) requireConverged(partitions int) {
+	c.t.Helper()
+	require.Eventually(c.t, func() bool {
+		nodes := c.alive()
+		want := nodes[0].engine.Assignment()
+		if len(want) != partitions {
+			return false
+		}
+		for _, n := range nodes[1:] {
+			if fmt.Sprint(n.engine.Assignment()) != fmt.Sprint(want) {
+				return false
+			}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for p, replicas := range want {
+			if len(replicas) != c.rf {
+				return false
+			}
+			var holders []string
+			for _, n := range c.nodes {
+				for dp, records := range n.data {
+					if dp.String() == p && records == 10 {
+						holders = append(holders, n.name)
+					}
+				}
+			}
+			sort.Strings(holders)
+			sorted := append([]string(nil), replicas...)
+			sort.Strings(sorted)
+			if fmt.Sprint(holders) != fmt.Sprint(sorted) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+type mover struct {
+	c     *cluster
+	local string
+}
+
+func (m *mover) Partitions(members []Member) (map[Partition][]string, error) {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	holders := make(map[Partition][]string)
+	for _, member := range members {
+		n, OK := m.c.nodes[member.Name]
+		if !OK {
+			continue
+		}
+		for p := range n.data {
+			holders[p] = append(holders[p], n.name)
+		}
+	}
+	return holders, nil
+}
+
+func (m *mover) Fetch(p Partition, from []Member) error {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	local, OK := m.c.nodes[m.local]
+	if !OK {
+		return errors.New("local node is gone")
+	}
+	for _, f := range from {
+		if n, OK := m.c.nodes[f.Name]; OK && n.data[p] > 0 {
+			local.data[p] = n.data[p]
+			return nil
+		}
+	}
+	return errors.New("no replica to fetch from")
+}
+
+func (m *mover) CaughtUp(p Partition, member Member) (bool, error) {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	n, OK := m.c.nodes[member.Name]
+	if !OK {
+		return false, errors.New("member is gone")
+	}
+	return n.data[p] >= m.c.nodes[m.local].data[p], nil
+}
+
+func (m *mover) Drop(p Partition) error {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	delete(m.c.nodes[m.local].data, p)
+	return nil
+}
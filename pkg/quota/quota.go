@@ -0,0 +1,371 @@
+// Package quota admits produces against per client token buckets, on
+// records and bytes per second, keyed by the identity the auth package
+// puts in the request context.
+//
+// Quotas are per server: each one holds the clients to the rates on the
+// produces it serves, keeping buckets and usage of its own, so a client
+// producing to n servers gets up to n times the rates.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/auth"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Rule limits what each client matching Subject produces, on the topics
+// matching Topic or on all topics together when it is empty. Both may
+// hold * wildcards, * alone matching anonymous clients too, and a zero
+// rate is unlimited. Every rule a produce matches applies to it, each
+// client and topic getting buckets of its own, so
+//
+//	[{"subject": "*", "records_per_second": 1000},
+//	 {"subject": "*", "topic": "audit", "bytes_per_second": 65536}]
+//
+// holds every client to 1000 records a second and to 64KiB a second on
+// the audit topic, on each server.
+type Rule struct {
+	Subject          string  `json:"subject" yaml:"subject"`
+	Topic            string  `json:"topic" yaml:"topic"`
+	RecordsPerSecond float64 `json:"records_per_second" yaml:"records_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second" yaml:"bytes_per_second"`
+}
+
+// Load reads a JSON or YAML list of rules, told apart by the file
+// extension.
+func Load(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = config.Unmarshal(path, b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, r := range rules {
+		if err = r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.Subject == "" {
+		return fmt.Errorf("quota needs a subject")
+	}
+	if r.RecordsPerSecond < 0 || r.BytesPerSecond < 0 {
+		return fmt.Errorf("quota of %s has a negative rate", r.Subject)
+	}
+	return nil
+}
+
+// idleAfter is how long the buckets and usage of a client are kept after
+// its last produce.
+const idleAfter = 10 * time.Minute
+
+// Limiter enforces rules on the produces of the clients it serves.
+type Limiter struct {
+	mu      sync.Mutex
+	rules   []Rule
+	buckets map[bucketKey]*bucket
+	usage   map[string]*usage
+	swept   time.Time
+	now     func() time.Time
+
+	records   metric.Int64Counter
+	bytes     metric.Int64Counter
+	throttled metric.Int64Counter
+}
+
+// bucketKey is the bucket of a rule for one client, and one topic when
+// the rule names topics.
+type bucketKey struct {
+	subject, topic  string
+	client, onTopic string
+	records         bool
+}
+
+// New returns a limiter enforcing rules, counting what clients produce
+// with the meters of mp, the global provider when nil.
+func New(rules []Rule, mp metric.MeterProvider) (*Limiter, error) {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter("github.com/larkiee/distributed_logger/pkg/quota")
+	l := &Limiter{
+		rules:   append([]Rule(nil), rules...),
+		buckets: make(map[bucketKey]*bucket),
+		usage:   make(map[string]*usage),
+		now:     time.Now,
+	}
+	var err error
+	if l.records, err = meter.Int64Counter("dlog.quota.records", metric.WithDescription("records produced per client")); err != nil {
+		return nil, err
+	}
+	if l.bytes, err = meter.Int64Counter("dlog.quota.bytes", metric.WithDescription("bytes produced per client"), metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if l.throttled, err = meter.Int64Counter("dlog.quota.throttled", metric.WithDescription("produces turned away per client")); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Set adds r, replacing the rule with the same subject and topic, which
+// is removed when r has no rates.
+func (l *Limiter) Set(r Rule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rules := l.rules[:0:0]
+	for _, old := range l.rules {
+		if old.Subject != r.Subject || old.Topic != r.Topic {
+			rules = append(rules, old)
+		}
+	}
+	if r.RecordsPerSecond > 0 || r.BytesPerSecond > 0 {
+		rules = append(rules, r)
+	}
+	l.rules = rules
+	// buckets of the old rates start over
+	for k := range l.buckets {
+		if k.subject == r.Subject && k.topic == r.Topic {
+			delete(l.buckets, k)
+		}
+	}
+	return nil
+}
+
+// Rules returns the rules enforced.
+func (l *Limiter) Rules() []Rule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Rule(nil), l.rules...)
+}
+
+// usage is what a client produced and when it last did.
+type usage struct {
+	records, bytes, throttled uint64
+	last                      time.Time
+}
+
+// Usage returns what each client produced, sorted by subject. Clients
+// idle for a while are forgotten.
+func (l *Limiter) Usage() []*api.ClientUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := make([]*api.ClientUsage, 0, len(l.usage))
+	for client, u := range l.usage {
+		usage = append(usage, &api.ClientUsage{
+			Subject:   client,
+			Records:   u.records,
+			Bytes:     u.bytes,
+			Throttled: u.throttled,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Subject < usage[j].Subject })
+	return usage
+}
+
+// Admit takes a record of size bytes produced by client to topic out of
+// the buckets of every rule it matches. When one of them is short nothing
+// is taken and Admit returns how long until the record fits.
+func (l *Limiter) Admit(client, topic string, size int) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) >= idleAfter {
+		l.sweep(now)
+	}
+	var buckets []*bucket
+	var costs []float64
+	for _, r := range l.rules {
+		if !auth.Match(r.Subject, client) || (r.Topic != "" && !auth.Match(r.Topic, topic)) {
+			continue
+		}
+		onTopic := ""
+		if r.Topic != "" {
+			onTopic = topic
+		}
+		if r.RecordsPerSecond > 0 {
+			buckets = append(buckets, l.bucket(bucketKey{r.Subject, r.Topic, client, onTopic, true}, r.RecordsPerSecond, now))
+			costs = append(costs, 1)
+		}
+		if r.BytesPerSecond > 0 {
+			buckets = append(buckets, l.bucket(bucketKey{r.Subject, r.Topic, client, onTopic, false}, r.BytesPerSecond, now))
+			costs = append(costs, float64(size))
+		}
+	}
+	for i, b := range buckets {
+		if wait := b.wait(costs[i]); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	u, OK := l.usage[client]
+	if !OK {
+		u = &usage{}
+		l.usage[client] = u
+	}
+	u.last = now
+	attrs := metric.WithAttributes(attribute.String("client", client))
+	if retryAfter > 0 {
+		u.throttled++
+		l.throttled.Add(context.Background(), 1, attrs)
+		return false, retryAfter
+	}
+	for i, b := range buckets {
+		b.take(costs[i])
+	}
+	u.records++
+	u.bytes += uint64(size)
+	l.records.Add(context.Background(), 1, attrs)
+	l.bytes.Add(context.Background(), int64(size), attrs)
+	return true, 0
+}
+
+// sweep drops the usage of clients idle for idleAfter, and their buckets
+// once full again, a new bucket being the same.
+func (l *Limiter) sweep(now time.Time) {
+	l.swept = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) < idleAfter {
+			continue
+		}
+		if b.refill(now); b.tokens >= math.Max(b.rate, 1) {
+			delete(l.buckets, k)
+		}
+	}
+	for client, u := range l.usage {
+		if now.Sub(u.last) >= idleAfter {
+			delete(l.usage, client)
+		}
+	}
+}
+
+func (l *Limiter) bucket(k bucketKey, rate float64, now time.Time) *bucket {
+	b, OK := l.buckets[k]
+	if !OK {
+		b = &bucket{rate: rate, tokens: math.Max(rate, 1), last: now}
+		l.buckets[k] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// bucket holds a second's worth of tokens. A record costing more than
+// the bucket holds is let through when it is full and leaves it in debt,
+// so large records are slowed down rather than never admitted.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(math.Max(b.rate, 1), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait is how long until the bucket has the tokens a record costing n
+// takes.
+func (b *bucket) wait(n float64) time.Duration {
+	need := math.Min(n, math.Max(b.rate, 1)) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(need / b.rate * float64(time.Second)))
+}
+
+func (b *bucket) take(n float64) {
+	b.tokens -= n
+}
+
+// check admits a produce request of the client in ctx.
+func (l *Limiter) check(ctx context.Context, req *api.ProduceRequest) error {
+	id, _ := auth.FromContext(ctx)
+	topic := req.Topic
+	if topic == "" {
+		topic = log.DefaultTopic
+	}
+	ok, retryAfter := l.Admit(id.Subject, topic, proto.Size(req.GetRecord()))
+	if ok {
+		return nil
+	}
+	st := status.Newf(codes.ResourceExhausted, "quota exceeded, retry after %v", retryAfter.Round(time.Millisecond))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// UnaryServerInterceptor admits produces, chained after the interceptors
+// of the auth package so it knows the client.
+func (l *Limiter) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if p, OK := req.(*api.ProduceRequest); OK {
+		if err := l.check(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor admits every record produced on a stream.
+func (l *Limiter) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if info.FullMethod != api.Log_ProduceStream_FullMethodName {
+		return handler(srv, ss)
+	}
+	return handler(srv, &limitedStream{ServerStream: ss, limiter: l})
+}
+
+type limitedStream struct {
+	grpc.ServerStream
+	limiter *Limiter
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if p, OK := m.(*api.ProduceRequest); OK {
+		return s.limiter.check(s.Context(), p)
+	}
+	return nil
+}
+
+// RetryAfter reads the retry hint of a ResourceExhausted error, false when
+// err has none.
+func RetryAfter(err error) (time.Duration, bool) {
+	for _, d := range status.Convert(err).Details() {
+		if info, OK := d.(*errdetails.RetryInfo); OK {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
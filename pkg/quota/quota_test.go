@@ -0,0 +1,112 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l, err := New([]Rule{
+		{Subject: "*", RecordsPerSecond: 2},
+		{Subject: "export", Topic: "audit-*", BytesPerSecond: 100},
+	}, nil)
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	// a second's worth of records, then a wait for the next one
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Admit("alice", "orders", 10)
+		require.True(t, ok)
+	}
+	ok, retryAfter := l.Admit("alice", "orders", 10)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+	// clients have buckets of their own
+	ok, _ = l.Admit("bob", "orders", 10)
+	require.True(t, ok)
+	now = now.Add(retryAfter)
+	ok, _ = l.Admit("alice", "orders", 10)
+	require.True(t, ok)
+
+	// topic rules apply on top of the others, each topic on its own, and
+	// a record larger than the bucket gets in and leaves it in debt
+	now = now.Add(time.Second)
+	ok, _ = l.Admit("export", "audit-eu", 150)
+	require.True(t, ok)
+	ok, retryAfter = l.Admit("export", "audit-eu", 10)
+	require.False(t, ok)
+	require.Equal(t, 600*time.Millisecond, retryAfter)
+	ok, _ = l.Admit("export", "audit-us", 10)
+	require.True(t, ok)
+	now = now.Add(time.Second)
+	ok, _ = l.Admit("export", "orders", 1000)
+	require.True(t, ok)
+
+	// rules change at runtime, rates of zero remove them
+	require.NoError(t, l.Set(Rule{Subject: "*", RecordsPerSecond: 1000}))
+	require.Len(t, l.Rules(), 2)
+	for i := 0; i < 10; i++ {
+		ok, _ = l.Admit("alice", "orders", 10)
+		require.True(t, ok)
+	}
+	require.NoError(t, l.Set(Rule{Subject: "export", Topic: "audit-*"}))
+	require.Equal(t, []Rule{{Subject: "*", RecordsPerSecond: 1000}}, l.Rules())
+	require.Error(t, l.Set(Rule{Subject: "*", BytesPerSecond: -1}))
+
+	usage := l.Usage()
+	require.Len(t, usage, 3)
+	require.Equal(t, "alice", usage[0].Subject)
+	require.Equal(t, uint64(13), usage[0].Records)
+	require.Equal(t, uint64(130), usage[0].Bytes)
+	require.Equal(t, uint64(1), usage[0].Throttled)
+}
+
+func TestLimiterForgetsIdleClients(t *testing.T) {
+	l, err := New([]Rule{{Subject: "*", BytesPerSecond: 100}}, nil)
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	// alice leaves her bucket deep in debt, bob a full one
+	ok, _ := l.Admit("alice", "orders", 100*int(idleAfter/time.Second)*2)
+	require.True(t, ok)
+	ok, _ = l.Admit("bob", "orders", 10)
+	require.True(t, ok)
+	now = now.Add(idleAfter)
+	ok, _ = l.Admit("carol", "orders", 10)
+	require.True(t, ok)
+	require.Len(t, l.buckets, 2)
+	require.Len(t, l.Usage(), 1)
+
+	// her bucket goes once it is full, she would get a full one anyway
+	now = now.Add(2 * idleAfter)
+	ok, _ = l.Admit("carol", "orders", 10)
+	require.True(t, ok)
+	require.Len(t, l.buckets, 1)
+	require.Equal(t, "carol", l.Usage()[0].Subject)
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "quotas.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- {subject: "*", records_per_second: 1000}
+- {subject: export, topic: audit, bytes_per_second: 65536}
+`), 0644))
+	rules, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, []Rule{
+		{Subject: "*", RecordsPerSecond: 1000},
+		{Subject: "export", Topic: "audit", BytesPerSecond: 65536},
+	}, rules)
+
+	path = filepath.Join(dir, "quotas.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"records_per_second": 1}]`), 0644))
+	_, err = Load(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	t := req.GetTopic()
+	topic, err := s.topics.CreateTopic(t.GetName(), TopicConfig(t))
+	if err != nil {
+		return nil, topicError(err)
+	}
+	return &api.CreateTopicResponse{Topic: apiTopic(topic)}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	if err := s.topics.DeleteTopic(req.Name); err != nil {
+		return nil, topicError(err)
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	var topics []*api.Topic
+	for _, t := range s.topics.Topics() {
+		topics = append(topics, apiTopic(t))
+	}
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}
+
+// TopicConfig is the log config described by an API topic.
+func TopicConfig(t *api.Topic) log.TopicConfig {
+	return log.TopicConfig{
+		Partitions: t.GetPartitions(),
+		Log: log.Config{
+			Segment: log.SegmentConfig{
+				MaxStoreBytes: t.GetMaxStoreBytes(),
+				MaxIndexBytes: t.GetMaxIndexBytes(),
+			},
+			Retention: log.RetentionConfig{
+				MaxBytes: t.GetRetentionBytes(),
+				MaxAge:   time.Duration(t.GetRetentionMs()) * time.Millisecond,
+			},
+		},
+	}
+}
+
+func apiTopic(t *log.Topic) *api.Topic {
+	c := t.Config.Log
+	return &api.Topic{
+		Name:           t.Name,
+		Partitions:     t.Config.Partitions,
+		MaxStoreBytes:  c.Segment.MaxStoreBytes,
+		MaxIndexBytes:  c.Segment.MaxIndexBytes,
+		RetentionBytes: c.Retention.MaxBytes,
+		RetentionMs:    c.Retention.MaxAge.Milliseconds(),
+	}
+}
+
+// topicError maps the topic and partition errors of the log package onto
+// gRPC codes.
+func topicError(err error) error {
+	switch {
+	case errors.Is(err, log.ErrTopicNotFound), errors.Is(err, log.ErrPartitionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, log.ErrTopicExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, log.ErrInvalidTopic):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, log.ErrDefaultTopic):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, log.ErrOffsetOutOfRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, log.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "admin_test")
+	require.NoError(t, err)
+	m, err := log.NewManager(dir, log.ManagerConfig{})
+	require.NoError(t, err)
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, cleanup, err := NewGRPCServer(m)
+	require.NoError(t, err)
+	go s.Serve(lst)
+	defer func() {
+		s.Stop()
+		cleanup()
+	}()
+
+	cc, err := grpc.Dial(
+		lst.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	admin := api.NewAdminClient(cc)
+	ctx := context.Background()
+
+	_, err = admin.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders", Partitions: 2, RetentionMs: 60000},
+	})
+	require.NoError(t, err)
+	_, err = admin.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "orders"},
+	})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	lRes, err := admin.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, lRes.Topics, 2)
+	require.Equal(t, "orders", lRes.Topics[1].Name)
+	require.Equal(t, int64(60000), lRes.Topics[1].RetentionMs)
+
+	partition := uint32(1)
+	pRes, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &partition,
+		Record:    &api.Record{Value: []byte("explicit")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), pRes.Partition)
+
+	// without a partition the key decides where the record goes
+	pRes, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{Value: []byte("keyed"), Key: []byte("k")},
+	})
+	require.NoError(t, err)
+	cRes, err := client.Consume(ctx, &api.ConsumeRequest{
+		Topic:     "orders",
+		Partition: pRes.Partition,
+		Offset:    pRes.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("keyed"), cRes.Record.Value)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: 5})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// streamed records are routed the same way
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &partition,
+		Record:    &api.Record{Value: []byte("streamed")},
+	}))
+	sRes, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), sRes.Partition)
+	cRes, err = client.Consume(ctx, &api.ConsumeRequest{
+		Topic:     "orders",
+		Partition: partition,
+		Offset:    sRes.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("streamed"), cRes.Record.Value)
+	require.NoError(t, stream.CloseSend())
+
+	_, err = admin.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: log.DefaultTopic})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = admin.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{Value: []byte("gone")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/discovery"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ServerGetter reports the servers that currently make up the cluster.
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// KeyManager changes the keys the cluster's gossip is encrypted with.
+// The ServerGetter given to RegisterClusterServer may implement it to
+// serve the key RPCs. A response is returned along with the error when
+// some of the members failed.
+type KeyManager interface {
+	InstallKey(key string) (*api.KeyResponse, error)
+	UseKey(key string) (*api.KeyResponse, error)
+	RemoveKey(key string) (*api.KeyResponse, error)
+	ListKeys() (*api.KeyResponse, error)
+}
+
+// Decommissioner takes a server out of the cluster without losing what
+// only it holds. The ServerGetter given to RegisterClusterServer may
+// implement it to serve the Decommission and Promote RPCs.
+type Decommissioner interface {
+	Decommission(ctx context.Context) (*api.DecommissionResponse, error)
+	Promote() error
+}
+
+// EpochReporter tells which leadership epoch a server is on. The
+// ServerGetter given to RegisterClusterServer may implement it to serve
+// the GetEpoch RPC.
+type EpochReporter interface {
+	Epoch() (epoch uint64, leader bool)
+}
+
+// QuotaManager changes the produce quotas of a server. The ServerGetter
+// given to RegisterClusterServer may implement it to serve the SetQuota
+// and GetQuotas RPCs.
+type QuotaManager interface {
+	SetQuota(q *api.Quota) error
+	GetQuotas() ([]*api.Quota, []*api.ClientUsage)
+}
+
+// TagReporter tells the tags a server advertises to the cluster. The
+// ServerGetter given to RegisterClusterServer may implement it to serve
+// the GetTags RPC.
+type TagReporter interface {
+	Tags() map[string]string
+}
+
+type clusterServer struct {
+	api.UnimplementedClusterServer
+	ServerGetter
+}
+
+// RegisterClusterServer exposes the cluster membership of g on gsrv so
+// clients can discover every server from a single address.
+func RegisterClusterServer(gsrv *grpc.Server, g ServerGetter) {
+	api.RegisterClusterServer(gsrv, &clusterServer{ServerGetter: g})
+}
+
+func (s *clusterServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	servers, err := s.ServerGetter.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *clusterServer) InstallKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyOp(func(km KeyManager) (*api.KeyResponse, error) {
+		return km.InstallKey(req.Key)
+	})
+}
+
+func (s *clusterServer) UseKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyOp(func(km KeyManager) (*api.KeyResponse, error) {
+		return km.UseKey(req.Key)
+	})
+}
+
+func (s *clusterServer) RemoveKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyOp(func(km KeyManager) (*api.KeyResponse, error) {
+		return km.RemoveKey(req.Key)
+	})
+}
+
+func (s *clusterServer) ListKeys(ctx context.Context, req *api.ListKeysRequest) (*api.KeyResponse, error) {
+	return s.keyOp(func(km KeyManager) (*api.KeyResponse, error) {
+		return km.ListKeys()
+	})
+}
+
+func (s *clusterServer) keyOp(op func(KeyManager) (*api.KeyResponse, error)) (*api.KeyResponse, error) {
+	km, OK := s.ServerGetter.(KeyManager)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "key management is not supported")
+	}
+	res, err := op(km)
+	if errors.Is(err, discovery.ErrInvalidKey) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, keyError(err, res))
+	}
+	return res, nil
+}
+
+// keyError adds what each failing member said to err.
+func keyError(err error, res *api.KeyResponse) string {
+	if res == nil || len(res.Messages) == 0 {
+		return err.Error()
+	}
+	msgs := make([]string, 0, len(res.Messages))
+	for node, msg := range res.Messages {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", node, msg))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("%v (%s)", err, strings.Join(msgs, "; "))
+}
+
+func (s *clusterServer) Decommission(ctx context.Context, req *api.DecommissionRequest) (*api.DecommissionResponse, error) {
+	d, OK := s.ServerGetter.(Decommissioner)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "decommission is not supported")
+	}
+	return d.Decommission(ctx)
+}
+
+func (s *clusterServer) Promote(ctx context.Context, req *api.PromoteRequest) (*api.PromoteResponse, error) {
+	d, OK := s.ServerGetter.(Decommissioner)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "promote is not supported")
+	}
+	if err := d.Promote(); err != nil {
+		return nil, err
+	}
+	return &api.PromoteResponse{}, nil
+}
+
+func (s *clusterServer) GetEpoch(ctx context.Context, req *api.GetEpochRequest) (*api.GetEpochResponse, error) {
+	r, OK := s.ServerGetter.(EpochReporter)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "epochs are not supported")
+	}
+	epoch, leader := r.Epoch()
+	return &api.GetEpochResponse{Epoch: epoch, Leader: leader}, nil
+}
+
+func (s *clusterServer) GetTags(ctx context.Context, req *api.GetTagsRequest) (*api.GetTagsResponse, error) {
+	r, OK := s.ServerGetter.(TagReporter)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "tags are not supported")
+	}
+	return &api.GetTagsResponse{Tags: r.Tags()}, nil
+}
+
+func (s *clusterServer) SetQuota(ctx context.Context, req *api.SetQuotaRequest) (*api.SetQuotaResponse, error) {
+	m, OK := s.ServerGetter.(QuotaManager)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "quotas are not supported")
+	}
+	if req.Quota == nil {
+		return nil, status.Error(codes.InvalidArgument, "quota is missing")
+	}
+	if err := m.SetQuota(req.Quota); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &api.SetQuotaResponse{}, nil
+}
+
+func (s *clusterServer) GetQuotas(ctx context.Context, req *api.GetQuotasRequest) (*api.GetQuotasResponse, error) {
+	m, OK := s.ServerGetter.(QuotaManager)
+	if !OK {
+		return nil, status.Error(codes.Unimplemented, "quotas are not supported")
+	}
+	quotas, clients := m.GetQuotas()
+	return &api.GetQuotasResponse{Quotas: quotas, Clients: clients}, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetPartitions reports the partitions this node hosts and how far each
+// of them goes, so peers can decide what to copy from where.
+func (s *grpcServer) GetPartitions(ctx context.Context, req *api.GetPartitionsRequest) (*api.GetPartitionsResponse, error) {
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	var partitions []*api.PartitionInfo
+	for _, t := range s.topics.Topics() {
+		for i := uint32(0); i < t.Config.Partitions; i++ {
+			l, err := t.Partition(i)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, &api.PartitionInfo{
+				Topic:      t.Name,
+				Partition:  i,
+				NextOffset: l.NextOffset(),
+			})
+		}
+	}
+	return &api.GetPartitionsResponse{Partitions: partitions}, nil
+}
+
+// GetDigests hashes the requested offset ranges of a partition, clipped
+// to the records this node holds, so replicas can find where they
+// disagree without sending the records themselves.
+func (s *grpcServer) GetDigests(ctx context.Context, req *api.GetDigestsRequest) (*api.GetDigestsResponse, error) {
+	l, err := s.partitionLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetDigestsResponse{
+		LowestOffset: l.LowestOffset(),
+		NextOffset:   l.NextOffset(),
+	}
+	for _, r := range req.Ranges {
+		from := max(r.From, res.LowestOffset)
+		to := min(r.To, res.NextOffset)
+		if from >= to {
+			continue
+		}
+		checksum, err := l.Digest(from, to)
+		if err != nil {
+			return nil, err
+		}
+		res.Digests = append(res.Digests, &api.RangeDigest{
+			Range:    &api.OffsetRange{From: from, To: to},
+			Checksum: checksum,
+		})
+	}
+	return res, nil
+}
+
+// partitionLog looks a partition up, the empty topic being the default
+// one.
+func (s *grpcServer) partitionLog(topic string, partition uint32) (*log.Log, error) {
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	if topic == "" {
+		topic = log.DefaultTopic
+	}
+	l, err := s.topics.Partition(topic, partition)
+	if err != nil {
+		return nil, topicError(err)
+	}
+	return l, nil
+}
+
+// FetchSegments streams the sealed segment files of a partition so new
+// or lagging replicas can catch up without replaying every record.
+func (s *grpcServer) FetchSegments(req *api.FetchSegmentsRequest, stream api.Peer_FetchSegmentsServer) error {
+	l, err := s.partitionLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	return l.ExportSegments(req.FromOffset, stream.Send)
+}
+
+// GetEpochEnd tells a follower where an epoch ended on this node, so it
+// can drop the records it got from a leader that was replaced.
+func (s *grpcServer) GetEpochEnd(ctx context.Context, req *api.GetEpochEndRequest) (*api.GetEpochEndResponse, error) {
+	l, err := s.partitionLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	end, err := l.EpochEnd(req.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetEpochEndResponse{EndOffset: end}, nil
+}
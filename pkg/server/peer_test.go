@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	authority, authorityAddr := setupManagerServer(t)
+	replica, _ := setupManagerServer(t)
+
+	for _, m := range []*log.Manager{authority, replica} {
+		_, err := m.CreateTopic("orders", log.TopicConfig{
+			Partitions: 1,
+			Log: log.Config{
+				Segment: log.SegmentConfig{MaxIndexBytes: 4 * 12},
+			},
+		})
+		require.NoError(t, err)
+	}
+	a, err := authority.Partition("orders", 0)
+	require.NoError(t, err)
+	r, err := replica.Partition("orders", 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		rec := fmt.Sprintf("record %d", i)
+		_, err = a.Append(&api.Record{Value: []byte(rec)})
+		require.NoError(t, err)
+		// the replica silently lost records 6 and on and made up others
+		if i >= 6 {
+			rec = "corrupted"
+		}
+		_, err = r.Append(&api.Record{Value: []byte(rec)})
+		require.NoError(t, err)
+	}
+	_, err = r.Append(&api.Record{Value: []byte("extra")})
+	require.NoError(t, err)
+
+	ae := &log.AntiEntropy{
+		Log: replica,
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		Authority: func(topic string, partition uint32) string {
+			if topic == "orders" {
+				return authorityAddr
+			}
+			return ""
+		},
+	}
+	defer ae.Close()
+
+	report := ae.Run()
+	require.Equal(t, log.RepairReport{
+		Partitions: 1,
+		Diverged:   1,
+		Removed:    5,
+		Fetched:    4,
+	}, report)
+	require.Equal(t, a.NextOffset(), r.NextOffset())
+	for off := uint64(0); off < a.NextOffset(); off++ {
+		want, err := a.Read(off)
+		require.NoError(t, err)
+		got, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// once repaired there is nothing left to do
+	require.Equal(t, log.RepairReport{Partitions: 1}, ae.Run())
+	require.Equal(t, 1, ae.Total().Diverged)
+}
+
+func TestFetchSegments(t *testing.T) {
+	leader, leaderAddr := setupManagerServer(t)
+	follower, _ := setupManagerServer(t)
+
+	segment := log.SegmentConfig{MaxIndexBytes: 4 * 12}
+	for _, m := range []*log.Manager{leader, follower} {
+		_, err := m.CreateTopic("orders", log.TopicConfig{
+			Partitions: 1,
+			Log:        log.Config{Segment: segment},
+		})
+		require.NoError(t, err)
+	}
+	l, err := leader.Partition("orders", 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	f, err := follower.Partition("orders", 0)
+	require.NoError(t, err)
+	// the follower has part of the first segment already
+	_, err = f.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(leaderAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewPeerClient(cc)
+
+	n, err := log.FetchSegments(context.Background(), client, f, "orders", 0)
+	require.NoError(t, err)
+	// records 0-3 and 4-7 are sealed, 8 and 9 are left for streaming
+	require.Equal(t, 2, n)
+	require.Equal(t, uint64(8), f.NextOffset())
+	for off := uint64(0); off < f.NextOffset(); off++ {
+		got, err := f.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(got.Value))
+	}
+	off, err := f.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+
+	// the installed segments survive a restart
+	require.NoError(t, f.Close())
+	f, err = log.NewLog(f.Dir, log.Config{Segment: segment})
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, uint64(9), f.NextOffset())
+	got, err := f.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, "record 5", string(got.Value))
+
+	// segments that do not line up with the local log are left alone
+	_, err = follower.CreateTopic("payments", log.TopicConfig{
+		Partitions: 1,
+		Log:        log.Config{Segment: log.SegmentConfig{MaxIndexBytes: 3 * 12}},
+	})
+	require.NoError(t, err)
+	p, err := follower.Partition("payments", 0)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = p.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	n, err = log.FetchSegments(context.Background(), client, p, "orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, uint64(4), p.NextOffset())
+}
+
+func TestTruncateDiverged(t *testing.T) {
+	leader, leaderAddr := setupManagerServer(t)
+	follower, _ := setupManagerServer(t)
+	l, err := leader.Partition(log.DefaultTopic, 0)
+	require.NoError(t, err)
+	f, err := follower.Partition(log.DefaultTopic, 0)
+	require.NoError(t, err)
+
+	// both got records 0-2 in epoch 1, then the follower led epoch 2 on
+	// its own for a while and the leader took over in epoch 3 at offset 3
+	epochs := map[*log.Log][]uint64{
+		l: {1, 1, 1, 3, 3},
+		f: {1, 1, 1, 2, 2, 2},
+	}
+	for lg, es := range epochs {
+		for i, epoch := range es {
+			_, err = lg.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Epoch: epoch})
+			require.NoError(t, err)
+		}
+	}
+	end, err := l.EpochEnd(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), end)
+	end, err = l.EpochEnd(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), end)
+
+	cc, err := grpc.Dial(leaderAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	removed, err := log.TruncateDiverged(context.Background(), api.NewPeerClient(cc), f, log.DefaultTopic, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), removed)
+	require.Equal(t, uint64(3), f.NextOffset())
+	epoch, err := f.LastEpoch()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch)
+
+	// nothing left to drop
+	removed, err = log.TruncateDiverged(context.Background(), api.NewPeerClient(cc), f, log.DefaultTopic, 0)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func TestReplicatorFollowsMovedPeer(t *testing.T) {
+	leader, _ := setupManagerServer(t)
+	follower, _ := setupManagerServer(t)
+
+	// the leader is served on two addresses, as if it restarted on a
+	// new port once the first one stops
+	var addrs []string
+	var servers []*grpc.Server
+	for i := 0; i < 2; i++ {
+		lst, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s, cleanup, err := NewGRPCServer(leader)
+		require.NoError(t, err)
+		go s.Serve(lst)
+		t.Cleanup(func() {
+			s.Stop()
+			cleanup()
+		})
+		addrs = append(addrs, lst.Addr().String())
+		servers = append(servers, s)
+	}
+
+	r := &log.Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		Local:       follower,
+	}
+	defer r.Close()
+	require.NoError(t, r.Join("leader", addrs[0]))
+	f, err := follower.Partition(log.DefaultTopic, 0)
+	require.NoError(t, err)
+
+	_, err = leader.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.NextOffset() == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	servers[0].Stop()
+	require.NoError(t, r.Update("leader", map[string]string{"rpc_addr": addrs[1]}))
+	_, err = leader.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.NextOffset() == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	rec, err := f.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), rec.Value)
+}
+
+func TestReplicatorCopiesSegmentsNearby(t *testing.T) {
+	leader, leaderAddr := setupManagerServer(t)
+	near, nearAddr := setupManagerServer(t)
+	follower, _ := setupManagerServer(t)
+
+	// the values tell which server a record was copied from, 200 records
+	// sealing two segments
+	for i := 0; i < 200; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("leader %d", i))})
+		require.NoError(t, err)
+		_, err = near.Append(&api.Record{Value: []byte(fmt.Sprintf("near %d", i))})
+		require.NoError(t, err)
+	}
+
+	r := &log.Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		Local:       follower,
+		Follow: func(name string, tags map[string]string) bool {
+			return tags["role"] == "leader"
+		},
+		Zone: "east",
+	}
+	defer r.Close()
+	require.NoError(t, r.Update("near", map[string]string{"rpc_addr": nearAddr, "zone": "east"}))
+	require.NoError(t, r.Update("leader", map[string]string{"rpc_addr": leaderAddr, "zone": "west", "role": "leader"}))
+
+	f, err := follower.Partition(log.DefaultTopic, 0)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.NextOffset() == 200
+	}, 5*time.Second, 50*time.Millisecond)
+	rec, err := f.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "near 0", string(rec.Value))
+	rec, err = f.Read(199)
+	require.NoError(t, err)
+	require.Equal(t, "leader 199", string(rec.Value))
+}
+
+func setupManagerServer(t *testing.T) (*log.Manager, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "peer_test")
+	require.NoError(t, err)
+	m, err := log.NewManager(dir, log.ManagerConfig{})
+	require.NoError(t, err)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, cleanup, err := NewGRPCServer(m)
+	require.NoError(t, err)
+	go s.Serve(lst)
+	t.Cleanup(func() {
+		s.Stop()
+		cleanup()
+	})
+	return m, lst.Addr().String()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/certs"
+	"github.com/larkiee/distributed_logger/pkg/config"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(dir)
+	require.NoError(t, err)
+	// so the server is sure to check the client certificates
+	files.RequireClientCert = true
+	reloader, err := config.NewReloader(files)
+	require.NoError(t, err)
+	defer reloader.Close()
+	serverTLS := reloader.TLSConfig(config.TLSRequest{IsServer: true})
+	clientTLS := reloader.TLSConfig(config.TLSRequest{ServerAddr: "127.0.0.1"})
+
+	m, err := log.NewManager(t.TempDir(), log.ManagerConfig{})
+	require.NoError(t, err)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, cleanup, err := NewGRPCServer(m, WithServerOptions(grpc.Creds(credentials.NewTLS(serverTLS))))
+	require.NoError(t, err)
+	go s.Serve(lst)
+	defer func() {
+		s.Stop()
+		cleanup()
+	}()
+	dial := func() api.LogClient {
+		cc, err := grpc.Dial(lst.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewLogClient(cc)
+	}
+
+	ctx := context.Background()
+	stream, err := dial().ProduceStream(ctx)
+	require.NoError(t, err)
+	produce := func(value string) {
+		require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte(value)}}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	produce("before")
+
+	// replace the authority and every certificate under the open stream
+	_, err = certs.Rotate(dir, true)
+	require.NoError(t, err)
+	rotated := serial(t, files.ServerCertFile)
+	require.Eventually(t, func() bool {
+		conn, err := tls.Dial("tcp", lst.Addr().String(), clientTLS)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Cmp(rotated) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	produce("after")
+
+	// certificates of another authority are still turned away both ways
+	strangerFiles, err := certs.DevTLSConfig(t.TempDir())
+	require.NoError(t, err)
+	stranger, err := config.NewReloader(strangerFiles)
+	require.NoError(t, err)
+	defer stranger.Close()
+	_, err = tls.Dial("tcp", lst.Addr().String(), stranger.TLSConfig(config.TLSRequest{ServerAddr: "127.0.0.1"}))
+	require.Error(t, err)
+	strangerTLS := stranger.TLSConfig(config.TLSRequest{ServerAddr: "127.0.0.1"})
+	strangerTLS.VerifyConnection = nil
+	conn, err := tls.Dial("tcp", lst.Addr().String(), strangerTLS)
+	if err == nil {
+		// TLS 1.3 clients learn of a rejected certificate on first read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	require.Error(t, err)
+	require.NoError(t, stream.CloseSend())
+
+	consume, err := dial().ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for _, want := range []string{"before", "after"} {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+}
+
+func serial(t *testing.T, path string) *big.Int {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert.SerialNumber
+}
@@ -10,19 +10,25 @@ import (
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	"github.com/larkiee/distributed_logger/api/v1"
 	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/tracing"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
-	"go.opentelemetry.io/otel/sdk/trace"
-	"go.uber.org/zap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-var (
-	tracer = otel.Tracer("Producer")
+const (
+	// maxOffsetWait bounds how long a consume waits for its min offset.
+	maxOffsetWait = 10 * time.Second
+	// offsetPollInterval is how often a waiting consume checks the log.
+	offsetPollInterval = 10 * time.Millisecond
 )
 
-func NewGRPCServer(l Logger, srvOpts ...grpc.ServerOption) (*grpc.Server, func(), error) {
+func NewGRPCServer(l Logger, opts ...Option) (*grpc.Server, func(), error) {
 	var logger Logger
 	var err error
 	switch v := l.(type) {
@@ -42,31 +48,33 @@ func NewGRPCServer(l Logger, srvOpts ...grpc.ServerOption) (*grpc.Server, func()
 		}else {
 			logger = l
 		}
+	case *log.Manager:
+		logger = v
 	default:
 		return nil, nil, errors.New("not recognisable logger")
 	}
-	zl, _ := zap.NewDevelopment()
-	te, _ := stdouttrace.New(stdouttrace.WithPrettyPrint())
-	tp := trace.NewTracerProvider(trace.WithBatcher(te,
-		// Default is 5s. Set to 1s for demonstrative purposes.
-		trace.WithBatchTimeout(time.Second)))
-	srvOpts = append(srvOpts,
-		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithTracerProvider(tp))),
-		grpc.ChainUnaryInterceptor(
-			logging.UnaryServerInterceptor(interceptorLogger(zl), loggingMiddlewareOpts...),
-		),
-		grpc.ChainStreamInterceptor(
-			otelgrpc.StreamServerInterceptor(),
-			logging.StreamServerInterceptor(interceptorLogger(zl), loggingMiddlewareOpts...),
-		),
+	o := newOptions(opts)
+	srvOpts := append(o.serverOptions,
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithTracerProvider(o.tracerProvider),
+			otelgrpc.WithMeterProvider(o.meterProvider),
+		)),
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{
+			logging.UnaryServerInterceptor(interceptorLogger(o.logger), loggingMiddlewareOpts...),
+		}, o.unary...)...),
+		grpc.ChainStreamInterceptor(append([]grpc.StreamServerInterceptor{
+			logging.StreamServerInterceptor(interceptorLogger(o.logger), loggingMiddlewareOpts...),
+		}, o.stream...)...),
 	)
 	gsrv := grpc.NewServer(srvOpts...)
 
-	srv, err := newgrpcServer(logger)
+	srv, err := newgrpcServer(logger, o.meterProvider, o.tracerProvider)
 	if err != nil {
 		return nil, nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	api.RegisterAdminServer(gsrv, srv)
+	api.RegisterPeerServer(gsrv, srv)
 	cleanup := func ()  {
 		logger.Remove()
 	}
@@ -79,36 +87,139 @@ type Logger interface {
 	Remove() error
 }
 
+// TopicManager is implemented by loggers that split records into
+// topics and partitions.
+type TopicManager interface {
+	Partition(topic string, partition uint32) (*log.Log, error)
+	PartitionFor(topic string, key []byte) (uint32, error)
+	CreateTopic(name string, c log.TopicConfig) (*log.Topic, error)
+	DeleteTopic(name string) error
+	Topics() []*log.Topic
+}
+
 type grpcServer struct {
 	api.UnimplementedLogServer
+	api.UnimplementedAdminServer
+	api.UnimplementedPeerServer
 	Logger
+	topics TopicManager
+	// subscribers counts the ConsumeStream calls being served.
+	subscribers metric.Int64UpDownCounter
+	tracer      trace.Tracer
 }
 
-func newgrpcServer(l Logger) (*grpcServer, error) {
+func newgrpcServer(l Logger, mp metric.MeterProvider, tp trace.TracerProvider) (*grpcServer, error) {
 
-	s := &grpcServer{Logger: l}
+	s := &grpcServer{
+		Logger: l,
+		tracer: tp.Tracer("github.com/larkiee/distributed_logger/pkg/server"),
+	}
+	if tm, OK := l.(TopicManager); OK {
+		s.topics = tm
+	}
+	var err error
+	s.subscribers, err = mp.Meter("github.com/larkiee/distributed_logger/pkg/server").Int64UpDownCounter(
+		"dlog.consume.subscribers",
+		metric.WithDescription("ConsumeStream calls being served"),
+	)
+	if err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	off, err := s.Append(req.Record)
+	// records produced without a trace context continue the trace of
+	// the call
+	tracing.Inject(ctx, req.Record)
+	return s.produce(req)
+}
+
+// produce appends the record of req to the partition it names, the one
+// its key maps to when it names none, or to the default log when req
+// names no topic.
+func (s *grpcServer) produce(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Topic == "" {
+		off, err := s.Append(req.Record)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{Offset: off}, nil
+	}
+	if s.topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	var partition uint32
+	var err error
+	if req.Partition != nil {
+		partition = *req.Partition
+	} else if partition, err = s.topics.PartitionFor(req.Topic, req.Record.GetKey()); err != nil {
+		return nil, topicError(err)
+	}
+	l, err := s.topics.Partition(req.Topic, partition)
 	if err != nil {
-		return nil, err
+		return nil, topicError(err)
+	}
+	off, err := l.Append(req.Record)
+	if err != nil {
+		return nil, topicError(err)
 	}
-	return &api.ProduceResponse{Offset: off}, nil
+	return &api.ProduceResponse{Offset: off, Partition: partition}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	// _, span := tracer.Start(ctx, "producer")
-	// defer span.End()
-	r, err := s.Read(req.Offset)
+	var l Logger = s.Logger
+	pl, _ := s.Logger.(*log.Log)
+	if req.Topic != "" {
+		if s.topics == nil {
+			return nil, status.Error(codes.Unimplemented, "topics are not supported")
+		}
+		var err error
+		if pl, err = s.topics.Partition(req.Topic, req.Partition); err != nil {
+			return nil, topicError(err)
+		}
+		l = pl
+	}
+	if req.MinOffset != nil {
+		if pl == nil {
+			// the topic manager reads the default topic
+			var err error
+			if pl, err = s.partitionLog(log.DefaultTopic, 0); err != nil {
+				return nil, err
+			}
+		}
+		if err := waitOffset(ctx, pl, *req.MinOffset); err != nil {
+			return nil, err
+		}
+	}
+	r, err := l.Read(req.Offset)
 	if err != nil {
-		return nil, err
+		return nil, topicError(err)
 	}
 
 	return &api.ConsumeResponse{Record: r}, nil
 }
 
+// waitOffset blocks until l holds offset, for clients reading their own
+// writes from a replica that may lag behind. It gives up after
+// maxOffsetWait so the client can go elsewhere.
+func waitOffset(ctx context.Context, l *log.Log, offset uint64) error {
+	timeout := time.NewTimer(maxOffsetWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(offsetPollInterval)
+	defer ticker.Stop()
+	for l.NextOffset() <= offset {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timeout.C:
+			return status.Errorf(codes.Unavailable, "offset %d is not here yet", offset)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	
 	for {
@@ -117,12 +228,13 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 			return err
 		}
 
-		off, err := s.Append(req.Record)
+		tracing.Inject(stream.Context(), req.Record)
+		res, err := s.produce(req)
 		if err != nil {
 			return err
 		}
 
-		err = stream.Send(&api.ProduceResponse{Offset: off})
+		err = stream.Send(res)
 		if err != nil {
 			return err
 		}
@@ -130,6 +242,13 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	topic := req.Topic
+	if topic == "" {
+		topic = log.DefaultTopic
+	}
+	attrs := metric.WithAttributes(attribute.String("topic", topic))
+	s.subscribers.Add(stream.Context(), 1, attrs)
+	defer s.subscribers.Add(context.Background(), -1, attrs)
 	for {
 		select {
 		case <-stream.Context().Done():
@@ -141,7 +260,7 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			default:
 				return err
 			}
-			err = stream.Send(res)
+			err = s.sendTraced(stream, topic, req.Partition, res)
 			if err != nil {
 				return err
 			}
@@ -149,3 +268,28 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 		}
 	}
 }
+
+// sendTraced sends a consumed record in a consumer span linked to the
+// span the record was produced in.
+func (s *grpcServer) sendTraced(stream api.Log_ConsumeStreamServer, topic string, partition uint32, res *api.ConsumeResponse) error {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("dlog"),
+			semconv.MessagingOperationReceive,
+			semconv.MessagingDestinationName(topic),
+			attribute.Int64("dlog.partition", int64(partition)),
+			attribute.Int64("dlog.offset", int64(res.Record.GetOffset())),
+		),
+	}
+	if producer := tracing.SpanContext(res.Record); producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	_, span := s.tracer.Start(stream.Context(), topic+" receive", opts...)
+	defer span.End()
+	if err := stream.Send(res); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
@@ -8,13 +8,12 @@ import (
 	"testing"
 
 	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/certs"
 	"github.com/larkiee/distributed_logger/pkg/config"
 	"github.com/larkiee/distributed_logger/pkg/log"
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 func TestServer(t *testing.T) {
@@ -27,10 +26,16 @@ func TestServer(t *testing.T) {
 		{name: "produce/consume stream succeeds", fn: testProduceConsumeStream},
 	}
 
+	// the server and client read their certificates from a fresh
+	// authority rather than files that expire
+	dir := t.TempDir()
+	files, err := certs.DevTLSConfig(dir)
+	require.NoError(t, err)
+
 	for _, tc := range testCases {
-		addr, cleanupServer := setupServer(t)
+		addr, cleanupServer := setupServer(t, files)
 		logger.Println("Server Address :", addr)
-		client, cleanupClient := setupClient(t, addr)
+		client, cleanupClient := setupClient(t, addr, files)
 		defer func ()  {
 			cleanupClient()
 			cleanupServer()
@@ -42,24 +47,21 @@ func TestServer(t *testing.T) {
 }
 
 
-func setupServer(t *testing.T) (addr string, cleanup func()){
+func setupServer(t *testing.T, files config.TLSConfig) (addr string, cleanup func()){
 	logger.Println("Here...")
 	var l *log.Log
-	ip := viper.GetString("server.ip")
-	port := viper.GetInt("server.port")
-	lst, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, port))
+	ip := "127.0.0.1"
+	lst, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, 0))
 	serverOpts := make([]grpc.ServerOption, 0)
-	if viper.GetBool("tls.use") {
-		tlsCfg, err := config.GetTLSConfig(config.TLSRequest{ServerAddr: ip, IsServer: true})
-		require.NoError(t, err)
-		crends := credentials.NewTLS(tlsCfg)
-		serverOpts = append(serverOpts, 
-			grpc.Creds(crends),
-		)
-	}
+	tlsCfg, err := config.GetTLSConfig(files, config.TLSRequest{ServerAddr: ip, IsServer: true})
+	require.NoError(t, err)
+	crends := credentials.NewTLS(tlsCfg)
+	serverOpts = append(serverOpts, 
+		grpc.Creds(crends),
+	)
 	logger.Println(":::", err)
 	require.NoError(t, err)
-	s, lc,  err := NewGRPCServer(l, serverOpts...)
+	s, lc,  err := NewGRPCServer(l, WithServerOptions(serverOpts...))
 	require.NoError(t, err)
 	go func ()  {
 		s.Serve(lst)
@@ -72,18 +74,13 @@ func setupServer(t *testing.T) (addr string, cleanup func()){
 	return lst.Addr().String(), cleanup
 }
 
-func setupClient(t *testing.T, addr string) (client api.LogClient, cleanup func()) {
+func setupClient(t *testing.T, addr string, files config.TLSConfig) (client api.LogClient, cleanup func()) {
 	t.Helper()
 	clientOpts := []grpc.DialOption{}
-	if viper.GetBool("tls.use") {
-		ip := viper.GetString("server.ip")
-		tlsCfg, err := config.GetTLSConfig(config.TLSRequest{ServerAddr: ip, IsServer: false})
-		require.NoError(t, err)
-		crends := credentials.NewTLS(tlsCfg)
-		clientOpts = append(clientOpts, grpc.WithTransportCredentials(crends))
-	} else {
-		clientOpts = append(clientOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
+	tlsCfg, err := config.GetTLSConfig(files, config.TLSRequest{ServerAddr: "127.0.0.1", IsServer: false})
+	require.NoError(t, err)
+	crends := credentials.NewTLS(tlsCfg)
+	clientOpts = append(clientOpts, grpc.WithTransportCredentials(crends))
 	
 	logger.Println()
 	cc, err := grpc.Dial(addr, clientOpts...)
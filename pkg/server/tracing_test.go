@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPropagation(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	m, err := log.NewManager(t.TempDir(), log.ManagerConfig{})
+	require.NoError(t, err)
+	s, cleanup, err := NewGRPCServer(m,
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))),
+	)
+	require.NoError(t, err)
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lst)
+	defer func() {
+		s.Stop()
+		cleanup()
+	}()
+	cc, err := grpc.Dial(lst.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor),
+		grpc.WithStreamInterceptor(tracing.StreamClientInterceptor),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	// the producer's span travels with the record
+	ctx, producer := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "checkout")
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("a")}})
+	require.NoError(t, err)
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("b")}}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	producer.End()
+	// records produced outside a span continue the trace of the call
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("c")}})
+	require.NoError(t, err)
+
+	consume, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	var records []*api.Record
+	for i := 0; i < 3; i++ {
+		res, err := consume.Recv()
+		require.NoError(t, err)
+		records = append(records, res.Record)
+	}
+	for _, r := range records[:2] {
+		require.Equal(t, producer.SpanContext().SpanID(), tracing.SpanContext(r).SpanID())
+	}
+	// the last Produce span ended is the call of the third record
+	var produceSpan trace.SpanContext
+	for _, span := range spans.Ended() {
+		if span.Name() == "log.v1.Log/Produce" {
+			produceSpan = span.SpanContext()
+		}
+	}
+	require.True(t, produceSpan.IsValid())
+	require.Equal(t, produceSpan.SpanID(), tracing.SpanContext(records[2]).SpanID())
+
+	// every record sent is consumed in a span linked to its producer
+	require.Eventually(t, func() bool {
+		var links []trace.SpanID
+		for _, span := range spans.Ended() {
+			if span.Name() == "default receive" && span.SpanKind() == trace.SpanKindConsumer {
+				for _, l := range span.Links() {
+					links = append(links, l.SpanContext.SpanID())
+				}
+			}
+		}
+		return len(links) >= 3 &&
+			links[0] == producer.SpanContext().SpanID() &&
+			links[1] == producer.SpanContext().SpanID() &&
+			links[2] == produceSpan.SpanID()
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,172 @@
+// Package telemetry builds the tracer and meter providers the spans and
+// metrics of a process are exported through.
+package telemetry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/credentials"
+)
+
+// Exporters spans and metrics can be sent to.
+const (
+	// OTLP sends them to an OpenTelemetry collector over gRPC.
+	OTLP = "otlp"
+	// Stdout prints them, for development.
+	Stdout = "stdout"
+)
+
+type Config struct {
+	// ServiceName names the process in what it exports, dlogd by default.
+	ServiceName string
+	// Exporter is OTLP, Stdout or empty to export nothing.
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector. The exporters fall
+	// back to $OTEL_EXPORTER_OTLP_ENDPOINT and then localhost:4317 when it
+	// is empty.
+	Endpoint string
+	// Insecure talks to the collector in plaintext. TLSConfig secures the
+	// connection otherwise, the system roots verifying it when nil.
+	Insecure  bool
+	TLSConfig *tls.Config
+	// MetricInterval is how often metrics are exported, a minute by
+	// default.
+	MetricInterval time.Duration
+	// Prometheus keeps the metrics for Telemetry.MetricsHandler to serve
+	// besides exporting them.
+	Prometheus bool
+}
+
+// Telemetry holds the providers built from a Config.
+type Telemetry struct {
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+	// MetricsHandler serves the metrics in the Prometheus text format
+	// when Config.Prometheus is set.
+	MetricsHandler http.Handler
+	shutdowns      []func(context.Context) error
+}
+
+func New(c Config) (*Telemetry, error) {
+	if c.ServiceName == "" {
+		c.ServiceName = "dlogd"
+	}
+	if c.MetricInterval == 0 {
+		c.MetricInterval = time.Minute
+	}
+	t := &Telemetry{
+		TracerProvider: tracenoop.NewTracerProvider(),
+		MeterProvider:  metricnoop.NewMeterProvider(),
+	}
+	var spans sdktrace.SpanExporter
+	var metrics sdkmetric.Exporter
+	var err error
+	switch c.Exporter {
+	case "":
+		if !c.Prometheus {
+			return t, nil
+		}
+	case OTLP:
+		if spans, err = otlptracegrpc.New(context.Background(), c.traceOptions()...); err != nil {
+			return nil, err
+		}
+		if metrics, err = otlpmetricgrpc.New(context.Background(), c.metricOptions()...); err != nil {
+			spans.Shutdown(context.Background())
+			return nil, err
+		}
+	case Stdout:
+		if spans, err = stdouttrace.New(stdouttrace.WithPrettyPrint()); err != nil {
+			return nil, err
+		}
+		if metrics, err = stdoutmetric.New(stdoutmetric.WithPrettyPrint()); err != nil {
+			spans.Shutdown(context.Background())
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", c.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(c.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	if spans != nil {
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spans), sdktrace.WithResource(res))
+		t.TracerProvider = tp
+		t.shutdowns = append(t.shutdowns, tp.Shutdown)
+	}
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	if metrics != nil {
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics, sdkmetric.WithInterval(c.MetricInterval))))
+	}
+	if c.Prometheus {
+		// a registry of our own, the default one would fail on a second
+		// Telemetry in the process
+		registry := prometheus.NewRegistry()
+		reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdkmetric.WithReader(reader))
+		t.MetricsHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	}
+	mp := sdkmetric.NewMeterProvider(opts...)
+	t.MeterProvider = mp
+	t.shutdowns = append(t.shutdowns, mp.Shutdown)
+	return t, nil
+}
+
+func (c Config) traceOptions() []otlptracegrpc.Option {
+	var opts []otlptracegrpc.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else if c.TLSConfig != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(c.TLSConfig)))
+	}
+	return opts
+}
+
+func (c Config) metricOptions() []otlpmetricgrpc.Option {
+	var opts []otlpmetricgrpc.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else if c.TLSConfig != nil {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(c.TLSConfig)))
+	}
+	return opts
+}
+
+// Shutdown exports what is left and stops the exporters.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, shutdown := range t.shutdowns {
+		errs = append(errs, shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package telemetry
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/larkiee/distributed_logger/pkg/log"
+	"github.com/larkiee/distributed_logger/pkg/server"
+	"github.com/stretchr/testify/require"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// collector keeps the names of the spans and metrics exported to it.
+type collector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	colmetricpb.UnimplementedMetricsServiceServer
+
+	mu      sync.Mutex
+	spans   map[string]string
+	metrics map[string]bool
+}
+
+func (c *collector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		service := ""
+		for _, kv := range rs.Resource.Attributes {
+			if kv.Key == "service.name" {
+				service = kv.Value.GetStringValue()
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = service
+			}
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type metricsService struct {
+	*collector
+}
+
+func (m metricsService) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				m.metrics[metric.Name] = true
+			}
+		}
+	}
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLP(t *testing.T) {
+	c := &collector{spans: make(map[string]string), metrics: make(map[string]bool)}
+	gsrv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(gsrv, c)
+	colmetricpb.RegisterMetricsServiceServer(gsrv, metricsService{c})
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(lst)
+	defer gsrv.Stop()
+
+	tel, err := New(Config{
+		ServiceName: "dlogd-test",
+		Exporter:    OTLP,
+		Endpoint:    lst.Addr().String(),
+		Insecure:    true,
+	})
+	require.NoError(t, err)
+
+	m, err := log.NewManager(t.TempDir(), log.ManagerConfig{})
+	require.NoError(t, err)
+	s, cleanup, err := server.NewGRPCServer(m,
+		server.WithTracerProvider(tel.TracerProvider),
+		server.WithMeterProvider(tel.MeterProvider),
+	)
+	require.NoError(t, err)
+	slst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(slst)
+	defer func() {
+		s.Stop()
+		cleanup()
+	}()
+	cc, err := grpc.Dial(slst.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	_, err = api.NewLogClient(cc).Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	// shutting down flushes the batches
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, tel.Shutdown(ctx))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.Equal(t, "dlogd-test", c.spans["log.v1.Log/Produce"])
+	require.True(t, c.metrics["rpc.server.duration"], "%v", c.metrics)
+}
+
+func TestNew(t *testing.T) {
+	tel, err := New(Config{})
+	require.NoError(t, err)
+	require.NoError(t, tel.Shutdown(context.Background()))
+	_, err = New(Config{Exporter: "zipkin"})
+	require.Error(t, err)
+}
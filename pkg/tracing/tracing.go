@@ -0,0 +1,92 @@
+// Package tracing carries W3C trace context in record headers, so a trace
+// follows a record from its producer through the log to its consumers.
+package tracing
+
+import (
+	"context"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+var propagator = propagation.TraceContext{}
+
+// headers adapts record headers to the propagators.
+type headers map[string]string
+
+func (h headers) Get(key string) string {
+	return h[key]
+}
+
+func (h headers) Set(key, value string) {
+	h[key] = value
+}
+
+func (h headers) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject puts the trace context of the span in ctx in the headers of r,
+// unless they already carry one, as records mirrored or produced through
+// an interceptor do.
+func Inject(ctx context.Context, r *api.Record) {
+	if r == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if _, OK := r.Headers["traceparent"]; OK {
+		return
+	}
+	if r.Headers == nil {
+		r.Headers = make(map[string]string)
+	}
+	propagator.Inject(ctx, headers(r.Headers))
+}
+
+// Extract returns ctx with the trace context in the headers of r as its
+// remote span context, for consumers to continue the producer's trace.
+func Extract(ctx context.Context, r *api.Record) context.Context {
+	return propagator.Extract(ctx, headers(r.GetHeaders()))
+}
+
+// SpanContext returns the span context r was produced in, invalid when
+// its headers carry none.
+func SpanContext(r *api.Record) trace.SpanContext {
+	return trace.SpanContextFromContext(Extract(context.Background(), r))
+}
+
+// UnaryClientInterceptor injects the trace context of the calling span in
+// the records produced, adding the headers to the records of the caller.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if p, OK := req.(*api.ProduceRequest); OK {
+		Inject(ctx, p.Record)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// StreamClientInterceptor injects the trace context of the span the
+// stream was opened in in every record sent on it.
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &injectingStream{ClientStream: cs, ctx: ctx}, nil
+}
+
+type injectingStream struct {
+	grpc.ClientStream
+	ctx context.Context
+}
+
+func (s *injectingStream) SendMsg(m interface{}) error {
+	if p, OK := m.(*api.ProduceRequest); OK {
+		Inject(s.ctx, p.Record)
+	}
+	return s.ClientStream.SendMsg(m)
+}
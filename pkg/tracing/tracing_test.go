@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/larkiee/distributed_logger/api/v1"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInject(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "produce")
+	defer span.End()
+
+	r := &api.Record{Value: []byte("hello")}
+	Inject(context.Background(), r)
+	require.Nil(t, r.Headers)
+	require.False(t, SpanContext(r).IsValid())
+
+	Inject(ctx, r)
+	require.Contains(t, r.Headers, "traceparent")
+	sc := SpanContext(r)
+	require.True(t, sc.IsRemote())
+	require.Equal(t, span.SpanContext().TraceID(), sc.TraceID())
+	require.Equal(t, span.SpanContext().SpanID(), sc.SpanID())
+
+	// the context a record already carries is kept
+	_, other := tp.Tracer("test").Start(context.Background(), "other")
+	defer other.End()
+	Inject(trace.ContextWithSpan(context.Background(), other), r)
+	require.Equal(t, span.SpanContext().SpanID(), SpanContext(r).SpanID())
+}